@@ -0,0 +1,143 @@
+// The startup benchmark workers run so the server has an idea of how fast
+// they are before they have compiled anything.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"log"
+	"strings"
+)
+
+// Compiler used for the startup benchmark, none is run if empty
+var benchmarkCompiler = "gcc"
+
+// How many times the benchmark is compiled, the fastest run counts
+const benchmarkRuns = 3
+
+// A self contained bit of C with enough going on to keep the optimizer busy
+const benchmarkSource = `
+struct node {
+	int key;
+	struct node *left, *right;
+};
+
+static struct node *insert(struct node *n, struct node *pool, int *used, int key)
+{
+	if (!n) {
+		n = &pool[(*used)++];
+		n->key = key;
+		n->left = n->right = 0;
+	} else if (key < n->key) {
+		n->left = insert(n->left, pool, used, key);
+	} else {
+		n->right = insert(n->right, pool, used, key);
+	}
+	return n;
+}
+
+static int depth(const struct node *n)
+{
+	int l, r;
+
+	if (!n)
+		return 0;
+
+	l = depth(n->left);
+	r = depth(n->right);
+	return 1 + (l > r ? l : r);
+}
+
+static void sort(int *a, int n)
+{
+	int i, j, t;
+
+	for (i = 1; i < n; i++) {
+		t = a[i];
+		for (j = i; j > 0 && a[j - 1] > t; j--)
+			a[j] = a[j - 1];
+		a[j] = t;
+	}
+}
+
+static unsigned hash(const char *s)
+{
+	unsigned h = 5381;
+
+	while (*s)
+		h = h * 33 + (unsigned char)*s++;
+	return h;
+}
+
+static void matmul(const double *a, const double *b, double *c, int n)
+{
+	int i, j, k;
+
+	for (i = 0; i < n; i++)
+		for (j = 0; j < n; j++) {
+			double sum = 0;
+			for (k = 0; k < n; k++)
+				sum += a[i * n + k] * b[k * n + j];
+			c[i * n + j] = sum;
+		}
+}
+
+int benchmark(int seed)
+{
+	struct node pool[64];
+	struct node *root = 0;
+	int used = 0, i, values[64];
+	double a[16], b[16], c[16];
+
+	for (i = 0; i < 64; i++) {
+		values[i] = (seed * 1103515245 + 12345 * i) & 0xffff;
+		root = insert(root, pool, &used, values[i]);
+	}
+
+	sort(values, 64);
+
+	for (i = 0; i < 16; i++) {
+		a[i] = values[i];
+		b[i] = values[63 - i];
+	}
+
+	matmul(a, b, c, 4);
+
+	return depth(root) + values[0] + (int)c[5] + (int)hash("benchmark");
+}
+`
+
+// runBenchmark compiles the benchmark source and returns how many KB of it
+// the compiler gets through per CPU second, or zero if it can't be compiled
+func runBenchmark(compiler string) float64 {
+	if len(compiler) == 0 {
+		return 0
+	}
+
+	job := CompileJob{
+		Build:    ParseArgs(strings.Split("-O2 -c benchmark.c -o benchmark.o", " ")),
+		Input:    []byte(benchmarkSource),
+		Compiler: compiler,
+	}
+
+	best := 0.0
+
+	for i := 0; i < benchmarkRuns; i++ {
+		result, err := job.Compile()
+
+		if err != nil || result.Return != 0 || result.CPUTime <= 0 {
+			log.Printf("Benchmark with %s failed: %s %s", compiler, err,
+				result.Output)
+			return 0
+		}
+
+		speed := float64(len(job.Input)) / result.CPUTime.Seconds() / 1024
+
+		if speed > best {
+			best = speed
+		}
+	}
+
+	return best
+}
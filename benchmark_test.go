@@ -0,0 +1,29 @@
+// Tests for the worker startup benchmark.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestRunBenchmark(t *testing.T) {
+	if _, err := exec.LookPath(benchmarkCompiler); err != nil {
+		t.Skip("No benchmark compiler: ", err)
+	}
+
+	if speed := runBenchmark(benchmarkCompiler); speed <= 0 {
+		t.Errorf("Got benchmark speed %f", speed)
+	}
+
+	// Missing compilers just mean no benchmark
+	if speed := runBenchmark("cbd-no-such-compiler"); speed != 0 {
+		t.Errorf("Got speed %f for a missing compiler", speed)
+	}
+
+	if speed := runBenchmark(""); speed != 0 {
+		t.Errorf("Got speed %f with no compiler", speed)
+	}
+}
@@ -6,17 +6,30 @@
 package cbd
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// How many times we ask the server for another worker when the one we
+// were given is too busy to take our job
+const maxBusyRetries = 3
+
+// Returned by buildRemote when the worker turned away our job
+var errWorkerBusy = errors.New("Worker is too busy to take the job")
+
+// ClientBuildJob builds the job on a worker, or locally if none can be
+// found, and writes out the object file on success.  The time taken to
+// preprocess the job is passed in so it can be reported with the rest.
 // TODO: this needs some tests
-func ClientBuildJob(job CompileJob) (cresults CompileResult, err error) {
+func ClientBuildJob(job CompileJob, preprocess time.Duration) (cresults CompileResult, err error) {
 	address := os.Getenv("CBD_POTENTIAL_HOST")
-	server := os.Getenv("CBD_SERVER")
+	servers := SplitList(os.Getenv("CBD_SERVER"))
 	local := false
 
 	// Grab our ID
@@ -27,33 +40,76 @@ func ClientBuildJob(job CompileJob) (cresults CompileResult, err error) {
 	}
 
 	var worker MachineName
+	var jobID GUID
 
-	// If we have a server, but no hosts, go with the server
-	if len(address) == 0 && len(server) > 0 {
-		server = addPortIfNeeded(server, DefaultServerPort)
+	// Only go back to the server for a new worker if it gave us the first one
+	useServer := len(address) == 0 && len(servers) > 0
 
-		address, worker, err = findWorker(server)
+	// The server we got our worker from, which we report back to
+	var server string
 
-		if err != nil {
-			log.Print("Find worker error: ", err)
+	// When we started building the job
+	var start time.Time
+
+	// Where the time went, the worker fills in its part
+	var timing JobTiming
+
+	// Connection to the server which scheduled the job, we tell it how the
+	// job goes until we close it
+	var events *MessageConn
+
+	defer func() {
+		if events != nil {
+			events.Close()
 		}
-	}
+	}()
+
+	for attempt := 0; ; attempt++ {
+		// If we have a server, but no hosts, go with the server
+		if useServer {
+			if events != nil {
+				events.Close()
+			}
 
-	// Get when we start building
-	start := time.Now()
+			findStart := time.Now()
+			events, server, address, worker, jobID, err = findWorker(servers, job)
+			timing.Queue += time.Since(findStart)
+
+			if err != nil {
+				log.Print("Find worker error: ", err)
+			}
+		}
+
+		// Get when we start building
+		start = time.Now()
+
+		// Try to build on the remote host if we have found one
+		if len(address) == 0 {
+			local = true
+			break
+		}
 
-	// Try to build on the remote host if we have found one
-	if len(address) > 0 {
 		address = addPortIfNeeded(address, DefaultWorkerPort)
-		cresults, err = buildRemote(address, job)
+		job.ID = jobID
+		cresults, err = buildRemote(address, job, &timing, events)
+
+		if err != nil {
+			sendJobEvent(events, JobFailed, err.Error())
+		}
+
+		// A busy worker means we can ask for a different one
+		if err == errWorkerBusy && useServer && attempt < maxBusyRetries {
+			log.Print("Worker busy, finding another: ", address)
+			continue
+		}
 
 		// If the remote build failed switch to local
 		if err != nil {
 			log.Print("Remote build error: ", err)
 			local = true
 		}
-	} else {
-		local = true
+
+		break
 	}
 
 	// Disable local builds when in our special test mode
@@ -71,19 +127,35 @@ func ClientBuildJob(job CompileJob) (cresults CompileResult, err error) {
 
 	// Build it locally if all else has failed
 	if local {
+		compileStart := time.Now()
 		cresults, err = job.Compile()
+		timing.Compile = time.Since(compileStart)
+		timing.CPU = cresults.CPUTime
 
 		// Local build so we are building things
 		worker = ln
 	}
 
-	// Report to server if we have a connection
-	if len(server) > 0 {
-		stop := time.Now()
+	stop := time.Now()
+	timing.Preprocess = preprocess
 
+	// Now write the results to right output location
+	if err == nil && cresults.Return == 0 {
+		err = writeObjectCode(job.Build.Output(), cresults.ObjectCode)
+		timing.Write = time.Since(stop)
+	}
+
+	// Report to server if we have a connection
+	if len(servers) > 0 {
 		duration := stop.Sub(start)
 
-		errj := reportCompletion(server, ln, worker, job, cresults, duration)
+		// Stick with the server that scheduled the job if there was one
+		if len(server) > 0 {
+			servers = []string{server}
+		}
+
+		errj := reportCompletion(servers, jobID, ln, worker, job, cresults,
+			duration, timing)
 
 		if errj != nil {
 			log.Print("Report job error: ", errj)
@@ -93,21 +165,83 @@ func ClientBuildJob(job CompileJob) (cresults CompileResult, err error) {
 	return
 }
 
-// findWorker uses a central server to find the desired worker
-func findWorker(server string) (address string, worker MachineName, err error) {
-	DebugPrint("Finding worker server: ", server)
+// ParsePriority reads a CBD_PRIORITY value of the form "class", "class:n"
+// or "n", where class is "interactive" or "ci" and n is the priority.  The
+// ci class defaults to a priority below interactive builds.
+func ParsePriority(str string) (class JobClass, priority int, err error) {
+	if len(str) == 0 {
+		return InteractiveClass, 0, nil
+	}
+
+	parts := strings.SplitN(str, ":", 2)
+
+	// A bare number is just an interactive priority
+	if n, perr := strconv.Atoi(parts[0]); perr == nil && len(parts) == 1 {
+		return InteractiveClass, n, nil
+	}
+
+	class, err = ParseJobClass(parts[0])
+
+	if err != nil {
+		return class, 0, err
+	}
+
+	if class == CIClass {
+		priority = -1
+	}
+
+	if len(parts) == 2 {
+		priority, err = strconv.Atoi(parts[1])
+	}
+
+	return class, priority, err
+}
+
+// How long to wait for a worker before building locally, from the
+// CBD_QUEUE_TIMEOUT duration (ex: "30s")
+func queueTimeout() time.Duration {
+	d := time.Duration(10) * time.Second
+
+	if str := os.Getenv("CBD_QUEUE_TIMEOUT"); len(str) > 0 {
+		v, err := time.ParseDuration(str)
 
-	// Set a timeout for this entire process and just build locally
-	quittime := time.Now().Add(time.Duration(10) * time.Second)
+		if err != nil {
+			log.Print("Ignoring CBD_QUEUE_TIMEOUT: ", err)
+		} else {
+			d = v
+		}
+	}
+
+	return d
+}
+
+// findWorker uses the first central server it can reach to find the
+// desired worker, returning the server it used.  When a worker is found the
+// connection to the server is left open to send it the events of the job.
+func findWorker(servers []string, job CompileJob) (mc *MessageConn, server string, address string, worker MachineName, jobID GUID, err error) {
+	DebugPrint("Finding worker servers: ", servers)
+
+	// Set a timeout for this entire process and just build locally, we give
+	// the server a little extra time to expire the request itself
+	wait := queueTimeout()
+	quittime := time.Now().Add(wait + time.Duration(2)*time.Second)
 
 	// Connect to server
-	mc, err := NewTCPMessageConn(server, time.Duration(10)*time.Second)
+	mc, server, err = dialServers(servers, time.Duration(10)*time.Second)
 
 	if err != nil {
 		return
 	}
 
-	DebugPrint("  Connected")
+	// Only hang on to the connection when we got a worker
+	defer func() {
+		if err != nil {
+			mc.Close()
+			mc = nil
+		}
+	}()
+
+	DebugPrint("  Connected to ", server)
 
 	// Get hostname
 	hostname, err := os.Hostname()
@@ -125,8 +259,14 @@ func findWorker(server string) (address string, worker MachineName, err error) {
 
 	// Send our request
 	rq := WorkerRequest{
-		Client: hostname,
-		Addrs:  addrs,
+		Client:   hostname,
+		User:     os.Getenv("USER"),
+		Addrs:    addrs,
+		Class:    job.Class,
+		Priority: job.Priority,
+		Wait:     wait,
+		File:     job.Build.Input(),
+		JobID:    job.ID,
 	}
 	mc.Send(rq)
 
@@ -150,8 +290,13 @@ Loop:
 				err = fmt.Errorf("Timed out waiting for a free worker")
 				return
 			} else {
-				DebugPrint("No workers available waiting...")
+				DebugPrintf("No workers available waiting... (position: %d, "+
+					"estimated wait: %s)", r.Position, r.EstimatedWait)
 			}
+		case Expired:
+			// The server gave up finding us a worker
+			err = fmt.Errorf("Timed out waiting for a free worker")
+			return
 		case NoWorkers:
 			// No workers present in cluster bail out
 			err = fmt.Errorf("No workers in cluster")
@@ -174,37 +319,60 @@ Loop:
 
 	DebugPrintf("Using worker: %s (%s)", r.Host, address)
 
-	return address, worker, nil
+	return mc, server, address, worker, r.JobID, nil
 }
 
-// Reports the completion of the given job to the server
-func reportCompletion(address string, c MachineName, w MachineName, j CompileJob, r CompileResult, d time.Duration) error {
+// sendJobEvent tells the server how the job is going, if it scheduled it
+func sendJobEvent(mc *MessageConn, t JobEventType, reason string) {
+	if mc == nil {
+		return
+	}
+
+	err := mc.Send(JobEvent{Type: t, Reason: reason})
+
+	if err != nil {
+		DebugPrint("Error sending job event: ", err)
+	}
+}
+
+// Reports the completion of the given job to the first server we can reach
+func reportCompletion(servers []string, id GUID, c MachineName, w MachineName, j CompileJob, r CompileResult, d time.Duration, t JobTiming) error {
 
 	jc := CompletedJob{
+		ID:          id,
 		Client:      c,
 		Worker:      w,
+		File:        j.Build.Input(),
+		Compiler:    filepath.Base(j.Compiler),
+		Return:      r.Return,
 		InputSize:   len(j.Input),
 		OutputSize:  len(r.ObjectCode),
 		CompileTime: d,
+		Timing:      t,
+		BuildID:     os.Getenv("CBD_BUILD_ID"),
 	}
 
 	jc.computeCompileSpeed()
 
 	// Connect to server (short timeout here so we don't hold up the build)
-	mc, err := NewTCPMessageConn(address, time.Duration(1)*time.Second)
+	mc, _, err := dialServers(servers, time.Duration(1)*time.Second)
 
 	if err != nil {
 		return err
 	}
 
+	defer mc.Close()
+
 	// Send completion
 	err = mc.Send(jc)
 
 	return err
 }
 
-// Build the given job on the remote host
-func buildRemote(address string, job CompileJob) (CompileResult, error) {
+// Build the given job on the remote host, filling in the worker's part of
+// the timing along with the upload and download times.  The transfers are
+// reported as events to the server, if we have a connection to it.
+func buildRemote(address string, job CompileJob, timing *JobTiming, events *MessageConn) (CompileResult, error) {
 	DebugPrint("Building on worker: ", address)
 
 	var result CompileResult
@@ -219,7 +387,11 @@ func buildRemote(address string, job CompileJob) (CompileResult, error) {
 	DebugPrint("  Connected")
 
 	// Send the build job
+	sendJobEvent(events, JobUploadStart, "")
+	sendStart := time.Now()
 	mc.Send(job)
+	sent := time.Now()
+	sendJobEvent(events, JobUploadEnd, "")
 
 	// Read back our result
 	result, err = mc.ReadCompileResult()
@@ -228,7 +400,43 @@ func buildRemote(address string, job CompileJob) (CompileResult, error) {
 		return result, err
 	}
 
+	if result.Busy {
+		return result, errWorkerBusy
+	}
+
+	sendJobEvent(events, JobDownload, "")
+
+	// Whatever part of the wait the worker didn't spend queued or compiling
+	// was spent sending the results back
+	timing.Upload = sent.Sub(sendStart)
+	timing.Queue += result.Timing.Queue
+	timing.Compile = result.Timing.Compile
+	timing.CPU = result.Timing.CPU
+	timing.Download = time.Since(sent) - result.Timing.Queue -
+		result.Timing.Compile
+
+	if timing.Download < 0 {
+		timing.Download = 0
+	}
+
 	DebugPrint("Build complete")
 
 	return result, nil
 }
+
+// Writes the object code out to the given path
+func writeObjectCode(path string, code []byte) error {
+	f, err := os.Create(path)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(code)
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
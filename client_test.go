@@ -0,0 +1,81 @@
+// Tests for the client side functions.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePriority(t *testing.T) {
+	type result struct {
+		class    JobClass
+		priority int
+	}
+
+	tests := map[string]result{
+		"":              {InteractiveClass, 0},
+		"5":             {InteractiveClass, 5},
+		"interactive":   {InteractiveClass, 0},
+		"interactive:3": {InteractiveClass, 3},
+		"ci":            {CIClass, -1},
+		"ci:2":          {CIClass, 2},
+	}
+
+	for str, eres := range tests {
+		class, priority, err := ParsePriority(str)
+
+		if err != nil {
+			t.Errorf("Error parsing '%s': %s", str, err)
+			continue
+		}
+
+		if class != eres.class || priority != eres.priority {
+			t.Errorf("Parsing '%s' got %s:%d wanted %s:%d", str, class,
+				priority, eres.class, eres.priority)
+		}
+	}
+
+	for _, bad := range []string{"nightly", "ci:high"} {
+		if _, _, err := ParsePriority(bad); err == nil {
+			t.Errorf("Expected error parsing: %s", bad)
+		}
+	}
+}
+
+func TestComputeCompileSpeed(t *testing.T) {
+	// Input compiled per CPU second is the speed
+	cj := CompletedJob{
+		InputSize:   8192,
+		CompileTime: 8 * time.Second,
+		Timing: JobTiming{
+			Queue:   4 * time.Second,
+			Compile: 4 * time.Second,
+			CPU:     2 * time.Second,
+		},
+	}
+
+	cj.computeCompileSpeed()
+
+	if cj.CompileSpeed != 4 {
+		t.Errorf("Got speed %f wanted 4", cj.CompileSpeed)
+	}
+
+	// Without a CPU time only the time the compiler ran counts
+	cj.Timing.CPU = 0
+	cj.computeCompileSpeed()
+
+	if cj.CompileSpeed != 2 {
+		t.Errorf("Got speed %f wanted 2", cj.CompileSpeed)
+	}
+
+	// Without a breakdown fall back to the whole time
+	cj.Timing = JobTiming{}
+	cj.computeCompileSpeed()
+
+	if cj.CompileSpeed != 1 {
+		t.Errorf("Got speed %f wanted 1", cj.CompileSpeed)
+	}
+}
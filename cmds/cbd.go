@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/jlisee/cbd"
@@ -73,6 +80,34 @@ func main() {
 	// Input arguments
 	port := new(uint)
 	server := new(string)
+	jobs := new(int)
+	scheduler := new(string)
+	shareBy := new(string)
+	shareWeights := new(string)
+	classCaps := new(string)
+	queueTimeout := new(time.Duration)
+	workerTimeout := new(time.Duration)
+	stateFile := new(string)
+	historyFile := new(string)
+	httpPort := new(int)
+	plain := new(bool)
+	format := new(string)
+	clients := new(string)
+	workers := new(string)
+	failures := new(bool)
+	stateRate := new(time.Duration)
+	since := new(time.Duration)
+	until := new(time.Duration)
+	host := new(string)
+	file := new(string)
+	limit := new(int)
+	byFile := new(bool)
+	build := new(string)
+	trace := new(string)
+
+	// Flags of the server command
+	serverFlags := []string{"port", "scheduler", "queue-timeout",
+		"worker-timeout", "state-file", "history-file", "http-port"}
 
 	// Command map
 	commands := make(map[string]Command)
@@ -81,27 +116,74 @@ func main() {
 	cmdUpdate := map[string]Command{
 		"server": {
 			fn: func() {
-				runServer(int(*port))
+				runServer(int(*port), *scheduler, *shareBy, *shareWeights,
+					*classCaps, *queueTimeout, *workerTimeout, *stateFile,
+					*historyFile, *httpPort)
 			},
 			help:  "Run central scheduler",
-			flags: []string{"port"},
+			flags: serverFlags,
 			port:  cbd.DefaultServerPort,
 		},
 		"worker": {
 			fn: func() {
-				runWorker(*server, int(*port))
+				if flag.Arg(0) == "drain" {
+					runDrain(*server, "")
+				} else {
+					runWorker(*server, int(*port), *jobs, *httpPort)
+				}
 			},
-			help:  "Run build slave",
-			flags: []string{"server", "port"},
+			help:  "Run build slave, \"worker drain\" drains this machine's worker",
+			flags: []string{"server", "port", "jobs", "http-port"},
 			// Automatically pick listening port
 			port: 0,
 		},
+		"drain": {
+			fn: func() {
+				runDrain(*server, flag.Arg(0))
+			},
+			help:  "Drain the worker with the given host name or ID",
+			flags: []string{"server"},
+		},
+		"history": {
+			fn: func() {
+				now := time.Now()
+				q := cbd.HistoryQuery{
+					Start: now.Add(-*since),
+					Host:  *host,
+					File:  *file,
+					Build: *build,
+					Limit: *limit,
+				}
+
+				if *until > 0 {
+					q.End = now.Add(-*until)
+				}
+
+				runHistory(*server, q, *byFile, *trace)
+			},
+			help:  "Query the server's history of completed jobs",
+			flags: []string{"server", "history", "trace"},
+		},
+		"build": {
+			fn: func() {
+				runBuild(*server, *trace, flag.Args())
+			},
+			help:  "Run a build, \"build -- make -j64\", then summarize its jobs",
+			flags: []string{"server", "trace"},
+		},
 		"monitor": {
 			fn: func() {
-				runMonitor(*server)
+				filter := cbd.MonitorFilter{
+					Clients:   cbd.SplitList(*clients),
+					Workers:   cbd.SplitList(*workers),
+					Failures:  *failures,
+					StateRate: *stateRate,
+				}
+
+				runMonitor(*server, *plain, *format, filter)
 			},
 			help:  "Run monitoring CLI",
-			flags: []string{"server"},
+			flags: []string{"server", "plain", "format", "filter"},
 		},
 		"help": {
 			fn: func() {
@@ -154,6 +236,75 @@ func main() {
 			defS := os.Getenv("CBD_SERVER")
 			flag.StringVar(server, "server", defS, "Address of the server")
 		}
+		if cmd.hasFlag("scheduler") {
+			flag.StringVar(scheduler, "scheduler", "fifo", "Scheduling policy: "+
+				strings.Join(cbd.SchedulerNames, ", "))
+			flag.StringVar(shareBy, "share-by", "host",
+				"Share the cluster fairly between each: host, user")
+			flag.StringVar(shareWeights, "share-weights", "",
+				"Relative shares of hosts or users, ex: alice=2,ci=0.5")
+			flag.StringVar(classCaps, "class-caps", "",
+				"Max fraction of the cluster for a job class, ex: ci=0.5")
+		}
+		if cmd.hasFlag("queue-timeout") {
+			flag.DurationVar(queueTimeout, "queue-timeout",
+				cbd.DefaultQueueTimeout, "Max time a job waits for a worker")
+		}
+		if cmd.hasFlag("worker-timeout") {
+			flag.DurationVar(workerTimeout, "worker-timeout",
+				cbd.DefaultWorkerTimeout, "Drop workers not heard from in this long")
+		}
+		if cmd.hasFlag("state-file") {
+			flag.StringVar(stateFile, "state-file", "",
+				"File to save learned worker speeds and stats in")
+		}
+		if cmd.hasFlag("history-file") {
+			flag.StringVar(historyFile, "history-file", "",
+				"Log every completed job to this file")
+		}
+		if cmd.hasFlag("http-port") {
+			flag.IntVar(httpPort, "http-port", 0,
+				"Serve status and /metrics over HTTP on this port")
+		}
+		if cmd.hasFlag("plain") {
+			flag.BoolVar(plain, "plain", false,
+				"Print a line per update instead of the full screen view")
+		}
+		if cmd.hasFlag("format") {
+			flag.StringVar(format, "format", "text",
+				"Output format: text, json (a line per update) or csv")
+		}
+		if cmd.hasFlag("filter") {
+			flag.StringVar(clients, "clients", "",
+				"Only jobs from these client hosts, ex: laptop,ci-1")
+			flag.StringVar(workers, "workers", "",
+				"Only jobs on and state of these workers, by host or ID")
+			flag.BoolVar(failures, "failures", false, "Only jobs which failed")
+			flag.DurationVar(stateRate, "state-rate", 0,
+				"Get worker state at most this often, ex: 5s")
+		}
+		if cmd.hasFlag("history") {
+			flag.DurationVar(since, "since", time.Duration(24)*time.Hour,
+				"Only jobs completed within this long")
+			flag.DurationVar(until, "until", 0,
+				"Only jobs completed at least this long ago")
+			flag.StringVar(host, "host", "", "Only jobs from or on this host")
+			flag.StringVar(file, "file", "",
+				"Only jobs whose source file contains this")
+			flag.StringVar(build, "build", "",
+				"Only jobs of the build with this CBD_BUILD_ID")
+			flag.IntVar(limit, "limit", 0, "Only this many of the latest jobs")
+			flag.BoolVar(byFile, "by-file", false,
+				"Total up time by source file, slowest first")
+		}
+		if cmd.hasFlag("trace") {
+			flag.StringVar(trace, "trace", "",
+				"Write the jobs to this file as a Chrome trace, for Perfetto")
+		}
+		if cmd.hasFlag("jobs") {
+			flag.IntVar(jobs, "jobs", runtime.NumCPU(),
+				"Number of compile jobs to run at once")
+		}
 
 		flag.Parse()
 
@@ -167,7 +318,7 @@ func main() {
 	}
 }
 
-func runWorker(saddr string, iport int) {
+func runWorker(saddr string, iport int, jobs int, httpPort int) {
 	log.Print("Worker starting...")
 
 	// Listen on any address
@@ -179,17 +330,103 @@ func runWorker(saddr string, iport int) {
 
 	log.Print("  Listening on port: ", port)
 
-	w, err := cbd.NewWorker(port, saddr)
+	log.Print("  Running up to jobs: ", jobs)
+
+	w, err := cbd.NewWorker(port, saddr, jobs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	// Serve up our metrics for monitoring
+	if httpPort > 0 {
+		hln, err := net.Listen("tcp", ":"+strconv.Itoa(httpPort))
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Print("  Metrics on port: ", httpPort)
+
+		go func() {
+			if err := w.ServeMetrics(ctx, hln); err != nil {
+				log.Print("Metrics error: ", err)
+			}
+		}()
+	}
+
+	err = w.Serve(ctx, ln)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print("Worker exiting")
+}
+
+// Drain the given worker, or the worker on this machine if none is given
+func runDrain(saddr string, worker string) {
+	if len(worker) == 0 {
+		id, err := cbd.GetMachineID()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		worker = string(id)
+	}
+
+	workers, err := cbd.DrainWorker(saddr, worker)
+
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	w.Serve(ln)
+	for _, w := range workers {
+		fmt.Printf("Draining: %s\n", w.ToString())
+	}
 }
 
-func runServer(port int) {
+func runServer(port int, scheduler string, shareBy string, shareWeights string,
+	classCaps string, queueTimeout time.Duration, workerTimeout time.Duration,
+	stateFile string, historyFile string, httpPort int) {
 	log.Print("Server starting, port: ", port)
 
+	// Determine how we are sharing the cluster
+	var opts cbd.SchedulerOptions
+	var err error
+
+	switch shareBy {
+	case "host":
+		opts.ShareByUser = false
+	case "user":
+		opts.ShareByUser = true
+	default:
+		log.Fatal("Unknown -share-by value: ", shareBy)
+	}
+
+	opts.Weights, err = cbd.ParseShareWeights(shareWeights)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts.ClassCaps, err = cbd.ParseClassCaps(classCaps)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sch, err := cbd.NewScheduler(scheduler, opts)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print("  Scheduling with: ", scheduler)
+
 	// Listen on any address
 	address := ":" + strconv.FormatUint(uint64(port), 10)
 	ln, err := net.Listen("tcp", address)
@@ -197,28 +434,285 @@ func runServer(port int) {
 		log.Fatal(err)
 	}
 
-	s := cbd.NewServerState()
+	s := cbd.NewServerState(cbd.ServerConfig{
+		Scheduler:     sch,
+		QueueTimeout:  queueTimeout,
+		WorkerTimeout: workerTimeout,
+		StateFile:     stateFile,
+		HistoryFile:   historyFile,
+	})
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	// Serve up our status for dashboards and scripts
+	if httpPort > 0 {
+		hln, err := net.Listen("tcp", ":"+strconv.Itoa(httpPort))
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Print("  Status API on port: ", httpPort)
+
+		go func() {
+			if err := s.ServeStatus(ctx, hln); err != nil {
+				log.Print("Status API error: ", err)
+			}
+		}()
+	}
+
+	err = s.Serve(ctx, ln)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// signalContext returns a context canceled on SIGINT or SIGTERM, so servers
+// can shut down cleanly when stopped by hand or by an init system
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt,
+		syscall.SIGTERM)
+}
+
+// Print the jobs matching the query, or the time spent on each file, or
+// write them out as a trace
+func runHistory(server string, q cbd.HistoryQuery, byFile bool, trace string) {
+	jobs, err := cbd.QueryHistory(server, q)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(trace) > 0 {
+		if err = writeTrace(trace, jobs); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if byFile {
+		for _, f := range cbd.SummarizeByFile(jobs) {
+			fmt.Printf("%10.3fs %6d  %s\n", f.CompileTime.Seconds(), f.Jobs,
+				f.File)
+		}
+		return
+	}
+
+	for _, j := range jobs {
+		fmt.Printf("%s %s -> %s %s in: %d out: %d %.3fs return: %d\n",
+			j.Time.Format("2006-01-02 15:04:05"), j.Client.Host, j.Worker.Host,
+			j.File, j.InputSize, j.OutputSize, j.CompileTime.Seconds(),
+			j.Return)
+	}
+}
+
+// Run the build command with every job tagged with one build ID, then print
+// a summary of the jobs from the server.  Exits with the command's status.
+func runBuild(server string, trace string, args []string) {
+	if len(args) == 0 {
+		log.Fatal("No build command given, ex: cbd build -- make -j64")
+	}
+
+	// Reuse the ID of an outer build so nested ones are counted together
+	id := os.Getenv("CBD_BUILD_ID")
+
+	if len(id) == 0 {
+		guid := cbd.NewGUID()
+		id = guid.String()
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "CBD_BUILD_ID="+id)
+
+	// Jobs must report to the server we ask for the summary
+	if len(server) > 0 {
+		cmd.Env = append(cmd.Env, "CBD_SERVER="+server)
+	}
+
+	start := time.Now()
+	err := cmd.Run()
+	wall := time.Since(start)
+
+	status := 0
+
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+
+		if !ok {
+			log.Fatal(err)
+		}
+
+		status = exitErr.ExitCode()
+	}
+
+	summary, err := waitBuildSummary(server, id)
+
+	if err != nil {
+		log.Print("No build summary: ", err)
+	} else {
+		printBuildSummary(summary, wall)
+	}
+
+	// The jobs themselves come from the server's history
+	if len(trace) > 0 {
+		jobs, err := cbd.QueryHistory(server, cbd.HistoryQuery{Build: id})
+
+		if err == nil {
+			err = writeTrace(trace, jobs)
+		}
+
+		if err != nil {
+			log.Print("No build trace: ", err)
+		}
+	}
+
+	os.Exit(status)
+}
+
+// Asks for the summary of the build until its job count stops changing, the
+// server can still be handling the last jobs reported when the build ends
+func waitBuildSummary(server string, id string) (cbd.BuildSummary, error) {
+	summary, err := cbd.QueryBuild(server, id)
+
+	for i := 0; i < 10; i++ {
+		time.Sleep(time.Duration(200) * time.Millisecond)
+
+		next, nerr := cbd.QueryBuild(server, id)
+
+		// Nothing new arrived, so everything has been counted
+		if nerr == nil && err == nil && next.Jobs == summary.Jobs {
+			break
+		}
+
+		summary, err = next, nerr
+	}
+
+	return summary, err
+}
+
+// Write the jobs to the file as a Chrome trace
+func writeTrace(path string, jobs []cbd.JobRecord) error {
+	f, err := os.Create(path)
+
+	if err != nil {
+		return err
+	}
+
+	err = cbd.WriteTrace(f, jobs)
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
 
-	s.Serve(ln)
+	if err == nil {
+		fmt.Fprintf(os.Stderr, "Wrote %d jobs to %s\n", len(jobs), path)
+	}
+
+	return err
 }
 
-func runMonitor(server string) {
+// Print where the jobs of the build ran and where the time went
+func printBuildSummary(b cbd.BuildSummary, wall time.Duration) {
+	fmt.Fprintf(os.Stderr, "\nBuild %s: %d jobs in %.1fs\n", b.ID, b.Jobs,
+		wall.Seconds())
+	fmt.Fprintf(os.Stderr, "  Distributed: %d jobs on %d workers\n",
+		b.Jobs-b.Local, len(b.Workers))
+	fmt.Fprintf(os.Stderr, "  Local:       %d jobs\n", b.Local)
+	fmt.Fprintf(os.Stderr, "  Failed:      %d jobs\n", b.Failed)
+
+	// Without dependencies the longest job is all we know of the critical
+	// path, it can't be any shorter than that
+	parallel := 0.0
+
+	if b.Busy > 0 {
+		parallel = b.JobTime.Seconds() / b.Busy.Seconds()
+	}
+
+	fmt.Fprintf(os.Stderr, "  Job time:    %.1fs total, %.1fs with jobs running, "+
+		"%.1f at once on average\n", b.JobTime.Seconds(), b.Busy.Seconds(),
+		parallel)
+	fmt.Fprintf(os.Stderr, "  Longest job: %.1fs\n", b.Longest.Seconds())
+	fmt.Fprintf(os.Stderr, "  Critical path: at least %.1fs, the full path "+
+		"needs job dependencies the server doesn't see\n", b.Longest.Seconds())
+
+	if len(b.Workers) > 0 {
+		var hosts []string
+
+		for h := range b.Workers {
+			hosts = append(hosts, h)
+		}
+
+		sort.Slice(hosts, func(i, j int) bool {
+			if b.Workers[hosts[i]] != b.Workers[hosts[j]] {
+				return b.Workers[hosts[i]] > b.Workers[hosts[j]]
+			}
+			return hosts[i] < hosts[j]
+		})
+
+		fmt.Fprintln(os.Stderr, "  Workers:")
+
+		for _, h := range hosts {
+			fmt.Fprintf(os.Stderr, "    %6d  %s\n", b.Workers[h], h)
+		}
+	}
+
+	if len(b.Slowest) > 0 {
+		fmt.Fprintln(os.Stderr, "  Slowest files:")
+
+		for _, f := range b.Slowest {
+			fmt.Fprintf(os.Stderr, "    %6.2fs  %s\n", f.CompileTime.Seconds(),
+				f.File)
+		}
+	}
+}
+
+func runMonitor(server string, plain bool, format string, filter cbd.MonitorFilter) {
 	log.Print("Monitor starting")
 
+	// Machine readable output goes straight to stdout
+	var mw *cbd.MonitorWriter
+
+	if format != "text" {
+		var err error
+		mw, err = cbd.NewMonitorWriter(os.Stdout, format)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Use the full screen view when we have a terminal to draw on
+	fullScreen := mw == nil && !plain && cbd.IsTerminal(os.Stdout)
+
+	ctx, stop := signalContext()
+	defer stop()
+
 	// Make connection to server
-	m := cbd.NewMonitor(server)
-	for {
+	m := cbd.NewMonitor(server, filter)
+	for ctx.Err() == nil {
 		err := m.Connect()
 
-		// Keep trying until we get a connection
+		// Keep trying until we get a connection, keeping stdout clean for
+		// the machine readable formats
 		if err != nil {
-			fmt.Printf("Can't connect to: %s\n", err)
+			fmt.Fprintf(os.Stderr, "Can't connect to: %s\n", err)
 			time.Sleep(time.Duration(1) * time.Second)
 			continue
 		}
 
 		// Go into an infinite reporting loop
-		err = m.BasicReport()
+		if mw != nil {
+			err = m.WriteReport(ctx, mw)
+		} else if fullScreen {
+			err = m.FullScreenReport(ctx)
+		} else {
+			err = m.BasicReport(ctx)
+		}
 
 		// A clear exit from report means we should do a graceful shutdown
 		if err == nil {
@@ -258,7 +752,9 @@ func runCompiler(compiler string, args []string) {
 	// TODO: Add in a local compile fast past
 	if b.Distributable {
 		// Pre-process the file into a compile job
+		preprocessStart := time.Now()
 		job, results, err := cbd.MakeCompileJob(compiler, b)
+		preprocess := time.Since(preprocessStart)
 
 		if err != nil {
 			fmt.Print(string(results.Output))
@@ -266,28 +762,28 @@ func runCompiler(compiler string, args []string) {
 			os.Exit(results.Return)
 		}
 
-		// See if we have a remote host defined
-		cresults, err := cbd.ClientBuildJob(job)
-
-		if err != nil || cresults.Return != 0 {
-			fmt.Print(string(cresults.Output))
-			cbd.DebugPrint("Build Error: ", string(cresults.Output))
-			os.Exit(cresults.Return)
-		}
-
-		// Now write the results to right output location
-		f, err := os.Create(b.Output())
+		// Tag the job with how important it is
+		job.Class, job.Priority, err = cbd.ParsePriority(os.Getenv("CBD_PRIORITY"))
 
 		if err != nil {
-			log.Fatal(err)
+			log.Print("Ignoring CBD_PRIORITY: ", err)
+			job.Class, job.Priority = cbd.InteractiveClass, 0
 		}
 
-		defer f.Close()
+		// See if we have a remote host defined, this writes out the object
+		// file when the build works
+		cresults, err := cbd.ClientBuildJob(job, preprocess)
+
+		if err != nil || cresults.Return != 0 {
+			fmt.Print(string(cresults.Output))
+			cbd.DebugPrint("Build Error: ", string(cresults.Output))
 
-		_, err = f.Write(cresults.ObjectCode)
+			// The compile worked but we couldn't write the object file
+			if cresults.Return == 0 {
+				log.Fatal(err)
+			}
 
-		if err != nil {
-			log.Fatal(err)
+			os.Exit(cresults.Return)
 		}
 
 		cbd.DebugPrint("Remote Success")
@@ -0,0 +1,44 @@
+// The compilers a worker has, which it reports to the server along with its
+// state so the server knows what the cluster can build.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// Compilers workers look for on their PATH
+var knownCompilers = []string{"gcc", "g++", "cc", "c++", "clang", "clang++"}
+
+// CompilerInfo is one compiler a worker can run
+type CompilerInfo struct {
+	Name    string // Name it's run by, without its path
+	Version string // What it reports for -dumpversion, empty if nothing
+}
+
+// findCompilers returns the compilers with the given names found on our
+// PATH, in the same order
+func findCompilers(names []string) []CompilerInfo {
+	var l []CompilerInfo
+
+	for _, name := range names {
+		path, err := exec.LookPath(name)
+
+		if err != nil {
+			continue
+		}
+
+		c := CompilerInfo{Name: name}
+
+		if r, err := RunCmd(path, []string{"-dumpversion"}); err == nil {
+			c.Version = strings.TrimSpace(string(r.Output))
+		}
+
+		l = append(l, c)
+	}
+
+	return l
+}
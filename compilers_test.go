@@ -0,0 +1,27 @@
+// Tests for finding the compilers on a worker.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestFindCompilers(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("No gcc: ", err)
+	}
+
+	// Only the compilers we have are listed
+	l := findCompilers([]string{"cbd-no-such-compiler", "gcc"})
+
+	if len(l) != 1 || l[0].Name != "gcc" {
+		t.Fatalf("Expected only gcc got: %v", l)
+	}
+
+	if len(l[0].Version) == 0 {
+		t.Error("No version for gcc")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 const (
@@ -36,16 +37,32 @@ type Build struct {
 
 // A job to be farmed out to our cluster
 type CompileJob struct {
-	Host     string // The host requesting it
-	Build    Build  // The commands to build it with
-	Input    []byte // The data to build
-	Compiler string // The compiler to run it with
+	ID       GUID     // ID the server gave the job, zero if none
+	Host     string   // The host requesting it
+	Build    Build    // The commands to build it with
+	Input    []byte   // The data to build
+	Compiler string   // The compiler to run it with
+	Class    JobClass // Scheduling class, used when asking for a worker
+	Priority int      // Scheduling priority, higher goes first
 }
 
 // The result of a compile
 type CompileResult struct {
-	ExecResult        // Results of the compiler command
-	ObjectCode []byte // The compiled object code
+	ExecResult           // Results of the compiler command
+	ObjectCode []byte    // The compiled object code
+	Busy       bool      // Worker was too busy to take the job, try elsewhere
+	Timing     JobTiming // Queue and compile time on the worker
+}
+
+// JobTiming breaks down where the time on a job went
+type JobTiming struct {
+	Preprocess time.Duration // Running the preprocessor on the client
+	Queue      time.Duration // Waiting on the server and worker for a slot
+	Upload     time.Duration // Sending the job to the worker
+	Compile    time.Duration // Running the compiler
+	CPU        time.Duration // CPU time used by the compiler
+	Download   time.Duration // Getting the results back from the worker
+	Write      time.Duration // Writing out the object file on the client
 }
 
 // Returns the output path build job
@@ -0,0 +1,126 @@
+// The web dashboard served along with the status API.  The page itself is
+// embedded in the binary, and is kept up to date with server-sent events fed
+// from the same updates "cbd monitor" gets.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+//go:embed web/dashboard.html
+var dashboardPage []byte
+
+// dashboardEvent is a worker event as sent to the dashboard and written by
+// "cbd monitor -format=json", with the type spelled out
+type dashboardEvent struct {
+	Type   string      // What happened
+	Worker MachineName // Worker it happened to
+	Reason string      // Why it happened, if known
+	Time   time.Time   // When the server noticed
+}
+
+// serveDashboard sends back the dashboard page
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	// The mux sends every unknown path here
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardPage)
+}
+
+// serveEvents streams updates to the dashboard as server-sent events until
+// the browser goes away or the server shuts down
+func (s *ServerState) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// We subscribe before answering so nothing is missed once we have
+	sub := s.monitorUpdates.subscribe("web:"+r.RemoteAddr, subscriberBuffer)
+	defer s.monitorUpdates.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		var msg interface{}
+		var ok bool
+
+		select {
+		case msg, ok = <-sub.updates:
+			if !ok {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-s.quit:
+			return
+		}
+
+		name, data, err := s.eventData(msg)
+
+		if err != nil {
+			log.Print("Error encoding dashboard event: ", err)
+			continue
+		}
+
+		if len(name) == 0 {
+			continue
+		}
+
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+
+		if err != nil {
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+// eventData returns the event name and JSON for an update, or no name if
+// the dashboard doesn't use it
+func (s *ServerState) eventData(msg interface{}) (string, []byte, error) {
+	var name string
+	var v interface{}
+
+	switch m := msg.(type) {
+	case CompletedJob:
+		name, v = "job", JobRecord{Time: time.Now(), CompletedJob: m}
+	case WorkerStateList:
+		name, v = "workers", toWorkerStatus(m.Workers)
+	case QueueState:
+		name, v = "queue", m
+	case MissedUpdates:
+		name, v = "missed", m
+	case WorkerEvent:
+		name, v = "worker", dashboardEvent{
+			Type:   m.Type.String(),
+			Worker: m.Worker,
+			Reason: m.Reason,
+			Time:   m.Time,
+		}
+	default:
+		return "", nil, nil
+	}
+
+	data, err := json.Marshal(v)
+
+	return name, data, err
+}
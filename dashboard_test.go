@@ -0,0 +1,115 @@
+// Tests for the web dashboard.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashboardPage(t *testing.T) {
+	s := NewServerState(ServerConfig{})
+	ts := httptest.NewServer(s.statusHandler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/")
+
+	if err != nil {
+		t.Fatal("Get error: ", err)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "EventSource") {
+		t.Error("Bad dashboard page, status: ", resp.StatusCode)
+	}
+
+	resp, err = http.Get(ts.URL + "/no-such-page")
+
+	if err != nil {
+		t.Fatal("Get error: ", err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("Unknown page got status: ", resp.StatusCode)
+	}
+}
+
+func TestDashboardEvents(t *testing.T) {
+	s := NewServerState(ServerConfig{})
+	ts := httptest.NewServer(s.statusHandler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/events")
+
+	if err != nil {
+		t.Fatal("Get error: ", err)
+	}
+
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Error("Got content type: ", ct)
+	}
+
+	// We are subscribed once we have the response
+	s.monitorUpdates.publish(CompletedJob{
+		Worker: MachineName{ID: "w1", Host: "w1"},
+		File:   "a.c",
+	})
+
+	events := make(chan string)
+
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+
+		for scanner.Scan() {
+			events <- scanner.Text()
+		}
+
+		close(events)
+	}()
+
+	var lines []string
+
+	for len(lines) < 2 {
+		select {
+		case line, ok := <-events:
+			if !ok {
+				t.Fatal("Event stream closed")
+			}
+			lines = append(lines, line)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for event")
+		}
+	}
+
+	if lines[0] != "event: job" {
+		t.Error("Got event line: ", lines[0])
+	}
+
+	var r JobRecord
+
+	err = json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &r)
+
+	if err != nil || r.File != "a.c" || r.Worker.Host != "w1" {
+		t.Errorf("Bad job data %q: %v", lines[1], err)
+	}
+
+	// Closing down the server ends the stream
+	close(s.quit)
+
+	for range events {
+	}
+}
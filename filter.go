@@ -0,0 +1,107 @@
+// Filters a monitor can ask the server to apply to its updates, so watching
+// one build on a busy cluster doesn't mean wading through everyone else's.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"time"
+)
+
+// MonitorFilter narrows down the updates sent to a monitor.  Each field
+// left empty lets everything through.
+type MonitorFilter struct {
+	Clients   []string      // Only jobs and queues of these client hosts
+	Workers   []string      // Only jobs on and state of these workers, by host or ID
+	Failures  bool          // Only jobs which failed
+	StateRate time.Duration // Send worker state at most this often
+}
+
+// monitorFilter applies a MonitorFilter to the updates of one monitor
+type monitorFilter struct {
+	MonitorFilter
+	lastState time.Time // When we last let worker state through
+}
+
+func newMonitorFilter(f MonitorFilter) *monitorFilter {
+	return &monitorFilter{MonitorFilter: f}
+}
+
+// apply returns the update as the monitor should get it, or false if it
+// shouldn't get it at all.  Lists are cut down to the entries which match.
+func (f *monitorFilter) apply(msg interface{}, now time.Time) (interface{}, bool) {
+	switch m := msg.(type) {
+	case CompletedJob:
+		ok := f.client(m.Client.Host) && f.worker(m.Worker) &&
+			(!f.Failures || m.Return != 0)
+
+		return m, ok
+	case JobEvent:
+		ok := f.client(m.Client.Host) && f.worker(m.Worker) &&
+			(!f.Failures || m.Type == JobFailed)
+
+		return m, ok
+	case WorkerEvent:
+		return m, f.worker(m.Worker)
+	case WorkerStateList:
+		// Hold back state which comes too soon after the last
+		if f.StateRate > 0 && now.Sub(f.lastState) < f.StateRate {
+			return m, false
+		}
+
+		f.lastState = now
+
+		if len(f.Workers) == 0 {
+			return m, true
+		}
+
+		var l WorkerStateList
+
+		for _, ws := range m.Workers {
+			if f.worker(MachineName{ID: ws.ID, Host: ws.Host}) {
+				l.Workers = append(l.Workers, ws)
+			}
+		}
+
+		return l, true
+	case QueueState:
+		if len(f.Clients) == 0 {
+			return m, true
+		}
+
+		var q QueueState
+
+		for _, c := range m.Clients {
+			if f.client(c.Client) {
+				q.Clients = append(q.Clients, c)
+			}
+		}
+
+		return q, true
+	}
+
+	return msg, true
+}
+
+// client returns true if we want updates about the client host
+func (f *monitorFilter) client(host string) bool {
+	return len(f.Clients) == 0 || containsString(f.Clients, host)
+}
+
+// worker returns true if we want updates about the worker
+func (f *monitorFilter) worker(w MachineName) bool {
+	return len(f.Workers) == 0 || containsString(f.Workers, w.Host) ||
+		containsString(f.Workers, string(w.ID))
+}
+
+// containsString returns true if the string is in the list
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,124 @@
+// Tests for the monitor subscription filters.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMonitorFilterJobs(t *testing.T) {
+	mine := CompletedJob{
+		Client: MachineName{Host: "laptop"},
+		Worker: MachineName{ID: "id-w1", Host: "w1"},
+	}
+	failed := mine
+	failed.Return = 1
+	theirs := CompletedJob{
+		Client: MachineName{Host: "desktop"},
+		Worker: MachineName{ID: "id-w2", Host: "w2"},
+	}
+
+	tests := []struct {
+		filter   MonitorFilter
+		msg      interface{}
+		expected bool
+	}{
+		{MonitorFilter{}, theirs, true},
+		{MonitorFilter{Clients: []string{"laptop"}}, mine, true},
+		{MonitorFilter{Clients: []string{"laptop"}}, theirs, false},
+		{MonitorFilter{Workers: []string{"w1"}}, mine, true},
+		{MonitorFilter{Workers: []string{"id-w1"}}, mine, true},
+		{MonitorFilter{Workers: []string{"w1"}}, theirs, false},
+		{MonitorFilter{Failures: true}, mine, false},
+		{MonitorFilter{Failures: true}, failed, true},
+
+		// Job events follow the same rules
+		{MonitorFilter{Clients: []string{"laptop"}},
+			JobEvent{Type: JobQueued, Client: mine.Client}, true},
+		{MonitorFilter{Workers: []string{"w1"}},
+			JobEvent{Type: JobQueued, Client: mine.Client}, false},
+		{MonitorFilter{Failures: true},
+			JobEvent{Type: JobDone, Client: mine.Client}, false},
+		{MonitorFilter{Failures: true},
+			JobEvent{Type: JobFailed, Client: mine.Client}, true},
+
+		// Worker events only care about workers
+		{MonitorFilter{Clients: []string{"laptop"}},
+			WorkerEvent{Worker: theirs.Worker}, true},
+		{MonitorFilter{Workers: []string{"w1"}},
+			WorkerEvent{Worker: theirs.Worker}, false},
+	}
+
+	for i, test := range tests {
+		f := newMonitorFilter(test.filter)
+
+		if _, ok := f.apply(test.msg, time.Now()); ok != test.expected {
+			t.Errorf("Test %d: got %t wanted %t for %+v", i, ok,
+				test.expected, test.msg)
+		}
+	}
+}
+
+func TestMonitorFilterLists(t *testing.T) {
+	f := newMonitorFilter(MonitorFilter{
+		Clients: []string{"laptop"},
+		Workers: []string{"w1", "id-w3"},
+	})
+
+	msg, ok := f.apply(WorkerStateList{Workers: []WorkerState{
+		{ID: "id-w1", Host: "w1"},
+		{ID: "id-w2", Host: "w2"},
+		{ID: "id-w3", Host: "w3"},
+	}}, time.Now())
+
+	l := msg.(WorkerStateList)
+
+	if !ok || len(l.Workers) != 2 || l.Workers[0].Host != "w1" ||
+		l.Workers[1].Host != "w3" {
+		t.Errorf("Bad worker list: %+v", l)
+	}
+
+	msg, ok = f.apply(QueueState{Clients: []ClientQueue{
+		{Client: "desktop", Queued: 1},
+		{Client: "laptop", Queued: 2},
+	}}, time.Now())
+
+	q := msg.(QueueState)
+
+	if !ok || len(q.Clients) != 1 || q.Clients[0].Client != "laptop" {
+		t.Errorf("Bad queue: %+v", q)
+	}
+}
+
+func TestMonitorFilterStateRate(t *testing.T) {
+	f := newMonitorFilter(MonitorFilter{StateRate: 5 * time.Second})
+	now := time.Now()
+
+	expected := []struct {
+		after time.Duration
+		sent  bool
+	}{
+		{0, true},
+		{time.Second, false},
+		{4 * time.Second, false},
+		{5 * time.Second, true},
+		{6 * time.Second, false},
+		{11 * time.Second, true},
+	}
+
+	for _, e := range expected {
+		_, ok := f.apply(WorkerStateList{}, now.Add(e.after))
+
+		if ok != e.sent {
+			t.Errorf("At %s got %t wanted %t", e.after, ok, e.sent)
+		}
+	}
+
+	// Everything else comes through right away
+	if _, ok := f.apply(QueueState{}, now.Add(12*time.Second)); !ok {
+		t.Error("Queue state held back")
+	}
+}
@@ -0,0 +1,371 @@
+// The server's record of every job completed on the cluster.  Jobs are
+// appended to a log of JSON lines which is rotated once it gets too large,
+// and can be queried with "cbd history".
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rotate the history log once it's larger than this
+var historyMaxSize = int64(64 * 1024 * 1024)
+
+// Number of rotated logs kept along with the current one
+var historyKeep = 4
+
+// JobRecord is one completed job in the history log
+type JobRecord struct {
+	Time time.Time // When the server heard the job completed
+	CompletedJob
+}
+
+// HistoryQuery asks the server for the jobs matching all the given filters
+type HistoryQuery struct {
+	Start time.Time // Jobs completed at or after this, if set
+	End   time.Time // Jobs completed before this, if set
+	Host  string    // Client or worker host name, if set
+	File  string    // Part of the source file name, if set
+	Build string    // CBD_BUILD_ID of the build, if set
+	Limit int       // Only the most recent jobs, all if zero
+}
+
+// Most jobs sent in one HistoryResponse, larger results are split up
+var historyPageSize = 1000
+
+// HistoryResponse holds the jobs matching a HistoryQuery, oldest first.  A
+// large result is sent as a series of responses.
+type HistoryResponse struct {
+	Jobs  []JobRecord
+	More  bool   // More responses follow with the rest of the jobs
+	Error string // Why the query failed, if it did
+}
+
+// matches returns true if the record passes all the filters of the query
+func (q HistoryQuery) matches(r JobRecord) bool {
+	if !q.Start.IsZero() && r.Time.Before(q.Start) {
+		return false
+	}
+
+	if !q.End.IsZero() && !r.Time.Before(q.End) {
+		return false
+	}
+
+	if len(q.Host) > 0 && r.Client.Host != q.Host && r.Worker.Host != q.Host {
+		return false
+	}
+
+	if len(q.File) > 0 && !strings.Contains(r.File, q.File) {
+		return false
+	}
+
+	if len(q.Build) > 0 && r.BuildID != q.Build {
+		return false
+	}
+
+	return true
+}
+
+// jobHistory is a rotating log of JobRecords
+type jobHistory struct {
+	path    string      // Current log, older ones have .1, .2 ... added
+	maxSize int64       // Rotate once the log is larger than this
+	keep    int         // Number of rotated logs to keep
+	mutex   *sync.Mutex // Protects the file
+	f       *os.File    // Current log, opened for append
+	size    int64       // Current size of the log
+}
+
+func newJobHistory(path string, maxSize int64, keep int) (*jobHistory, error) {
+	h := new(jobHistory)
+	h.path = path
+	h.maxSize = maxSize
+	h.keep = keep
+	h.mutex = new(sync.Mutex)
+
+	err := h.open()
+
+	return h, err
+}
+
+// open opens the current log for appending
+func (h *jobHistory) open() error {
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	h.f = f
+	h.size = info.Size()
+
+	return nil
+}
+
+// rotatedPath is the name of the nth oldest log, 0 being the current one
+func (h *jobHistory) rotatedPath(n int) string {
+	if n == 0 {
+		return h.path
+	}
+
+	return h.path + "." + strconv.Itoa(n)
+}
+
+// rotate shifts every log up one, dropping the oldest, and starts a new one.
+// Assumes things are locked.
+func (h *jobHistory) rotate() error {
+	h.f.Close()
+
+	os.Remove(h.rotatedPath(h.keep))
+
+	for n := h.keep - 1; n >= 0; n-- {
+		err := os.Rename(h.rotatedPath(n), h.rotatedPath(n+1))
+
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return h.open()
+}
+
+// add appends the record to the log
+func (h *jobHistory) add(r JobRecord) error {
+	data, err := json.Marshal(r)
+
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.size > 0 && h.size+int64(len(data)) > h.maxSize {
+		if err = h.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := h.f.Write(data)
+	h.size += int64(n)
+
+	return err
+}
+
+// query returns the matching records from all the logs, oldest first.  The
+// logs are only locked while they're opened, so jobs keep being recorded
+// while we scan them.
+func (h *jobHistory) query(q HistoryQuery) ([]JobRecord, error) {
+	logs, err := h.openLogs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		for _, l := range logs {
+			l.Close()
+		}
+	}()
+
+	var jobs []JobRecord
+
+	for _, l := range logs {
+		scanner := bufio.NewScanner(l)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+		for scanner.Scan() {
+			var r JobRecord
+
+			// Skip over anything half written during a crash
+			if json.Unmarshal(scanner.Bytes(), &r) != nil {
+				continue
+			}
+
+			if !q.matches(r) {
+				continue
+			}
+
+			jobs = append(jobs, r)
+
+			// Only hold on to the most recent when limited
+			if q.Limit > 0 && len(jobs) > 2*q.Limit {
+				jobs = append(jobs[:0], jobs[len(jobs)-q.Limit:]...)
+			}
+		}
+
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if q.Limit > 0 && len(jobs) > q.Limit {
+		jobs = jobs[len(jobs)-q.Limit:]
+	}
+
+	return jobs, nil
+}
+
+// historyLog is an open log, read up to the size it had when opened so we
+// never see a record half written
+type historyLog struct {
+	io.Reader
+	f *os.File
+}
+
+func (l historyLog) Close() error {
+	return l.f.Close()
+}
+
+// openLogs opens every log, oldest first.  Open files can still be read once
+// they've been rotated away.
+func (h *jobHistory) openLogs() ([]historyLog, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var logs []historyLog
+
+	for n := h.keep; n >= 0; n-- {
+		f, err := os.Open(h.rotatedPath(n))
+
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			for _, l := range logs {
+				l.Close()
+			}
+			return nil, err
+		}
+
+		l := historyLog{Reader: f, f: f}
+
+		// The current log is still being written
+		if n == 0 {
+			l.Reader = io.LimitReader(f, h.size)
+		}
+
+		logs = append(logs, l)
+	}
+
+	return logs, nil
+}
+
+// close closes the current log
+func (h *jobHistory) close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.f.Close()
+}
+
+// QueryHistory asks the first server in the comma separated list that we
+// can reach for the jobs matching the query
+func QueryHistory(saddr string, q HistoryQuery) ([]JobRecord, error) {
+	mc, err := connectServer(saddr, time.Duration(30)*time.Second)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer mc.Close()
+
+	err = mc.Send(q)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []JobRecord
+
+	for {
+		_, msg, err := mc.Read()
+
+		if err != nil {
+			return nil, err
+		}
+
+		r, ok := msg.(HistoryResponse)
+
+		if !ok {
+			return nil, fmt.Errorf("Unexpected history response: %s",
+				reflect.TypeOf(msg).Name())
+		}
+
+		if len(r.Error) > 0 {
+			return nil, fmt.Errorf("History query failed: %s", r.Error)
+		}
+
+		jobs = append(jobs, r.Jobs...)
+
+		if !r.More {
+			return jobs, nil
+		}
+	}
+}
+
+// FileSummary totals up the jobs for one source file
+type FileSummary struct {
+	File        string        // Source file compiled
+	Jobs        int           // Number of times it was compiled
+	CompileTime time.Duration // Total time spent compiling it
+}
+
+// byCompileTime sorts file summaries with the most time first
+type byCompileTime []FileSummary
+
+func (a byCompileTime) Len() int      { return len(a) }
+func (a byCompileTime) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byCompileTime) Less(i, j int) bool {
+	if a[i].CompileTime != a[j].CompileTime {
+		return a[i].CompileTime > a[j].CompileTime
+	}
+
+	return a[i].File < a[j].File
+}
+
+// SummarizeByFile totals the jobs of each source file, with the files that
+// took the most time first
+func SummarizeByFile(jobs []JobRecord) []FileSummary {
+	index := make(map[string]int)
+	var files []FileSummary
+
+	for _, j := range jobs {
+		i, ok := index[j.File]
+
+		if !ok {
+			i = len(files)
+			index[j.File] = i
+			files = append(files, FileSummary{File: j.File})
+		}
+
+		files[i].Jobs++
+		files[i].CompileTime += j.CompileTime
+	}
+
+	sort.Sort(byCompileTime(files))
+
+	return files
+}
@@ -0,0 +1,297 @@
+// Tests for the job history log.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Makes a history record for the given file
+func historyRecord(t time.Time, client string, worker string,
+	file string, d time.Duration) JobRecord {
+	return JobRecord{
+		Time: t,
+		CompletedJob: CompletedJob{
+			Client:      MachineName{ID: MachineID(client), Host: client},
+			Worker:      MachineName{ID: MachineID(worker), Host: worker},
+			File:        file,
+			CompileTime: d,
+		},
+	}
+}
+
+func TestJobHistoryQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbd-history")
+
+	if err != nil {
+		t.Fatal("Temp dir error: ", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	h, err := newJobHistory(filepath.Join(dir, "history"), historyMaxSize,
+		historyKeep)
+
+	if err != nil {
+		t.Fatal("Open error: ", err)
+	}
+
+	defer h.close()
+
+	start := time.Now()
+	second := time.Duration(1) * time.Second
+
+	records := []JobRecord{
+		historyRecord(start, "alice", "w1", "src/a.c", second),
+		historyRecord(start.Add(second), "bob", "w2", "src/b.c", 2*second),
+		historyRecord(start.Add(2*second), "alice", "w2", "lib/a.c", second),
+	}
+
+	records[1].BuildID = "b1"
+
+	for _, r := range records {
+		if err = h.add(r); err != nil {
+			t.Fatal("Add error: ", err)
+		}
+	}
+
+	tests := []struct {
+		q     HistoryQuery
+		files []string
+	}{
+		{HistoryQuery{}, []string{"src/a.c", "src/b.c", "lib/a.c"}},
+		{HistoryQuery{Host: "alice"}, []string{"src/a.c", "lib/a.c"}},
+		{HistoryQuery{Host: "w2"}, []string{"src/b.c", "lib/a.c"}},
+		{HistoryQuery{File: "a.c"}, []string{"src/a.c", "lib/a.c"}},
+		{HistoryQuery{Start: start.Add(second)}, []string{"src/b.c", "lib/a.c"}},
+		{HistoryQuery{End: start.Add(second)}, []string{"src/a.c"}},
+		{HistoryQuery{Limit: 2}, []string{"src/b.c", "lib/a.c"}},
+		{HistoryQuery{Build: "b1"}, []string{"src/b.c"}},
+	}
+
+	for _, test := range tests {
+		jobs, err := h.query(test.q)
+
+		if err != nil {
+			t.Fatal("Query error: ", err)
+		}
+
+		var files []string
+
+		for _, j := range jobs {
+			files = append(files, j.File)
+		}
+
+		if !stringSlicesEqual(files, test.files) {
+			t.Errorf("Query %+v got %v wanted %v", test.q, files, test.files)
+		}
+	}
+
+	// Total up by file, slowest first
+	summary := SummarizeByFile(records)
+
+	if len(summary) != 3 || summary[0].File != "src/b.c" ||
+		summary[0].CompileTime != 2*second || summary[0].Jobs != 1 {
+		t.Errorf("Bad summary: %+v", summary)
+	}
+}
+
+func TestJobHistoryRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbd-history")
+
+	if err != nil {
+		t.Fatal("Temp dir error: ", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "history")
+
+	// Room for just one record per file, with two old files kept
+	h, err := newJobHistory(path, 10, 2)
+
+	if err != nil {
+		t.Fatal("Open error: ", err)
+	}
+
+	defer h.close()
+
+	files := []string{"a.c", "b.c", "c.c", "d.c"}
+
+	for i, file := range files {
+		r := historyRecord(time.Now(), "client", "worker", file,
+			time.Duration(i)*time.Second)
+
+		if err = h.add(r); err != nil {
+			t.Fatal("Add error: ", err)
+		}
+	}
+
+	if _, err = os.Stat(path + ".2"); err != nil {
+		t.Error("Rotated history file missing: ", err)
+	}
+
+	jobs, err := h.query(HistoryQuery{})
+
+	if err != nil {
+		t.Fatal("Query error: ", err)
+	}
+
+	var got []string
+
+	for _, j := range jobs {
+		got = append(got, j.File)
+	}
+
+	expected := []string{"b.c", "c.c", "d.c"}
+
+	if !stringSlicesEqual(got, expected) {
+		t.Errorf("Got %v wanted %v", got, expected)
+	}
+}
+
+func TestJobHistoryQueryWhileAdding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbd-history")
+
+	if err != nil {
+		t.Fatal("Temp dir error: ", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	h, err := newJobHistory(filepath.Join(dir, "history"), 10, 2)
+
+	if err != nil {
+		t.Fatal("Open error: ", err)
+	}
+
+	defer h.close()
+
+	for _, file := range []string{"a.c", "b.c"} {
+		h.add(historyRecord(time.Now(), "client", "worker", file, 0))
+	}
+
+	logs, err := h.openLogs()
+
+	if err != nil {
+		t.Fatal("Open logs error: ", err)
+	}
+
+	// Jobs added while scanning rotate the logs out from under us, but we
+	// still read just what was there when we started
+	for _, file := range []string{"c.c", "d.c"} {
+		if err = h.add(historyRecord(time.Now(), "client", "worker", file,
+			0)); err != nil {
+			t.Fatal("Add error: ", err)
+		}
+	}
+
+	var got []string
+
+	for _, l := range logs {
+		data, err := ioutil.ReadAll(l)
+		l.Close()
+
+		if err != nil {
+			t.Fatal("Read error: ", err)
+		}
+
+		if len(data) > 0 {
+			var r JobRecord
+			json.Unmarshal(data, &r)
+			got = append(got, r.File)
+		}
+	}
+
+	expected := []string{"a.c", "b.c"}
+
+	if !stringSlicesEqual(got, expected) {
+		t.Errorf("Got %v wanted %v", got, expected)
+	}
+}
+
+func TestProcessHistoryQueryPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbd-history")
+
+	if err != nil {
+		t.Fatal("Temp dir error: ", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	s := NewServerState(ServerConfig{
+		HistoryFile: filepath.Join(dir, "history"),
+	})
+
+	defer s.history.close()
+
+	defer func(size int) { historyPageSize = size }(historyPageSize)
+	historyPageSize = 2
+
+	files := []string{"a.c", "b.c", "c.c", "d.c", "e.c"}
+
+	for _, file := range files {
+		s.history.add(historyRecord(time.Now(), "client", "worker", file, 0))
+	}
+
+	var network MockConn
+	mc := NewMessageConn(&network, time.Duration(10)*time.Second)
+
+	if err := s.processHistoryQuery(mc, HistoryQuery{}); err != nil {
+		t.Fatal("Query error: ", err)
+	}
+
+	// Five jobs come back in pages of two, three and the last one
+	var got []string
+	var pages int
+
+	for {
+		_, msg, err := mc.Read()
+
+		if err != nil {
+			t.Fatal("Read error: ", err)
+		}
+
+		r, ok := msg.(HistoryResponse)
+
+		if !ok || len(r.Error) > 0 || len(r.Jobs) > historyPageSize {
+			t.Fatalf("Bad response: %+v", msg)
+		}
+
+		pages++
+
+		for _, j := range r.Jobs {
+			got = append(got, j.File)
+		}
+
+		if !r.More {
+			break
+		}
+	}
+
+	if pages != 3 || !stringSlicesEqual(got, files) {
+		t.Errorf("Got %v in %d pages", got, pages)
+	}
+}
+
+// Returns true if both slices hold the same strings in the same order
+func stringSlicesEqual(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
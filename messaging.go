@@ -12,6 +12,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"reflect"
 	"strconv"
@@ -32,6 +33,16 @@ const (
 	MonitorRequestID
 	CompletedJobID
 	WorkerStateListID
+	QueueStateID
+	WorkerEventID
+	DrainRequestID
+	DrainResponseID
+	HistoryQueryID
+	HistoryResponseID
+	JobEventID
+	MissedUpdatesID
+	BuildQueryID
+	BuildSummaryID
 )
 
 var messageIDNames = [...]string{
@@ -43,6 +54,16 @@ var messageIDNames = [...]string{
 	"MonitorRequestID",
 	"CompletedJobID",
 	"WorkerStateListID",
+	"QueueStateID",
+	"WorkerEventID",
+	"DrainRequestID",
+	"DrainResponseID",
+	"HistoryQueryID",
+	"HistoryResponseID",
+	"JobEventID",
+	"MissedUpdatesID",
+	"BuildQueryID",
+	"BuildSummaryID",
 }
 
 func (mID MessageID) String() string {
@@ -84,6 +105,10 @@ type MessageConn struct {
 	timeout time.Duration      // nanosecond timeout
 }
 
+// Longest we wait for a connection to be accepted, kept short so a server
+// which is down doesn't hold us up before we try the next one
+var dialTimeout = time.Duration(1) * time.Second
+
 // Adds the ":1234" port section to an address if there isn't one already
 func addPortIfNeeded(address string, port uint) string {
 	if strings.Index(address, ":") < 0 {
@@ -93,11 +118,53 @@ func addPortIfNeeded(address string, port uint) string {
 	return address
 }
 
-// Create a TCP based message conn
+// Connects to the first server in the list we can reach, returning the
+// connection and the address it's to
+func dialServers(servers []string, d time.Duration) (*MessageConn, string, error) {
+	err := errors.New("No server address given")
+
+	for _, s := range servers {
+		address := addPortIfNeeded(s, DefaultServerPort)
+
+		var mc *MessageConn
+		mc, err = NewTCPMessageConn(address, d)
+
+		if err == nil {
+			return mc, address, nil
+		}
+
+		log.Printf("Could not reach server %s: %s", address, err)
+	}
+
+	return nil, "", err
+}
+
+// Connects to the first reachable server of the comma separated list, or
+// uses auto-discovery to find one when the list is empty
+func connectServer(saddr string, d time.Duration) (*MessageConn, error) {
+	servers := SplitList(saddr)
+
+	if len(servers) == 0 {
+		addr, err := audoDiscoverySearch(time.Duration(5) * time.Second)
+
+		if err != nil {
+			return nil, err
+		}
+
+		servers = []string{addr}
+	}
+
+	mc, _, err := dialServers(servers, d)
+
+	return mc, err
+}
+
+// Create a TCP based message conn, d is the timeout for each message, the
+// connection itself has to be made within dialTimeout
 func NewTCPMessageConn(address string, d time.Duration) (*MessageConn, error) {
 	// Make our connection
 	DebugPrint("CONN:, trying to connect to ", address)
-	conn, err := net.Dial("tcp", address)
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
 
 	if err != nil {
 		return nil, err
@@ -120,7 +187,7 @@ func NewMessageConn(c DeadlineReadWriter, d time.Duration) *MessageConn {
 
 // Generic send function, makes it simpler to send messages
 func (mc MessageConn) Send(i interface{}) (err error) {
-	mc.conn.SetWriteDeadline(time.Now().Add(mc.timeout))
+	mc.conn.SetWriteDeadline(mc.deadline())
 
 	switch m := i.(type) {
 	case CompileJob:
@@ -163,6 +230,56 @@ func (mc MessageConn) Send(i interface{}) (err error) {
 		if err == nil {
 			return mc.enc.Encode(m)
 		}
+	case QueueState:
+		err = mc.sendHeader(QueueStateID)
+		if err == nil {
+			return mc.enc.Encode(m)
+		}
+	case WorkerEvent:
+		err = mc.sendHeader(WorkerEventID)
+		if err == nil {
+			return mc.enc.Encode(m)
+		}
+	case DrainRequest:
+		err = mc.sendHeader(DrainRequestID)
+		if err == nil {
+			return mc.enc.Encode(m)
+		}
+	case DrainResponse:
+		err = mc.sendHeader(DrainResponseID)
+		if err == nil {
+			return mc.enc.Encode(m)
+		}
+	case HistoryQuery:
+		err = mc.sendHeader(HistoryQueryID)
+		if err == nil {
+			return mc.enc.Encode(m)
+		}
+	case HistoryResponse:
+		err = mc.sendHeader(HistoryResponseID)
+		if err == nil {
+			return mc.enc.Encode(m)
+		}
+	case JobEvent:
+		err = mc.sendHeader(JobEventID)
+		if err == nil {
+			return mc.enc.Encode(m)
+		}
+	case MissedUpdates:
+		err = mc.sendHeader(MissedUpdatesID)
+		if err == nil {
+			return mc.enc.Encode(m)
+		}
+	case BuildQuery:
+		err = mc.sendHeader(BuildQueryID)
+		if err == nil {
+			return mc.enc.Encode(m)
+		}
+	case BuildSummary:
+		err = mc.sendHeader(BuildSummaryID)
+		if err == nil {
+			return mc.enc.Encode(m)
+		}
 	default:
 		return errors.New("Could not encode type: " + reflect.TypeOf(i).Name())
 	}
@@ -216,6 +333,46 @@ func (mc MessageConn) Read() (MessageHeader, interface{}, error) {
 		var l WorkerStateList
 		err := mc.dec.Decode(&l)
 		return h, l, err
+	case QueueStateID:
+		var q QueueState
+		err := mc.dec.Decode(&q)
+		return h, q, err
+	case WorkerEventID:
+		var e WorkerEvent
+		err := mc.dec.Decode(&e)
+		return h, e, err
+	case DrainRequestID:
+		var r DrainRequest
+		err := mc.dec.Decode(&r)
+		return h, r, err
+	case DrainResponseID:
+		var r DrainResponse
+		err := mc.dec.Decode(&r)
+		return h, r, err
+	case HistoryQueryID:
+		var q HistoryQuery
+		err := mc.dec.Decode(&q)
+		return h, q, err
+	case HistoryResponseID:
+		var r HistoryResponse
+		err := mc.dec.Decode(&r)
+		return h, r, err
+	case JobEventID:
+		var e JobEvent
+		err := mc.dec.Decode(&e)
+		return h, e, err
+	case MissedUpdatesID:
+		var m MissedUpdates
+		err := mc.dec.Decode(&m)
+		return h, m, err
+	case BuildQueryID:
+		var q BuildQuery
+		err := mc.dec.Decode(&q)
+		return h, q, err
+	case BuildSummaryID:
+		var r BuildSummary
+		err := mc.dec.Decode(&r)
+		return h, r, err
 	default:
 		return h, nil, errors.New("Unknown message ID: " + h.ID.String())
 	}
@@ -231,8 +388,26 @@ func (mc MessageConn) ReadType(eID MessageID) (interface{}, error) {
 	return msg, err
 }
 
+// Close the underlying connection, if it can be closed
+func (mc MessageConn) Close() error {
+	if c, ok := mc.conn.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
 func (mc MessageConn) setReadDeadline() error {
-	return mc.conn.SetReadDeadline(time.Now().Add(mc.timeout))
+	return mc.conn.SetReadDeadline(mc.deadline())
+}
+
+// The deadline for the next read or write, a zero timeout means none
+func (mc MessageConn) deadline() time.Time {
+	if mc.timeout == 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(mc.timeout)
 }
 
 // Read the header and check the message ID
@@ -3,6 +3,7 @@ package cbd
 import (
 	"bytes"
 	"encoding/gob"
+	"net"
 	"reflect"
 	"testing"
 	"time"
@@ -133,3 +134,51 @@ func TestGobEncoding(t *testing.T) {
 		t.Errorf("ObjectCode not serialized properly")
 	}
 }
+
+func TestDialServers(t *testing.T) {
+	// Grab a port nobody is listening on
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("Listen error: ", err)
+	}
+
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	live, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("Listen error: ", err)
+	}
+
+	defer live.Close()
+
+	// We skip over the dead server to the live one
+	mc, addr, err := dialServers([]string{deadAddr, live.Addr().String()},
+		time.Second)
+
+	if err != nil {
+		t.Fatal("Dial error: ", err)
+	}
+
+	mc.Close()
+
+	if addr != live.Addr().String() {
+		t.Errorf("Connected to %s wanted %s", addr, live.Addr())
+	}
+
+	if _, _, err = dialServers([]string{deadAddr}, time.Second); err == nil {
+		t.Error("Expected error with no live servers")
+	}
+
+	// A server which never answers is given up on quickly, no matter how
+	// long messages may take.  192.0.2.0/24 is reserved for documentation
+	// so nothing should be there.
+	start := time.Now()
+	dialServers([]string{"192.0.2.1:15800"}, time.Minute)
+
+	if wait := time.Since(start); wait > dialTimeout+time.Second {
+		t.Errorf("Waited %s for a server which never answers", wait)
+	}
+}
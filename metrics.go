@@ -0,0 +1,319 @@
+// Just enough of the Prometheus text format to publish our metrics on
+// /metrics, without pulling in the client library.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Bucket bounds, in seconds, for our timing histograms
+var durationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+	30, 60}
+
+// metricCounter is a value that only goes up
+type metricCounter struct {
+	mutex sync.Mutex // Protects the value
+	value float64    // Current total
+}
+
+func (c *metricCounter) add(v float64) {
+	c.mutex.Lock()
+	c.value += v
+	c.mutex.Unlock()
+}
+
+func (c *metricCounter) get() float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.value
+}
+
+// metricHistogram counts observations into buckets
+type metricHistogram struct {
+	mutex  sync.Mutex // Protects everything below
+	bounds []float64  // Upper bound of each bucket, ascending
+	counts []uint64   // Observations in each bucket, not cumulative
+	sum    float64    // Total of all observations
+	count  uint64     // Number of observations
+}
+
+func newMetricHistogram(bounds []float64) *metricHistogram {
+	h := new(metricHistogram)
+	h.bounds = bounds
+	h.counts = make([]uint64, len(bounds))
+
+	return h
+}
+
+func (h *metricHistogram) observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// Values past the last bound only show up in the +Inf bucket
+	i := sort.SearchFloat64s(h.bounds, v)
+
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+
+	h.sum += v
+	h.count++
+}
+
+// metricsWriter writes metrics out in the Prometheus text format
+type metricsWriter struct {
+	w io.Writer
+}
+
+// header writes the help and type lines of a metric
+func (m metricsWriter) header(name string, help string, kind string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (m metricsWriter) counter(name string, help string, c *metricCounter) {
+	m.counterValue(name, help, c.get())
+}
+
+// counterValue writes a counter kept somewhere other than a metricCounter
+func (m metricsWriter) counterValue(name string, help string, v float64) {
+	m.header(name, help, "counter")
+	fmt.Fprintf(m.w, "%s %s\n", name, formatMetric(v))
+}
+
+func (m metricsWriter) gauge(name string, help string, v float64) {
+	m.header(name, help, "gauge")
+	fmt.Fprintf(m.w, "%s %s\n", name, formatMetric(v))
+}
+
+// gaugeVec writes a gauge with one value for each value of the label
+func (m metricsWriter) gaugeVec(name string, help string, label string, values map[string]float64) {
+	m.header(name, help, "gauge")
+
+	keys := make([]string, 0, len(values))
+
+	for k := range values {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(m.w, "%s{%s=\"%s\"} %s\n", name, label, escapeLabel(k),
+			formatMetric(values[k]))
+	}
+}
+
+func (m metricsWriter) histogram(name string, help string, h *metricHistogram) {
+	m.header(name, help, "histogram")
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	total := uint64(0)
+
+	for i, bound := range h.bounds {
+		total += h.counts[i]
+		fmt.Fprintf(m.w, "%s_bucket{le=\"%s\"} %d\n", name, formatMetric(bound),
+			total)
+	}
+
+	fmt.Fprintf(m.w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(m.w, "%s_sum %s\n", name, formatMetric(h.sum))
+	fmt.Fprintf(m.w, "%s_count %d\n", name, h.count)
+}
+
+// formatMetric formats a value the way Prometheus expects
+func formatMetric(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Escapes the backslashes, quotes and newlines of a label value
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// metricsHandler serves up the metrics written by the given function
+func metricsHandler(write func(m metricsWriter)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		write(metricsWriter{w})
+	}
+}
+
+// serverMetrics are the counts the server keeps as jobs go by
+type serverMetrics struct {
+	scheduled   metricCounter    // Requests handed a worker
+	expired     metricCounter    // Requests that gave up waiting
+	completed   metricCounter    // Jobs reported complete
+	failed      metricCounter    // Completed jobs the compiler failed
+	inputBytes  metricCounter    // Source sent to workers
+	outputBytes metricCounter    // Object code sent back
+	queueWait   *metricHistogram // Seconds requests waited for a worker
+	compileTime *metricHistogram // Seconds the compiler ran
+}
+
+func newServerMetrics() *serverMetrics {
+	m := new(serverMetrics)
+	m.queueWait = newMetricHistogram(durationBuckets)
+	m.compileTime = newMetricHistogram(durationBuckets)
+
+	return m
+}
+
+// jobCompleted counts up a finished job
+func (m *serverMetrics) jobCompleted(cj CompletedJob) {
+	m.completed.add(1)
+
+	if cj.Return != 0 {
+		m.failed.add(1)
+	}
+
+	// Jobs the client built itself never went over the network
+	if !cj.local() {
+		m.inputBytes.add(float64(cj.InputSize))
+		m.outputBytes.add(float64(cj.OutputSize))
+	}
+
+	m.compileTime.observe(cj.workTime().Seconds())
+}
+
+// writeMetrics writes out the server's counts along with the current state
+// of the cluster
+func (s *ServerState) writeMetrics(m metricsWriter) {
+	workers := s.sch.getWorkerState().Workers
+	load := make(map[string]float64)
+	capacity := make(map[string]float64)
+	totalLoad, totalCapacity := 0, 0
+
+	for _, ws := range workers {
+		load[ws.Host] = float64(ws.Load)
+		capacity[ws.Host] = float64(ws.Capacity)
+		totalLoad += ws.Load
+		totalCapacity += ws.Capacity
+	}
+
+	queued := 0
+
+	for _, c := range s.sch.getQueueState().Clients {
+		queued += c.Queued
+	}
+
+	monitors, dropped := s.monitorUpdates.stats()
+
+	sm := s.metrics
+
+	m.counter("cbd_jobs_scheduled_total", "Requests handed a worker.",
+		&sm.scheduled)
+	m.counter("cbd_jobs_expired_total", "Requests that gave up waiting for a worker.",
+		&sm.expired)
+	m.counter("cbd_jobs_completed_total", "Jobs reported complete.",
+		&sm.completed)
+	m.counter("cbd_jobs_failed_total", "Completed jobs where the compiler failed.",
+		&sm.failed)
+	m.counter("cbd_input_bytes_total", "Bytes of source sent to workers.",
+		&sm.inputBytes)
+	m.counter("cbd_output_bytes_total", "Bytes of object code sent back.",
+		&sm.outputBytes)
+	m.histogram("cbd_queue_wait_seconds", "Time requests waited for a worker.",
+		sm.queueWait)
+	m.histogram("cbd_compile_seconds", "Time the compiler ran for each job.",
+		sm.compileTime)
+	m.gauge("cbd_queue_length", "Requests waiting for a worker.",
+		float64(queued))
+	m.gauge("cbd_workers", "Workers connected.", float64(len(workers)))
+	m.gauge("cbd_capacity", "Jobs all the workers can run at once.",
+		float64(totalCapacity))
+	m.gauge("cbd_load", "Jobs running on all the workers.", float64(totalLoad))
+	m.gaugeVec("cbd_worker_load", "Jobs running on each worker.", "worker",
+		load)
+	m.gaugeVec("cbd_worker_capacity", "Jobs each worker can run at once.",
+		"worker", capacity)
+	m.gauge("cbd_monitors", "Monitors and dashboards subscribed to updates.",
+		float64(monitors))
+	m.counterValue("cbd_monitor_updates_dropped_total",
+		"Updates dropped for monitors too far behind to take them.",
+		float64(dropped))
+}
+
+// workerMetrics are the counts a worker keeps as it builds jobs
+type workerMetrics struct {
+	jobs          metricCounter    // Jobs compiled
+	failed        metricCounter    // Jobs the compiler failed
+	rejected      metricCounter    // Jobs turned away while busy
+	receivedBytes metricCounter    // Source received
+	sentBytes     metricCounter    // Object code sent back
+	queueWait     *metricHistogram // Seconds jobs waited for a free slot
+	compileTime   *metricHistogram // Seconds the compiler ran
+}
+
+func newWorkerMetrics() *workerMetrics {
+	m := new(workerMetrics)
+	m.queueWait = newMetricHistogram(durationBuckets)
+	m.compileTime = newMetricHistogram(durationBuckets)
+
+	return m
+}
+
+// ServeMetrics serves the worker's metrics over HTTP until the context is
+// canceled
+func (w *Worker) ServeMetrics(ctx context.Context, ln net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(w.writeMetrics))
+
+	return serveHTTP(ctx, ln, mux)
+}
+
+// writeMetrics writes out the worker's counts and current state
+func (w *Worker) writeMetrics(m metricsWriter) {
+	running, queued := w.jobCounts()
+	draining := 0.0
+
+	if w.isDraining() {
+		draining = 1
+	}
+
+	wm := w.metrics
+
+	m.counter("cbd_worker_jobs_total", "Jobs compiled.", &wm.jobs)
+	m.counter("cbd_worker_jobs_failed_total", "Jobs where the compiler failed.",
+		&wm.failed)
+	m.counter("cbd_worker_jobs_rejected_total", "Jobs turned away while busy.",
+		&wm.rejected)
+	m.counter("cbd_worker_received_bytes_total", "Bytes of source received.",
+		&wm.receivedBytes)
+	m.counter("cbd_worker_sent_bytes_total", "Bytes of object code sent back.",
+		&wm.sentBytes)
+	m.histogram("cbd_worker_queue_wait_seconds", "Time jobs waited for a free slot.",
+		wm.queueWait)
+	m.histogram("cbd_worker_compile_seconds", "Time the compiler ran for each job.",
+		wm.compileTime)
+	m.gauge("cbd_worker_running", "Jobs compiling.", float64(running))
+	m.gauge("cbd_worker_queued", "Jobs waiting for a free slot.", float64(queued))
+	m.gauge("cbd_worker_slots", "Jobs that can compile at once.",
+		float64(w.jobs))
+	m.gauge("cbd_worker_draining", "1 while the worker is draining.", draining)
+}
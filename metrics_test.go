@@ -0,0 +1,205 @@
+// Tests for the Prometheus metrics.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWriter(t *testing.T) {
+	var c metricCounter
+	c.add(2)
+	c.add(1.5)
+
+	h := newMetricHistogram([]float64{1, 5})
+	h.observe(0.5)
+	h.observe(1)
+	h.observe(3)
+	h.observe(10)
+
+	var buf bytes.Buffer
+	m := metricsWriter{&buf}
+
+	m.counter("test_total", "A counter.", &c)
+	m.gauge("test_gauge", "A gauge.", 7)
+	m.gaugeVec("test_vec", "A vector.", "host", map[string]float64{
+		"b":         2,
+		"a\"quoted": 1,
+	})
+	m.histogram("test_seconds", "A histogram.", h)
+
+	expected := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total 3.5
+# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge 7
+# HELP test_vec A vector.
+# TYPE test_vec gauge
+test_vec{host="a\"quoted"} 1
+test_vec{host="b"} 2
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="5"} 3
+test_seconds_bucket{le="+Inf"} 4
+test_seconds_sum 14.5
+test_seconds_count 4
+`
+
+	if buf.String() != expected {
+		t.Errorf("Got:\n%s\nWanted:\n%s", buf.String(), expected)
+	}
+}
+
+// Fetches /metrics from the address
+func scrapeMetrics(t *testing.T, addr string) string {
+	resp, err := http.Get("http://" + addr + "/metrics")
+
+	if err != nil {
+		t.Fatal("Scrape error: ", err)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		t.Fatal("Read error: ", err)
+	}
+
+	return string(body)
+}
+
+// Checks the metrics contain every one of the lines
+func checkMetrics(t *testing.T, metrics string, lines []string) {
+	for _, line := range lines {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("Missing metric: %s", line)
+		}
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	s := NewServerState(ServerConfig{})
+
+	s.updateWorker(WorkerState{
+		ID:       "w1",
+		Host:     "w1",
+		Addrs:    []net.IPNet{{net.IPv4(192, 1, 1, 1), net.IPv4Mask(255, 255, 255, 0)}},
+		Capacity: 4,
+		Load:     3,
+	})
+
+	s.updateStats(CompletedJob{
+		Worker:      MachineName{ID: "w1", Host: "w1"},
+		InputSize:   100,
+		OutputSize:  40,
+		CompileTime: 2 * time.Second,
+		Timing:      JobTiming{Upload: time.Millisecond, Compile: time.Second},
+	})
+
+	// Built on the client, so nothing was sent to a worker
+	s.updateStats(CompletedJob{
+		Client:     MachineName{ID: "c1", Host: "c1"},
+		Worker:     MachineName{ID: "c1", Host: "c1"},
+		InputSize:  500,
+		OutputSize: 200,
+		Return:     1,
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("Listen error: ", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+
+	go func() {
+		served <- s.ServeStatus(ctx, ln)
+	}()
+
+	checkMetrics(t, scrapeMetrics(t, ln.Addr().String()), []string{
+		"cbd_jobs_completed_total 2",
+		"cbd_jobs_failed_total 1",
+		"cbd_input_bytes_total 100",
+		"cbd_output_bytes_total 40",
+		`cbd_compile_seconds_bucket{le="1"} 2`,
+		"cbd_compile_seconds_count 2",
+		"cbd_queue_length 0",
+		"cbd_workers 1",
+		"cbd_capacity 4",
+		"cbd_load 3",
+		`cbd_worker_load{worker="w1"} 3`,
+		`cbd_worker_capacity{worker="w1"} 4`,
+	})
+
+	cancel()
+
+	if err = <-served; err != nil {
+		t.Error("Serve error: ", err)
+	}
+}
+
+func TestWorkerMetrics(t *testing.T) {
+	w, err := NewWorker(57, "", 2)
+
+	if err != nil {
+		t.Fatal("Making worker:", err)
+	}
+
+	w.reserve()
+	w.startJob("")
+	w.reserve()
+
+	// A full queue turns the next job away
+	var network MockConn
+	mc := NewMessageConn(&network, time.Duration(10)*time.Second)
+	mc.Send(CompileJob{})
+
+	w.maxQueue = 0
+	w.handleRequest(&network)
+
+	w.metrics.jobs.add(1)
+	w.metrics.compileTime.observe(0.2)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("Listen error: ", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+
+	go func() {
+		served <- w.ServeMetrics(ctx, ln)
+	}()
+
+	checkMetrics(t, scrapeMetrics(t, ln.Addr().String()), []string{
+		"cbd_worker_jobs_total 1",
+		"cbd_worker_jobs_rejected_total 1",
+		`cbd_worker_compile_seconds_bucket{le="0.25"} 1`,
+		"cbd_worker_running 1",
+		"cbd_worker_queued 1",
+		"cbd_worker_slots 2",
+		"cbd_worker_draining 0",
+	})
+
+	cancel()
+
+	if err = <-served; err != nil {
+		t.Error("Serve error: ", err)
+	}
+}
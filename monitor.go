@@ -6,6 +6,7 @@
 package cbd
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"reflect"
@@ -24,28 +25,65 @@ func (mn *MachineName) ToString() string {
 
 // CompletedJob is one updated about a job completed on the cluster
 type CompletedJob struct {
+	ID           GUID          // ID the server gave the job, zero if none
 	Client       MachineName   // Machine that requested the job
 	Worker       MachineName   // Worker that build the job
+	File         string        // Source file compiled
+	Compiler     string        // Name of the compiler, without its path
+	Return       int           // Exit code of the compiler
 	InputSize    int           // Bytes of source code compiled
 	OutputSize   int           // Bytes of object code produced
 	CompileTime  time.Duration // How long the job took to complete
-	CompileSpeed float64       // Speed rating used for the job
+	CompileSpeed float64       // KB of input compiled per CPU second
+	Timing       JobTiming     // Where the time on the job went
+	BuildID      string        // Build the job was part of, from CBD_BUILD_ID
 }
 
-// We define the compile speed of a job based
+// workTime is how long the compiler ran, falling back to the total time
+// when the client didn't break it down
+func (c *CompletedJob) workTime() time.Duration {
+	if c.Timing.Compile > 0 {
+		return c.Timing.Compile
+	}
+
+	return c.CompileTime
+}
+
+// local returns true if the client built the job itself.  A worker on the
+// client's host has the same name, but only remote jobs are uploaded.
+func (c *CompletedJob) local() bool {
+	if c.Timing != (JobTiming{}) {
+		return c.Timing.Upload == 0
+	}
+
+	return c.Worker == c.Client
+}
+
+// We define the compile speed of a job as how much input the compiler got
+// through per second of CPU time, which leaves out time spent waiting and on
+// the network.  Without a CPU time we fall back to the time it ran.
 func (c *CompletedJob) computeCompileSpeed() {
-	c.CompileSpeed = float64(c.OutputSize) / c.CompileTime.Seconds() / 1024
+	t := c.Timing.CPU
+
+	if t <= 0 {
+		t = c.workTime()
+	}
+
+	c.CompileSpeed = float64(c.InputSize) / t.Seconds() / 1024
 }
 
 type Monitor struct {
-	saddr string       // Address for the server
-	mc    *MessageConn // Message connection to server
+	saddr  string        // Address for the server
+	filter MonitorFilter // Updates we want the server to send
+	mc     *MessageConn  // Message connection to server
 }
 
-// Creates a new connects to the server
-func NewMonitor(saddr string) *Monitor {
+// Creates a new connects to the server, which will only send the updates
+// passing the filter
+func NewMonitor(saddr string, filter MonitorFilter) *Monitor {
 	m := new(Monitor)
 	m.saddr = saddr
+	m.filter = filter
 	m.mc = nil
 
 	return m
@@ -54,23 +92,22 @@ func NewMonitor(saddr string) *Monitor {
 // Connect to the server and sends monitoring request
 func (m *Monitor) Connect() error {
 	// If we have no set address, use auto-discovery to find the server
-	saddr := m.saddr
+	servers := SplitList(m.saddr)
 
-	if len(saddr) == 0 {
+	if len(servers) == 0 {
 		DebugPrint("Finding server with autodiscovery")
-		var err error
-		saddr, err = audoDiscoverySearch(time.Duration(5) * time.Second)
+		saddr, err := audoDiscoverySearch(time.Duration(5) * time.Second)
 
 		if err != nil {
 			return err
 		}
-	} else {
-		saddr = addPortIfNeeded(saddr, DefaultServerPort)
+
+		servers = []string{saddr}
 	}
 
-	// Connect
+	// Connect to the first server that answers
 	var err error
-	m.mc, err = NewTCPMessageConn(saddr, time.Duration(10)*time.Second)
+	m.mc, _, err = dialServers(servers, time.Duration(10)*time.Second)
 
 	if err != nil {
 		m.mc = nil
@@ -91,15 +128,45 @@ func (m *Monitor) Connect() error {
 
 	// Send out monitor request
 	rq := MonitorRequest{
-		Host: hostid,
+		Host:   hostid,
+		Filter: m.filter,
 	}
 	m.mc.Send(rq)
 
 	return nil
 }
 
-// Print out report data in raw form, connecting if needed
-func (m *Monitor) BasicReport() error {
+// readUpdates reads updates from the server in the background, until the
+// connection drops or stop is closed
+func (m *Monitor) readUpdates(stop <-chan struct{}) (<-chan interface{}, <-chan error) {
+	msgs := make(chan interface{})
+	errs := make(chan error, 1)
+	mc := m.mc
+
+	go func() {
+		for {
+			_, msg, err := mc.Read()
+
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			select {
+			case msgs <- msg:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return msgs, errs
+}
+
+// report hands every update from the server to the function, connecting if
+// needed.  It returns nil once the context is canceled, otherwise the error
+// which ended it.
+func (m *Monitor) report(ctx context.Context, update func(msg interface{}) error) error {
 	// Connect of needed
 	if m.mc == nil {
 		err := m.Connect()
@@ -109,37 +176,106 @@ func (m *Monitor) BasicReport() error {
 		}
 	}
 
-	// Jump into our reporting loop
+	stop := make(chan struct{})
+	defer close(stop)
+
+	msgs, errs := m.readUpdates(stop)
+
 	for {
-		_, i, err := m.mc.Read()
+		select {
+		case msg := <-msgs:
+			err := update(msg)
 
-		if err != nil {
+			if err != nil {
+				m.mc.Close()
+				m.mc = nil
+				return err
+			}
+		case err := <-errs:
 			// TODO: check for stale data
 			m.mc = nil
-
 			return err
+		case <-ctx.Done():
+			// Closing the connection ends the reader
+			m.mc.Close()
+			m.mc = nil
+			return nil
 		}
+	}
+}
 
-		switch m := i.(type) {
-		case CompletedJob:
-			fmt.Printf("%s: finished job in: %.3fs (Speed: %.0f)\n", m.Worker,
-				m.CompileTime.Seconds(), m.CompileSpeed)
+// Print out report data in raw form until the context is canceled,
+// connecting if needed
+func (m *Monitor) BasicReport(ctx context.Context) error {
+	return m.report(ctx, printUpdate)
+}
+
+// printUpdate prints an update from the server in raw form
+func printUpdate(i interface{}) error {
+	switch m := i.(type) {
+	case CompletedJob:
+		fmt.Printf("%s: finished job in: %.3fs (Speed: %.0f)\n", m.Worker,
+			m.CompileTime.Seconds(), m.CompileSpeed)
+
+		t := m.Timing
+		fmt.Printf("  %s: preprocess %.3fs queue %.3fs upload %.3fs "+
+			"compile %.3fs download %.3fs write %.3fs\n", m.File,
+			t.Preprocess.Seconds(), t.Queue.Seconds(), t.Upload.Seconds(),
+			t.Compile.Seconds(), t.Download.Seconds(), t.Write.Seconds())
 
-		case WorkerStateList:
-			// Final output
-			// id?  Preprocess/Compile    file.cpp                     server[core#]
+	case WorkerStateList:
+		// Final output
+		// id?  Preprocess/Compile    file.cpp                     server[core#]
 
-			fmt.Printf("[")
-			for _, state := range m.Workers {
-				// element is the element from someSlice for where we are
-				fmt.Printf("%s[%d|%d|%.0f] ", state.Host, state.Load,
-					state.Capacity, state.Speed)
+		fmt.Printf("[")
+		for _, state := range m.Workers {
+			// element is the element from someSlice for where we are
+			fmt.Printf("%s[%d|%d|%.2f] ", state.Host, state.Load,
+				state.Capacity, state.Speed)
+
+			if state.Suspect {
+				fmt.Printf("(suspect) ")
 			}
-			fmt.Printf("]\n")
+		}
+		fmt.Printf("]\n")
 
-		default:
-			fmt.Printf("ERROR, unknown message type: %s\n",
-				reflect.TypeOf(i).Name())
+	case QueueState:
+		// Only worth printing when there is something outstanding
+		if len(m.Clients) == 0 {
+			break
 		}
+
+		fmt.Printf("Clients: [")
+		for _, c := range m.Clients {
+			fmt.Printf("%s[%d|%d] ", c.Client, c.Queued, c.Running)
+		}
+		fmt.Printf("]\n")
+
+	case WorkerEvent:
+		fmt.Printf("Worker %s %s", m.Worker.ToString(), m.Type)
+
+		if len(m.Reason) > 0 {
+			fmt.Printf(": %s", m.Reason)
+		}
+		fmt.Printf("\n")
+
+	case MissedUpdates:
+		fmt.Printf("Missed %d updates, the server dropped them while we "+
+			"were behind\n", m.Count)
+
+	case JobEvent:
+		fmt.Printf("Job %s %s %s -> %s", m.File, m.Type, m.Client.Host,
+			m.Worker.Host)
+
+		if len(m.Reason) > 0 {
+			fmt.Printf(": %s", m.Reason)
+		}
+		fmt.Printf("\n")
+
+	default:
+		fmt.Printf("ERROR, unknown message type: %s\n",
+			reflect.TypeOf(i).Name())
 	}
+
+	return nil
 }
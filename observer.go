@@ -1,71 +1,148 @@
 // Functions and structures relating to the monitoring the state of the cluster
-// This is a basic observer pattern implementation.
+// This is a basic observer pattern implementation.  Each subscriber has its
+// own bounded buffer, so a slow one only loses its own updates, and is told
+// how many it missed once it catches up.
 //
 // Author: Joseph Lisee <jlisee@gmail.com>
 
 package cbd
 
-// observerDst represents a location to send updates to
-type observerDst struct {
-	host string
-	ch   chan interface{}
+import (
+	"log"
+	"sync"
+)
+
+// Updates buffered for each monitor before we start dropping them
+const subscriberBuffer = 256
+
+// MissedUpdates is sent to a monitor ahead of the next update it gets after
+// falling behind, in place of the updates it missed
+type MissedUpdates struct {
+	Count int // Updates dropped since the last one sent
+}
+
+// subscriber is one destination for updates
+type subscriber struct {
+	id      uint64           // Unique to this subscription
+	name    string           // Who subscribed, for logging
+	updates chan interface{} // Waiting updates, closed on unsubscribe
+	missed  int              // Dropped since the last update sent
+	dropped uint64           // Dropped over the whole subscription
 }
 
 type updatePublisher struct {
-	updates     chan interface{} // Completed jobs
-	newMonitor  chan observerDst // Channel to send new monitors
-	stopMonitor chan string      // Channel used to stop a monitor
+	mutex   sync.Mutex             // Protects everything below
+	subs    map[uint64]*subscriber // Current subscribers by ID
+	nextID  uint64                 // ID of the next subscriber
+	dropped uint64                 // Updates dropped for every subscriber
+	stopped bool                   // No more updates will be published
 }
 
 func newUpdatePublisher() *updatePublisher {
 	p := new(updatePublisher)
-	p.updates = make(chan interface{})
-	p.newMonitor = make(chan observerDst)
-	p.stopMonitor = make(chan string)
-
-	go p.handlePublish()
+	p.subs = make(map[uint64]*subscriber)
 
 	return p
 }
 
-func (p *updatePublisher) addObs(h string, c chan interface{}) {
-	p.newMonitor <- observerDst{host: h, ch: c}
+// subscribe starts sending updates to a new subscriber, buffering up to
+// size of them.  Once stopped the subscriber's channel is already closed.
+func (p *updatePublisher) subscribe(name string, size int) *subscriber {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.nextID++
+
+	sub := &subscriber{
+		id:      p.nextID,
+		name:    name,
+		updates: make(chan interface{}, size),
+	}
+
+	if p.stopped {
+		close(sub.updates)
+	} else {
+		p.subs[sub.id] = sub
+	}
+
+	return sub
+}
+
+// unsubscribe stops sending updates to the subscriber and closes its
+// channel, it's safe to call more than once
+func (p *updatePublisher) unsubscribe(sub *subscriber) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, ok := p.subs[sub.id]; ok {
+		delete(p.subs, sub.id)
+		close(sub.updates)
+
+		if sub.dropped > 0 {
+			log.Printf("Monitor %s missed %d updates in all", sub.name,
+				sub.dropped)
+		}
+	}
 }
 
-func (p *updatePublisher) removeObs(h string) {
-	p.stopMonitor <- h
+// stop closes every subscriber's channel, anything published after is
+// dropped
+func (p *updatePublisher) stop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.stopped = true
+
+	for id, sub := range p.subs {
+		delete(p.subs, id)
+		close(sub.updates)
+	}
 }
 
-func (p *updatePublisher) publish(j interface{}) {
-	p.updates <- j
+// publish hands the update to every subscriber with room for it, without
+// ever blocking
+func (p *updatePublisher) publish(u interface{}) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, sub := range p.subs {
+		if !sub.send(u) {
+			p.dropped++
+		}
+	}
 }
 
-func (p *updatePublisher) handlePublish() {
-	obs := make(map[string]chan interface{})
-	more := true
+// stats returns the number of subscribers and the updates dropped so far
+func (p *updatePublisher) stats() (subscribers int, dropped uint64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
-	for more {
-		// Read in new jobs and update observers map as needed
-		var cj interface{}
+	return len(p.subs), p.dropped
+}
 
+// send buffers the update, returning false if there was no room for it.
+// A subscriber which has missed updates is told so before anything else.
+func (sub *subscriber) send(u interface{}) bool {
+	if sub.missed > 0 {
 		select {
-		case mDst := <-p.newMonitor:
-			// Add new destination
-			obs[mDst.host] = mDst.ch
-		case h := <-p.stopMonitor:
-			// Remove destination
-			delete(obs, h)
-
-		case cj, more = <-p.updates:
-			// Send to all channels that are ready
-			for _, dst := range obs {
-				select {
-				case dst <- cj:
-					// Message away
-				default:
-					// Nothing to do
-				}
-			}
+		case sub.updates <- MissedUpdates{Count: sub.missed}:
+			sub.missed = 0
+		default:
 		}
 	}
+
+	if sub.missed == 0 {
+		select {
+		case sub.updates <- u:
+			return true
+		default:
+			log.Printf("Monitor %s is falling behind, dropping updates",
+				sub.name)
+		}
+	}
+
+	sub.missed++
+	sub.dropped++
+
+	return false
 }
@@ -5,121 +5,244 @@
 package cbd
 
 import (
-	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
-type TestListener struct {
-	res     []CompletedJob   // All jobs we got
-	updates chan interface{} // Incoming Updates
-	done    chan bool        // Signal when we got a job
-	run     bool
+// Reads the next update from the subscriber, failing if there isn't one
+func nextUpdate(t *testing.T, sub *subscriber) interface{} {
+	select {
+	case u, ok := <-sub.updates:
+		if !ok {
+			t.Fatal("Subscription closed")
+		}
+		return u
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for an update")
+	}
+
+	return nil
 }
 
-func newListener(t *testing.T) *TestListener {
-	l := new(TestListener)
-	l.updates = make(chan interface{})
-	l.done = make(chan bool)
-	l.run = true
+func TestCompletedJobPublisher(t *testing.T) {
+	p := newUpdatePublisher()
 
-	l.runListener(t)
+	an := MachineName{Host: "A"}
+	bn := MachineName{Host: "B"}
+	cn := MachineName{Host: "C"}
 
-	return l
-}
+	// Publish something and make sure we got it
+	s1 := p.subscribe("1", 10)
+	p.publish(CompletedJob{Client: an, Worker: bn})
 
-func (l *TestListener) runListener(t *testing.T) {
-	go func() {
-		for l.run {
-			update := <-l.updates
+	if j, ok := nextUpdate(t, s1).(CompletedJob); !ok || j.Worker != bn {
+		t.Error("Error with publish: ", j)
+	}
 
-			switch u := update.(type) {
-			case CompletedJob:
-				l.res = append(l.res, u)
-			default:
-				t.Errorf("Did not understand update type: " + reflect.TypeOf(update).Name())
-			}
+	// Add another and both get the next job
+	s2 := p.subscribe("2", 10)
+	p.publish(CompletedJob{Client: an, Worker: cn})
 
-			l.done <- true
+	for _, sub := range []*subscriber{s1, s2} {
+		if j, ok := nextUpdate(t, sub).(CompletedJob); !ok || j.Worker != cn {
+			t.Error("Error with publish: ", j)
 		}
-	}()
+	}
+
+	// Now remove the first one, which closes its channel
+	p.unsubscribe(s1)
+	p.publish(CompletedJob{Client: an, Worker: bn})
+
+	if _, ok := <-s1.updates; ok {
+		t.Error("Got an update after unsubscribing")
+	}
+
+	if j, ok := nextUpdate(t, s2).(CompletedJob); !ok || j.Worker != bn {
+		t.Error("Error with publish: ", j)
+	}
 }
 
-func TestCompletedJobPublisher(t *testing.T) {
+func TestPublisherDrops(t *testing.T) {
 	p := newUpdatePublisher()
+	sub := p.subscribe("slow", 2)
 
-	// Add a listener
-	l1 := newListener(t)
+	for i := 0; i < 5; i++ {
+		p.publish(i)
+	}
 
-	p.addObs("1", l1.updates)
+	// We only kept what fit
+	if nextUpdate(t, sub) != 0 || nextUpdate(t, sub) != 1 {
+		t.Error("Wrong updates kept")
+	}
 
-	// Define names
-	an := MachineName{
-		ID:   MachineID(""),
-		Host: "A",
+	if _, dropped := p.stats(); dropped != 3 {
+		t.Errorf("Dropped %d updates, wanted 3", dropped)
 	}
 
-	bn := MachineName{
-		ID:   MachineID(""),
-		Host: "B",
+	// Then we are told what we missed before the next update
+	p.publish(5)
+
+	if m, ok := nextUpdate(t, sub).(MissedUpdates); !ok || m.Count != 3 {
+		t.Errorf("Expected notice of 3 missed got: %v", m)
 	}
 
-	cn := MachineName{
-		ID:   MachineID(""),
-		Host: "C",
+	if u := nextUpdate(t, sub); u != 5 {
+		t.Errorf("Expected 5 got: %v", u)
 	}
 
-	// Publish something
-	j := CompletedJob{Client: an, Worker: bn}
-	p.publish(j)
+	// Other subscribers don't suffer for a slow one
+	fast := p.subscribe("fast", 10)
 
-	// Make sure we got it
-	_ = <-l1.done
+	for i := 0; i < 5; i++ {
+		p.publish(i)
+	}
 
-	if len(l1.res) != 1 {
-		t.Errorf("Error with publish")
-	} else {
-		if l1.res[0].Client != an {
-			t.Errorf("Error with publish")
+	for i := 0; i < 5; i++ {
+		if u := nextUpdate(t, fast); u != i {
+			t.Errorf("Expected %d got: %v", i, u)
 		}
 	}
+}
 
-	// Add another
-	l2 := newListener(t)
+func TestPublisherUniqueSubscribers(t *testing.T) {
+	p := newUpdatePublisher()
 
-	p.addObs("2", l2.updates)
+	// The same name twice gets two subscriptions
+	a := p.subscribe("same", 10)
+	b := p.subscribe("same", 10)
 
-	// Publish another job
-	j = CompletedJob{Client: an, Worker: cn}
-	p.publish(j)
+	if a.id == b.id {
+		t.Error("Subscribers share an ID")
+	}
 
-	_ = <-l1.done
-	_ = <-l2.done
+	p.unsubscribe(a)
+	p.unsubscribe(a)
+	p.publish("hello")
 
-	if len(l1.res) != 2 {
-		t.Errorf("Error with publish")
+	if u := nextUpdate(t, b); u != "hello" {
+		t.Errorf("Expected hello got: %v", u)
 	}
 
-	if len(l2.res) != 1 {
-		t.Errorf("Error with publish")
+	if n, _ := p.stats(); n != 1 {
+		t.Errorf("Got %d subscribers wanted 1", n)
 	}
+}
+
+func TestPublisherStop(t *testing.T) {
+	p := newUpdatePublisher()
+	sub := p.subscribe("1", 10)
 
-	// Now remove the main one
-	p.removeObs("1")
+	p.publish("before")
+	p.stop()
+	p.publish("after")
 
-	j = CompletedJob{Client: an, Worker: cn}
-	p.publish(j)
+	// What was sent before is still there, then the channel is closed
+	if u := nextUpdate(t, sub); u != "before" {
+		t.Errorf("Expected before got: %v", u)
+	}
+
+	if _, ok := <-sub.updates; ok {
+		t.Error("Channel still open after stop")
+	}
 
-	_ = <-l2.done
+	// Late subscribers are closed from the start
+	late := p.subscribe("late", 10)
 
-	if len(l1.res) != 2 {
-		t.Errorf("Error with publish")
+	if _, ok := <-late.updates; ok {
+		t.Error("Late subscriber channel is open")
 	}
 
-	if len(l2.res) != 2 {
-		t.Errorf("Error with publish")
+	p.unsubscribe(sub)
+	p.unsubscribe(late)
+}
+
+// Run with -race to check the publisher's locking
+func TestPublisherConcurrent(t *testing.T) {
+	p := newUpdatePublisher()
+
+	const publishers = 4
+	const updates = 500
+
+	// One subscriber reads everything, counting what it missed
+	sub := p.subscribe("counted", 16)
+	received, missed := 0, 0
+	read := make(chan bool)
+
+	go func() {
+		for u := range sub.updates {
+			if m, ok := u.(MissedUpdates); ok {
+				missed += m.Count
+			} else {
+				received++
+			}
+		}
+		read <- true
+	}()
+
+	var wg sync.WaitGroup
+
+	// Others come and go while we publish
+	for i := 0; i < publishers; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < updates; j++ {
+				p.publish(j)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				s := p.subscribe("churn", 1)
+				<-s.updates
+				p.unsubscribe(s)
+			}
+		}()
+	}
+
+	// Churners wait on an update, so keep them fed until they're done
+	done := make(chan bool)
+	fed := make(chan int)
+
+	go func() {
+		n := 0
+
+		for {
+			select {
+			case <-done:
+				fed <- n
+				return
+			default:
+				p.publish("feed")
+				n++
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	feeds := <-fed
+
+	// Anything not yet reported missed is still counted on the subscriber
+	p.mutex.Lock()
+	pending := sub.missed
+	p.mutex.Unlock()
+
+	p.unsubscribe(sub)
+	<-read
+
+	// Every update was either read or missed
+	total := received + missed + pending
+
+	if total != publishers*updates+feeds {
+		t.Errorf("Accounted for %d of %d updates", total,
+			publishers*updates+feeds)
 	}
 
-	// Halt all the go routines
-	l1.run = false
-	l2.run = false
+	p.stop()
 }
@@ -0,0 +1,125 @@
+// Saving what the server has learned about the cluster to a local file, so
+// a restarted server schedules as well as the one it replaced.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How often the server saves its state
+var stateSaveInterval = time.Duration(1) * time.Minute
+
+// ServerSnapshot is the learned state of a server written to disk
+type ServerSnapshot struct {
+	Saved     time.Time      // When the snapshot was taken
+	Scheduler SchedulerState // Worker speeds, compilers and job times
+	Stats     ServerStats    // Totals of all completed jobs
+}
+
+// saveSnapshot writes the snapshot as JSON, replacing the file in one step
+// so a crash never leaves a partial file behind
+func saveSnapshot(path string, snap ServerSnapshot) error {
+	data, err := json.MarshalIndent(snap, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// loadSnapshot reads back a snapshot written by saveSnapshot
+func loadSnapshot(path string) (ServerSnapshot, error) {
+	var snap ServerSnapshot
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return snap, err
+	}
+
+	err = json.Unmarshal(data, &snap)
+
+	return snap, err
+}
+
+// snapshot gathers up the state worth saving
+func (s *ServerState) snapshot() ServerSnapshot {
+	return ServerSnapshot{
+		Saved:     time.Now(),
+		Scheduler: s.sch.saveState(),
+		Stats:     s.getStats(),
+	}
+}
+
+// saveState writes our state to the state file
+func (s *ServerState) saveState() {
+	err := saveSnapshot(s.stateFile, s.snapshot())
+
+	if err != nil {
+		log.Print("Error saving server state: ", err)
+	}
+}
+
+// loadState restores the state saved by a previous server, a missing file
+// just means we are starting fresh
+func (s *ServerState) loadState() {
+	snap, err := loadSnapshot(s.stateFile)
+
+	if os.IsNotExist(err) {
+		return
+	}
+
+	if err != nil {
+		log.Print("Error loading server state: ", err)
+		return
+	}
+
+	s.sch.loadState(snap.Scheduler)
+
+	s.statsMutex.Lock()
+	s.stats = snap.Stats
+	s.statsMutex.Unlock()
+
+	log.Printf("Loaded state of %d workers saved at %s",
+		len(snap.Scheduler.Speeds), snap.Saved)
+}
+
+// saveStateLoop saves our state periodically, and one last time when the
+// server shuts down
+func (s *ServerState) saveStateLoop() {
+	for {
+		select {
+		case <-s.quit:
+			s.saveState()
+			return
+		case <-time.After(stateSaveInterval):
+			s.saveState()
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Tests for saving server state.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServerStatePersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbd-state")
+
+	if err != nil {
+		t.Fatal("Temp dir error: ", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+
+	// A missing file is fine, we just start fresh
+	s := NewServerState(ServerConfig{StateFile: path})
+
+	ws := WorkerState{
+		ID:       "fast",
+		Host:     "fast",
+		Addrs:    []net.IPNet{{net.IPv4(192, 1, 1, 1), net.IPv4Mask(255, 255, 255, 0)}},
+		Capacity: 2,
+		Compilers: []CompilerInfo{
+			{Name: "gcc", Version: "12"},
+			{Name: "clang", Version: "15.0.7"},
+		},
+	}
+
+	s.updateWorker(ws)
+
+	s.updateStats(CompletedJob{
+		Worker:       MachineName{ID: "fast", Host: "fast"},
+		InputSize:    100,
+		OutputSize:   50,
+		CompileTime:  2 * time.Second,
+		Compiler:     "gcc",
+		CompileSpeed: 25,
+	})
+
+	speed := s.sch.getWorkerState().Workers[0].Speed
+
+	s.saveState()
+
+	// A new server picks up the speed as soon as the worker connects
+	r := NewServerState(ServerConfig{StateFile: path})
+
+	// Compilers are known before the worker is back
+	if c := r.sch.saveState().Compilers["fast"]; !reflect.DeepEqual(c, ws.Compilers) {
+		t.Errorf("Got compilers %v wanted %v", c, ws.Compilers)
+	}
+
+	// And kept for a worker which doesn't report them
+	compilers := ws.Compilers
+	ws.Compilers = nil
+
+	if st := r.getStats(); st.Jobs != 1 || st.InputBytes != 100 || st.CompileTime != 2*time.Second {
+		t.Error("Stats not restored: ", st)
+	}
+
+	r.updateWorker(ws)
+
+	l := r.sch.getWorkerState()
+
+	if len(l.Workers) != 1 || l.Workers[0].Speed != speed {
+		t.Error("Worker speed not restored: ", l.Workers)
+	}
+
+	if !reflect.DeepEqual(l.Workers[0].Compilers, compilers) {
+		t.Error("Worker compilers not restored: ", l.Workers[0].Compilers)
+	}
+
+	if rate := r.sch.saveState().Rates["gcc"]; rate != 25 {
+		t.Errorf("Got gcc rate %f wanted 25", rate)
+	}
+
+	// The speed is remembered even if the worker went away before we saved
+	r.removeWorker(ws, "test")
+
+	if got := r.sch.saveState().Speeds["fast"]; got != speed {
+		t.Errorf("Got speed %f wanted %f", got, speed)
+	}
+}
+
+func TestLoadBadSnapshot(t *testing.T) {
+	f, err := ioutil.TempFile("", "cbd-state")
+
+	if err != nil {
+		t.Fatal("Temp file error: ", err)
+	}
+
+	defer os.Remove(f.Name())
+
+	f.WriteString("{not json")
+	f.Close()
+
+	if _, err := loadSnapshot(f.Name()); err == nil {
+		t.Error("Expected error loading a bad snapshot")
+	}
+
+	// The server still starts
+	s := NewServerState(ServerConfig{StateFile: f.Name()})
+
+	if st := s.getStats(); st.Jobs != 0 {
+		t.Error("Expected empty stats: ", st)
+	}
+}
@@ -0,0 +1,152 @@
+// The scheduling policies used by the PolicyScheduler.  Each one decides
+// which free worker a request should get, and in what order queued requests
+// are served.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+// schedPolicy plugs into the PolicyScheduler, all calls are made with the
+// scheduler locked.
+type schedPolicy interface {
+	// better returns true when worker a should be picked over worker b
+	better(a, b *WorkerState) bool
+
+	// nearestFirst returns true when workers on the client's most private
+	// network should be used before looking at any other network
+	nearestFirst() bool
+
+	// stamp sets the order key on a newly arrived request
+	stamp(req *SchedulerRequest)
+
+	// dispatched is called when a request has been given a worker
+	dispatched(req *SchedulerRequest)
+}
+
+// freeSlots is how many more jobs the worker can take, jobs waiting on the
+// worker for a slot are already spoken for
+func freeSlots(ws *WorkerState) int {
+	return ws.Capacity - ws.Load - ws.Queued
+}
+
+// freeFraction is the fraction of the workers capacity that is not in use
+func freeFraction(ws *WorkerState) float64 {
+	if ws.Capacity <= 0 {
+		return 0
+	}
+
+	return float64(freeSlots(ws)) / float64(ws.Capacity)
+}
+
+// fifoPolicy serves requests in the order they arrive, giving each the
+// fastest worker available.
+type fifoPolicy struct{}
+
+func (fifoPolicy) better(a, b *WorkerState) bool {
+	return a.Speed > b.Speed
+}
+
+func (fifoPolicy) nearestFirst() bool               { return false }
+func (fifoPolicy) stamp(req *SchedulerRequest)      {}
+func (fifoPolicy) dispatched(req *SchedulerRequest) {}
+
+// leastLoadedPolicy spreads jobs out by giving each request the worker with
+// the largest fraction of its capacity free.
+type leastLoadedPolicy struct {
+	fifoPolicy
+}
+
+func (leastLoadedPolicy) better(a, b *WorkerState) bool {
+	af := freeFraction(a)
+	bf := freeFraction(b)
+
+	if af != bf {
+		return af > bf
+	}
+
+	// Break ties with the raw free slots, then the speed
+	as := freeSlots(a)
+	bs := freeSlots(b)
+
+	if as != bs {
+		return as > bs
+	}
+
+	return a.Speed > b.Speed
+}
+
+// speedPolicy weights the speed of each worker by how much of it is free, so
+// fast workers get more jobs without piling everything onto them.
+type speedPolicy struct {
+	fifoPolicy
+}
+
+func (speedPolicy) better(a, b *WorkerState) bool {
+	as := a.Speed * freeFraction(a)
+	bs := b.Speed * freeFraction(b)
+
+	if as != bs {
+		return as > bs
+	}
+
+	return a.Speed > b.Speed
+}
+
+// localityPolicy keeps jobs on the client's own subnet whenever a worker is
+// free there, using the ByPrivateIPAddr order of the client's addresses.
+type localityPolicy struct {
+	fifoPolicy
+}
+
+func (localityPolicy) nearestFirst() bool { return true }
+
+// fairSharePolicy serves clients round-robin, so one client with a deep
+// queue can't starve everyone else.  Each request gets a start tag one past
+// the last one its client was given, or the tag currently being served if
+// that is later.  This is Start-time Fair Queuing, where a client with a
+// weight of 2 has its tags advance half as fast, so gets twice the share.
+type fairSharePolicy struct {
+	fifoPolicy
+
+	vtime   float64            // Tag of the last request given a worker
+	last    map[string]float64 // Tag of the latest request from each client
+	weights map[string]float64 // Share of each client, 1 if not present
+}
+
+func newFairSharePolicy(weights map[string]float64) *fairSharePolicy {
+	p := new(fairSharePolicy)
+	p.last = make(map[string]float64)
+	p.weights = weights
+
+	return p
+}
+
+func (p *fairSharePolicy) stamp(req *SchedulerRequest) {
+	tag := p.last[req.owner]
+
+	if tag < p.vtime {
+		tag = p.vtime
+	}
+
+	weight, ok := p.weights[req.owner]
+
+	if !ok {
+		weight = 1
+	}
+
+	req.key = tag + 1/weight
+	p.last[req.owner] = req.key
+}
+
+func (p *fairSharePolicy) dispatched(req *SchedulerRequest) {
+	if req.key > p.vtime {
+		p.vtime = req.key
+	}
+
+	// Forget clients that have fallen behind, they start from vtime anyway
+	for client, tag := range p.last {
+		if tag <= p.vtime {
+			delete(p.last, client)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Machine readable output for "cbd monitor": every update from the server as
+// a line of JSON, or jobs and workers as rows of CSV, ready for jq, log
+// shippers or a spreadsheet.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Columns of the CSV output.  Job rows leave the worker columns empty and
+// worker rows the job columns.
+var monitorColumns = []string{
+	"time", "type", "worker", "client", "file", "compiler", "return",
+	"input_bytes", "output_bytes", "compile_seconds", "cpu_seconds",
+	"compile_speed", "load", "capacity", "queued", "speed", "suspect",
+	"draining",
+}
+
+// monitorRecord is one update from the server as written in JSON.  Only the
+// field matching the type is filled in.
+type monitorRecord struct {
+	Type     string          // job, workers, queue, worker, step or missed
+	Time     time.Time       // When the monitor got the update
+	Job      *CompletedJob   `json:",omitempty"`
+	Workers  []WorkerStatus  `json:",omitempty"`
+	Clients  []ClientQueue   `json:",omitempty"`
+	Event    *dashboardEvent `json:",omitempty"`
+	JobEvent *jobEventRecord `json:",omitempty"`
+	Missed   int             `json:",omitempty"`
+}
+
+// jobEventRecord is a job event with the type spelled out
+type jobEventRecord struct {
+	ID     string      // ID the server gave the job
+	Type   string      // What happened
+	Client MachineName // Machine that requested the job
+	Worker MachineName // Worker building the job, once assigned
+	File   string      // Source file being compiled
+	Reason string      // Why the job failed, if it did
+	Time   time.Time   // When the server heard of it
+}
+
+// MonitorWriter writes updates from the server in a machine readable format
+type MonitorWriter struct {
+	format string        // json or csv
+	enc    *json.Encoder // Writes JSON lines
+	csv    *csv.Writer   // Writes CSV rows
+	header bool          // CSV header has been written
+}
+
+// NewMonitorWriter returns a writer for the given format, json or csv
+func NewMonitorWriter(w io.Writer, format string) (*MonitorWriter, error) {
+	mw := new(MonitorWriter)
+	mw.format = format
+
+	switch format {
+	case "json":
+		mw.enc = json.NewEncoder(w)
+	case "csv":
+		mw.csv = csv.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("Unknown format: %s (must be json or csv)",
+			format)
+	}
+
+	return mw, nil
+}
+
+// Write writes out a single update received at the given time
+func (mw *MonitorWriter) Write(msg interface{}, now time.Time) error {
+	if mw.format == "csv" {
+		return mw.writeCSV(msg, now)
+	}
+
+	r := monitorRecord{Time: now}
+
+	switch m := msg.(type) {
+	case CompletedJob:
+		r.Type, r.Job = "job", &m
+	case WorkerStateList:
+		r.Type, r.Workers = "workers", toWorkerStatus(m.Workers)
+	case QueueState:
+		r.Type, r.Clients = "queue", m.Clients
+	case WorkerEvent:
+		r.Type, r.Event = "worker", &dashboardEvent{
+			Type:   m.Type.String(),
+			Worker: m.Worker,
+			Reason: m.Reason,
+			Time:   m.Time,
+		}
+	case JobEvent:
+		r.Type, r.JobEvent = "step", &jobEventRecord{
+			ID:     m.ID.String(),
+			Type:   m.Type.String(),
+			Client: m.Client,
+			Worker: m.Worker,
+			File:   m.File,
+			Reason: m.Reason,
+			Time:   m.Time,
+		}
+	case MissedUpdates:
+		r.Type, r.Missed = "missed", m.Count
+	default:
+		return nil
+	}
+
+	return mw.enc.Encode(r)
+}
+
+// writeCSV writes a row for a job, or one for each worker in a list.  Other
+// updates don't fit the columns and are skipped.
+func (mw *MonitorWriter) writeCSV(msg interface{}, now time.Time) error {
+	var rows [][]string
+	t := now.Format(time.RFC3339Nano)
+
+	switch m := msg.(type) {
+	case CompletedJob:
+		rows = append(rows, []string{
+			t, "job", m.Worker.Host, m.Client.Host, m.File, m.Compiler,
+			strconv.Itoa(m.Return), strconv.Itoa(m.InputSize),
+			strconv.Itoa(m.OutputSize), formatSeconds(m.CompileTime),
+			formatSeconds(m.Timing.CPU), formatFloat(m.CompileSpeed),
+			"", "", "", "", "", "",
+		})
+	case WorkerStateList:
+		for _, ws := range m.Workers {
+			rows = append(rows, []string{
+				t, "worker", ws.Host, "", "", "", "", "", "", "", "", "",
+				strconv.Itoa(ws.Load), strconv.Itoa(ws.Capacity),
+				strconv.Itoa(ws.Queued), formatFloat(ws.Speed),
+				strconv.FormatBool(ws.Suspect), strconv.FormatBool(ws.Draining),
+			})
+		}
+	default:
+		return nil
+	}
+
+	if !mw.header {
+		mw.csv.Write(monitorColumns)
+		mw.header = true
+	}
+
+	mw.csv.WriteAll(rows)
+
+	return mw.csv.Error()
+}
+
+func formatSeconds(d time.Duration) string {
+	return formatFloat(d.Seconds())
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// WriteReport writes every update from the server until the context is
+// canceled, connecting if needed
+func (m *Monitor) WriteReport(ctx context.Context, mw *MonitorWriter) error {
+	return m.report(ctx, func(msg interface{}) error {
+		return mw.Write(msg, time.Now())
+	})
+}
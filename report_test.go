@@ -0,0 +1,135 @@
+// Tests for the machine readable monitor output.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Updates like the ones the server sends monitors
+var testUpdates = []interface{}{
+	CompletedJob{
+		Client:      MachineName{Host: "laptop"},
+		Worker:      MachineName{Host: "w1"},
+		File:        "main.c",
+		Compiler:    "gcc",
+		InputSize:   2048,
+		OutputSize:  512,
+		CompileTime: 1500 * time.Millisecond,
+		Timing:      JobTiming{CPU: time.Second},
+	},
+	WorkerStateList{Workers: []WorkerState{
+		{Host: "w1", Capacity: 4, Load: 1, Speed: 1.25},
+		{Host: "w2", Capacity: 2, Suspect: true},
+	}},
+	QueueState{Clients: []ClientQueue{{Client: "laptop", Queued: 3}}},
+	WorkerEvent{Type: WorkerRemoved, Worker: MachineName{Host: "w3"}},
+	JobEvent{Type: JobCompileStart, Worker: MachineName{Host: "w1"},
+		File: "util.c"},
+}
+
+func TestMonitorWriterJSON(t *testing.T) {
+	var buf bytes.Buffer
+	mw, err := NewMonitorWriter(&buf, "json")
+
+	if err != nil {
+		t.Fatal("Making writer: ", err)
+	}
+
+	for _, u := range testUpdates {
+		if err := mw.Write(u, time.Now()); err != nil {
+			t.Fatal("Write error: ", err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+
+	if len(lines) != len(testUpdates) {
+		t.Fatalf("Got %d lines, wanted %d", len(lines), len(testUpdates))
+	}
+
+	var records []monitorRecord
+
+	for _, line := range lines {
+		var r monitorRecord
+
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("Bad JSON %q: %s", line, err)
+		}
+
+		records = append(records, r)
+	}
+
+	if r := records[0]; r.Type != "job" || r.Job == nil || r.Job.File != "main.c" ||
+		r.Job.Timing.CPU != time.Second {
+		t.Errorf("Bad job record: %+v", r)
+	}
+
+	if r := records[1]; r.Type != "workers" || len(r.Workers) != 2 ||
+		r.Workers[0].Speed != 1.25 || !r.Workers[1].Suspect {
+		t.Errorf("Bad workers record: %+v", r)
+	}
+
+	if r := records[2]; r.Type != "queue" || len(r.Clients) != 1 ||
+		r.Clients[0].Queued != 3 {
+		t.Errorf("Bad queue record: %+v", r)
+	}
+
+	if r := records[3]; r.Type != "worker" || r.Event == nil ||
+		r.Event.Type != "removed" || r.Event.Worker.Host != "w3" {
+		t.Errorf("Bad worker record: %+v", r)
+	}
+
+	if r := records[4]; r.Type != "step" || r.JobEvent == nil ||
+		r.JobEvent.Type != "compile-start" || r.JobEvent.File != "util.c" {
+		t.Errorf("Bad step record: %+v", r)
+	}
+}
+
+func TestMonitorWriterCSV(t *testing.T) {
+	var buf bytes.Buffer
+	mw, err := NewMonitorWriter(&buf, "csv")
+
+	if err != nil {
+		t.Fatal("Making writer: ", err)
+	}
+
+	// Write them all twice to make sure the header only comes once
+	now := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		for _, u := range testUpdates {
+			if err := mw.Write(u, now); err != nil {
+				t.Fatal("Write error: ", err)
+			}
+		}
+	}
+
+	ts := "2016-01-02T03:04:05Z"
+	row := strings.Join([]string{
+		ts + ",job,w1,laptop,main.c,gcc,0,2048,512,1.5,1,0,,,,,,",
+		ts + ",worker,w1,,,,,,,,,,1,4,0,1.25,false,false",
+		ts + ",worker,w2,,,,,,,,,,0,2,0,0,true,false",
+	}, "\n")
+
+	expected := strings.Join(monitorColumns, ",") + "\n" + row + "\n" +
+		row + "\n"
+
+	if buf.String() != expected {
+		t.Errorf("Got:\n%s\nWanted:\n%s", buf.String(), expected)
+	}
+}
+
+func TestMonitorWriterFormat(t *testing.T) {
+	_, err := NewMonitorWriter(&bytes.Buffer{}, "xml")
+
+	if err == nil {
+		t.Error("No error for an unknown format")
+	}
+}
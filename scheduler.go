@@ -7,28 +7,51 @@
 package cbd
 
 import (
+	"container/heap"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // The information needed
 type SchedulerRequest struct {
 	r      chan WorkerResponse // Where the result is sent
+	client string              // Host that made the request
+	user   string              // User that made the request
+	owner  string              // Who the request counts against for sharing
 	addrs  []net.IPNet         // Addresses of the client
+	class  JobClass            // Kind of build the request is for
+	prio   int                 // Higher priorities are served first
 	guid   GUID                // Unique ID for this request, used to cancel
 	active bool                // False when the request has been canceled
+	seq    uint64              // Arrival order, set by the scheduler
+	key    float64             // Policy order, lower keys are served first
+	queued bool                // True while waiting in the scheduler's queue
+	heaps  []*requestHeap      // Subnet heaps the request has been put in
 }
 
-func NewSchedulerRequest(addrs []net.IPNet) *SchedulerRequest {
+func NewSchedulerRequest(wr WorkerRequest) *SchedulerRequest {
 	req := new(SchedulerRequest)
 	req.r = make(chan WorkerResponse, 1)
-	req.addrs = addrs
-	req.guid = NewGUID()
+	req.client = wr.Client
+	req.user = wr.User
+	req.addrs = wr.Addrs
+	req.class = wr.Class
+	req.prio = wr.Priority
+	req.guid = wr.JobID
 	req.active = true
 
+	// A retried job keeps its ID, so it reads as one job to monitors
+	if req.guid == (GUID{}) {
+		req.guid = NewGUID()
+	}
+
 	return req
 }
 
@@ -40,9 +63,16 @@ type Scheduler interface {
 	// Remove the request from our list of requests
 	cancel(g GUID) error
 
+	// Place of a queued request in line (1 is next) and a guess at how long
+	// until it gets a worker
+	queuePosition(g GUID) (int, time.Duration, error)
+
 	// Mark job completed
 	completed(cj CompletedJob) error
 
+	// Stop counting a request's job as running, it won't complete
+	release(req *SchedulerRequest) error
+
 	// Add resource
 	addWorker(state WorkerState) error
 
@@ -52,33 +82,211 @@ type Scheduler interface {
 	// Remove resource
 	removeWorker(id MachineID) error
 
+	// Marks workers not updated within suspectAge as suspect, and removes
+	// those not updated within maxAge, returning the newly suspect and the
+	// removed workers
+	pruneWorkers(now time.Time, suspectAge, maxAge time.Duration) (suspect, removed []WorkerState)
+
 	// Get current work state
 	getWorkerState() WorkerStateList
 
+	// Get the outstanding work of each client
+	getQueueState() QueueState
+
+	// What the scheduler has learned that is worth keeping across restarts
+	saveState() SchedulerState
+
+	// Picks up where a previous scheduler left off
+	loadState(state SchedulerState)
+
 	/// TODO: figure out a way to remove me, this is just a test function
 	findWorker(addrs []net.IPNet) (WorkerResponse, error)
 
 	// TODO: something to dump current queue information
 }
 
-type FifoScheduler struct {
-	workers map[MachineID]WorkerState // All the currently active workers
-	smutex  *sync.Mutex               // Protects access to all state
+// How long a job handed a worker counts as running when we never hear it
+// completed, which happens when a client dies or can't reach us
+var assignmentTimeout = time.Duration(10) * time.Minute
+
+// Returned when a request's class is using all the cluster it's allowed
+var errClassFull = errors.New("Job class is at its cap")
 
-	// TODO: consider container/list which would have less copying
-	requests []*SchedulerRequest // Waiting requests
+// Names of all the scheduling policies NewScheduler understands
+var SchedulerNames = []string{"fifo", "least-loaded", "speed", "locality",
+	"fair-share"}
+
+// SchedulerOptions tunes the how requests are shared between clients
+type SchedulerOptions struct {
+	ShareByUser bool                 // Share by user instead of client host
+	Weights     map[string]float64   // Relative share of each host or user
+	ClassCaps   map[JobClass]float64 // Max fraction of the cluster per class
 }
 
-func newFifoScheduler() *FifoScheduler {
-	s := new(FifoScheduler)
-	s.workers = make(map[MachineID]WorkerState)
+// NewScheduler returns the scheduler with given policy name
+func NewScheduler(name string, opts SchedulerOptions) (Scheduler, error) {
+	var p schedPolicy
+
+	switch name {
+	case "fifo":
+		p = fifoPolicy{}
+	case "least-loaded":
+		p = leastLoadedPolicy{}
+	case "speed":
+		p = speedPolicy{}
+	case "locality":
+		p = localityPolicy{}
+	case "fair-share":
+		p = newFairSharePolicy(opts.Weights)
+	default:
+		return nil, fmt.Errorf("Unknown scheduler: %s (options: %s)", name,
+			strings.Join(SchedulerNames, ", "))
+	}
+
+	s := newPolicyScheduler(p)
+	s.shareByUser = opts.ShareByUser
+	s.classCaps = opts.ClassCaps
+
+	return s, nil
+}
+
+// ParseShareWeights parses a list of the form "alice=2,bob=0.5" into a map of
+// fair-share weights
+func ParseShareWeights(str string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+
+	if len(str) == 0 {
+		return weights, nil
+	}
+
+	for _, part := range strings.Split(str, ",") {
+		kv := strings.SplitN(part, "=", 2)
+
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			return nil, fmt.Errorf("Weight not of the form name=weight: %s", part)
+		}
+
+		w, err := strconv.ParseFloat(kv[1], 64)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if w <= 0 {
+			return nil, fmt.Errorf("Weight for %s must be positive", kv[0])
+		}
+
+		weights[kv[0]] = w
+	}
+
+	return weights, nil
+}
+
+// ParseClassCaps parses a list of the form "ci=0.5" into the fraction of
+// the cluster each class may use
+func ParseClassCaps(str string) (map[JobClass]float64, error) {
+	caps := make(map[JobClass]float64)
+
+	if len(str) == 0 {
+		return caps, nil
+	}
+
+	for _, part := range strings.Split(str, ",") {
+		kv := strings.SplitN(part, "=", 2)
+
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Cap not of the form class=fraction: %s", part)
+		}
+
+		class, err := ParseJobClass(kv[0])
+
+		if err != nil {
+			return nil, err
+		}
+
+		c, err := strconv.ParseFloat(kv[1], 64)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if c <= 0 || c > 1 {
+			return nil, fmt.Errorf("Cap for %s must be in (0, 1]", kv[0])
+		}
+
+		caps[class] = c
+	}
+
+	return caps, nil
+}
+
+// SchedulerState is what a scheduler has learned about the cluster
+type SchedulerState struct {
+	Speeds    map[MachineID]float64        // Speed estimate of each worker
+	AvgJob    time.Duration                // Smoothed time jobs take to complete
+	Rates     map[string]float64           // Smoothed compile speed of each compiler
+	Compilers map[MachineID][]CompilerInfo // Compilers each worker has
+}
+
+// A request which has been given a worker, but not yet completed
+type assignment struct {
+	owner  string    // Who the job counts against
+	class  JobClass  // Class of the job
+	at     time.Time // When the worker was handed out
+	seq    uint64    // Arrival order of the request it was handed to
+	worker MachineID // Worker the job was handed
+}
+
+// PolicyScheduler keeps a queue of requests and hands out workers as they
+// become free.  Which worker each request gets, and the order the queue is
+// served in, is decided by its schedPolicy.
+//
+// Workers are indexed by subnet, each with a heap of its free workers and
+// heaps of the requests that can reach it, so an update only has to look at
+// the best worker and request of each subnet involved.
+type PolicyScheduler struct {
+	policy      schedPolicy                  // Decides who gets what
+	workers     map[MachineID]*workerEntry   // All the currently active workers
+	subnets     map[string]*subnet           // Worker networks, by address
+	capacity    int                          // Total capacity of all workers
+	smutex      *sync.Mutex                  // Protects access to all state
+	seq         uint64                       // Arrival count of requests
+	shareByUser bool                         // Requests are owned by users
+	assigned    map[GUID]assignment          // Jobs running on workers
+	classCaps   map[JobClass]float64         // Max fraction of cluster per class
+	running     map[JobClass]int             // Number of assigned jobs per class
+	avgJob      time.Duration                // Smoothed time jobs take to complete
+	speeds      map[MachineID]float64        // Speeds of workers not connected
+	rates       map[string]float64           // Compile speed by compiler
+	compilers   map[MachineID][]CompilerInfo // Compilers of workers not connected
+
+	requests map[GUID]*SchedulerRequest // Waiting requests by ID
+	queue    []*SchedulerRequest        // Waiting requests, in policy order
+}
+
+// The default scheduler, first come first served with the fastest worker
+func newFifoScheduler() *PolicyScheduler {
+	return newPolicyScheduler(fifoPolicy{})
+}
+
+func newPolicyScheduler(p schedPolicy) *PolicyScheduler {
+	s := new(PolicyScheduler)
+	s.policy = p
+	s.workers = make(map[MachineID]*workerEntry)
+	s.subnets = make(map[string]*subnet)
 	s.smutex = new(sync.Mutex)
-	s.requests = make([]*SchedulerRequest, 0, 100)
+	s.assigned = make(map[GUID]assignment)
+	s.running = make(map[JobClass]int)
+	s.speeds = make(map[MachineID]float64)
+	s.rates = make(map[string]float64)
+	s.compilers = make(map[MachineID][]CompilerInfo)
+	s.requests = make(map[GUID]*SchedulerRequest)
+	s.queue = make([]*SchedulerRequest, 0, 100)
 
 	return s
 }
 
-func (s *FifoScheduler) schedule(req *SchedulerRequest) error {
+func (s *PolicyScheduler) schedule(req *SchedulerRequest) error {
 	// Determine if we have something available right now
 	s.smutex.Lock()
 	defer s.smutex.Unlock()
@@ -89,96 +297,177 @@ func (s *FifoScheduler) schedule(req *SchedulerRequest) error {
 		return nil
 	}
 
-	/// TODO: handle no source address check explicitly at this level
-	wr, err := findFreeWorker(&s.workers, req.addrs)
+	// Give the request its place in line
+	req.owner = req.client
 
-	if err == nil {
-		// Write it to channel
-		req.r <- wr
+	if s.shareByUser {
+		req.owner = req.user
+	}
 
-	} else {
-		// We did not find a worker so queue it
-		s.requests = append(s.requests, req)
+	s.seq++
+	req.seq = s.seq
+	s.policy.stamp(req)
+
+	// A client asking again for a job is done with its last worker
+	s.unassign(req.guid)
 
-		// Then tell the waiting user they are queue
-		// TODO: should we do this, or just use the absence?
-		req.r <- WorkerResponse{Type: Queued}
+	/// TODO: handle no source address check explicitly at this level
+	if !s.classFull(req.class) {
+		if e, addr, ok := s.findFree(req.addrs); ok {
+			s.dispatch(req, e, addr)
+			return nil
+		}
 	}
 
+	// We did not find a worker so queue it
+	s.enqueue(req)
+
+	// Then tell the waiting user they are queue
+	// TODO: should we do this, or just use the absence?
+	req.r <- WorkerResponse{Type: Queued}
+
 	return nil
 }
 
-func (s *FifoScheduler) cancel(g GUID) error {
+func (s *PolicyScheduler) cancel(g GUID) error {
 	s.smutex.Lock()
 	defer s.smutex.Unlock()
 
 	// Attempt to find request by ID
-	found := -1
+	req, ok := s.requests[g]
 
-	for idx, req := range s.requests {
-		if g == req.guid {
-			// Found it!
-			found = idx
-			break
-		}
+	if !ok {
+		return fmt.Errorf("Could not find request with id: %s", g.String())
+	}
+
+	// Mark it inactive then remove it
+	req.active = false
+	s.dequeue(req)
+
+	return nil
+}
+
+func (s *PolicyScheduler) queuePosition(g GUID) (int, time.Duration, error) {
+	s.smutex.Lock()
+	defer s.smutex.Unlock()
+
+	req, ok := s.requests[g]
+
+	if !ok {
+		return 0, 0, fmt.Errorf("Request not queued: %s", g.String())
 	}
 
-	// Remove it from our array of requests if it was found
-	var err error
+	pos := s.queueIndex(req) + 1
 
-	if found >= 0 {
-		// Mark it inactive then remove it
-		s.requests[found].active = false
+	// Everyone ahead of us, and us, need a slot to finish up
+	capacity := s.capacity
+
+	if capacity < 1 {
+		capacity = 1
+	}
 
-		s.requests = append(s.requests[:found], s.requests[found+1:]...)
+	wait := s.avgJob * time.Duration(pos) / time.Duration(capacity)
+
+	return pos, wait, nil
+}
+
+func (s *PolicyScheduler) completed(cj CompletedJob) error {
+	s.smutex.Lock()
+	defer s.smutex.Unlock()
+
+	s.pruneAssigned(time.Now())
+	s.unassign(cj.ID)
+
+	// Blend in how long the job held a worker slot the same way as worker
+	// speed
+	if s.avgJob == 0 {
+		s.avgJob = cj.workTime()
 	} else {
-		err = fmt.Errorf("Could not find request with id: ", g)
+		s.avgJob = (s.avgJob*9 + cj.workTime()) / 10
+	}
+
+	e, ok := s.workers[cj.Worker.ID]
+
+	if !ok {
+		return fmt.Errorf("Could not find worker: %s", cj.Worker.ToString())
 	}
 
-	return err
+	s.updateWorkerSpeed(e, cj)
+
+	// Our opinion of the worker changed so fix it's place in line
+	s.refresh(e)
+
+	return nil
 }
 
-func (s *FifoScheduler) completed(cj CompletedJob) error {
+func (s *PolicyScheduler) release(req *SchedulerRequest) error {
 	s.smutex.Lock()
 	defer s.smutex.Unlock()
 
-	return updateWorkerStats(&s.workers, cj)
+	// A retry of the job may have been assigned since, leave that alone
+	if a, ok := s.assigned[req.guid]; ok && a.seq == req.seq {
+		s.unassign(req.guid)
+	}
+
+	return nil
 }
 
-func (s *FifoScheduler) addWorker(state WorkerState) error {
+func (s *PolicyScheduler) addWorker(state WorkerState) error {
 	s.smutex.Lock()
 	defer s.smutex.Unlock()
 
-	s.workers[state.ID] = state
+	s.setWorker(state, false)
+
+	return nil
+}
+
+func (s *PolicyScheduler) updateWorker(update WorkerState) error {
+	s.smutex.Lock()
+	defer s.smutex.Unlock()
 
-	// Try and schedule queued requests
-	s.scheduleRequests()
+	s.setWorker(update, true)
 
 	return nil
 }
 
-func (s *FifoScheduler) updateWorker(update WorkerState) error {
+func (s *PolicyScheduler) removeWorker(id MachineID) error {
 	s.smutex.Lock()
 	defer s.smutex.Unlock()
 
-	mergeWorkerState(&s.workers, update)
+	e, ok := s.workers[id]
+
+	if !ok {
+		return fmt.Errorf("Could not find worker: %s", id)
+	}
 
-	// Try and schedule queued requests
-	s.scheduleRequests()
+	s.dropWorker(e)
 
 	return nil
 }
 
-func (s *FifoScheduler) removeWorker(id MachineID) error {
+func (s *PolicyScheduler) pruneWorkers(now time.Time, suspectAge, maxAge time.Duration) (suspect, removed []WorkerState) {
 	s.smutex.Lock()
 	defer s.smutex.Unlock()
 
-	delete(s.workers, id)
+	for _, e := range s.workers {
+		age := now.Sub(e.state.Updated)
+
+		switch {
+		case age > maxAge:
+			s.dropWorker(e)
+			removed = append(removed, e.state)
+		case age > suspectAge && !e.state.Suspect:
+			// No more jobs go to the worker until we hear from it again
+			e.state.Suspect = true
+			s.refresh(e)
+			suspect = append(suspect, e.state)
+		}
+	}
 
-	return nil
+	return suspect, removed
 }
 
-func (s *FifoScheduler) getWorkerState() WorkerStateList {
+func (s *PolicyScheduler) getWorkerState() WorkerStateList {
 	s.smutex.Lock()
 	defer s.smutex.Unlock()
 
@@ -186,142 +475,604 @@ func (s *FifoScheduler) getWorkerState() WorkerStateList {
 	// TODO: maintain single a list that is just updated instead
 	var l WorkerStateList
 
-	for _, state := range s.workers {
-		l.Workers = append(l.Workers, state)
+	for _, e := range s.workers {
+		l.Workers = append(l.Workers, e.state)
 	}
 
 	return l
 }
 
-/// TODO: remove me just an internal test function
-func (s *FifoScheduler) findWorker(addrs []net.IPNet) (WorkerResponse, error) {
+func (s *PolicyScheduler) getQueueState() QueueState {
 	s.smutex.Lock()
 	defer s.smutex.Unlock()
 
-	return findFreeWorker(&s.workers, addrs)
-}
+	s.pruneAssigned(time.Now())
 
-// Attempts to schedule a request if possible, assumes things are locked
-func (s *FifoScheduler) scheduleRequests() {
-	// Keep schedule requests until we fail to find a free worker
-	for len(s.requests) > 0 {
-		// Loop over all requests attempt to find a free worker that
-		// matches.
-		found := -1
+	// Tally up the queued and running jobs of each owner.  Assignments are
+	// released as soon as a client hangs up, its job fails or its worker
+	// goes away, so only jobs still being built count as running.
+	counts := make(map[string]*ClientQueue)
 
-		for idx, req := range s.requests {
-			wr, err := findFreeWorker(&s.workers, req.addrs)
+	count := func(owner string) *ClientQueue {
+		c, ok := counts[owner]
 
-			if err == nil {
-				// Write it to channel
-				req.r <- wr
+		if !ok {
+			c = &ClientQueue{Client: owner}
+			counts[owner] = c
+		}
 
-				// Found it!
-				found = idx
+		return c
+	}
 
-				break
-			}
-		}
+	for _, req := range s.queue {
+		count(req.owner).Queued++
+	}
 
-		// Handle results
-		if found >= 0 {
-			// We fulfilled a request so remove it from our list
-			s.requests = append(s.requests[:found], s.requests[found+1:]...)
-		} else {
-			// We try all requests but couldn't schedule anyone so
-			// break out of the loop
-			break
-		}
+	for _, a := range s.assigned {
+		count(a.owner).Running++
+	}
+
+	// Return them in a stable order
+	var q QueueState
+
+	for _, c := range counts {
+		q.Clients = append(q.Clients, *c)
 	}
+
+	sort.Sort(byClient(q.Clients))
+
+	return q
 }
 
-// Integrate new worker state into existing state map
-func mergeWorkerState(workers *map[MachineID]WorkerState, update WorkerState) {
-	// Keep the current speed if we already have an entry for this host
-	if val, ok := (*workers)[update.ID]; ok {
-		speed := val.Speed
-		update.Speed = speed
+func (s *PolicyScheduler) saveState() SchedulerState {
+	s.smutex.Lock()
+	defer s.smutex.Unlock()
+
+	state := SchedulerState{
+		Speeds:    make(map[MachineID]float64),
+		AvgJob:    s.avgJob,
+		Rates:     make(map[string]float64),
+		Compilers: make(map[MachineID][]CompilerInfo),
+	}
+
+	for id, compilers := range s.compilers {
+		state.Compilers[id] = compilers
+	}
+
+	for compiler, rate := range s.rates {
+		state.Rates[compiler] = rate
 	}
 
-	(*workers)[update.ID] = update
+	for id, speed := range s.speeds {
+		state.Speeds[id] = speed
+	}
+
+	for id, e := range s.workers {
+		if e.state.Speed != 0 {
+			state.Speeds[id] = e.state.Speed
+		}
+
+		if len(e.state.Compilers) > 0 {
+			state.Compilers[id] = e.state.Compilers
+		}
+	}
+
+	return state
 }
 
-// Updates the workers current speed estimate based on the job results, this
-// uses New = Old * 0.9 + Update * 0.1 to try and smooth out spikes caused by
-// variability.
-func updateWorkerStats(workers *map[MachineID]WorkerState, cj CompletedJob) error {
-	// Blend in the speed slowly if we already have a speed
-	state, ok := (*workers)[cj.Worker.ID]
+func (s *PolicyScheduler) loadState(state SchedulerState) {
+	s.smutex.Lock()
+	defer s.smutex.Unlock()
 
-	if !ok {
-		return fmt.Errorf("Could not find worker: %s", cj.Worker)
+	if state.AvgJob != 0 {
+		s.avgJob = state.AvgJob
 	}
 
-	if state.Speed == 0 {
-		state.Speed = cj.CompileSpeed
-	} else {
-		state.Speed = state.Speed*0.9 + cj.CompileSpeed*0.1
+	for compiler, rate := range state.Rates {
+		s.rates[compiler] = rate
 	}
 
-	(*workers)[cj.Worker.ID] = state
+	for id, speed := range state.Speeds {
+		// Workers already connected know better
+		if e, ok := s.workers[id]; ok {
+			if e.state.Speed == 0 {
+				e.state.Speed = speed
+				s.refresh(e)
+			}
+			continue
+		}
 
-	return nil
+		s.speeds[id] = speed
+	}
+
+	for id, compilers := range state.Compilers {
+		if e, ok := s.workers[id]; ok {
+			if len(e.state.Compilers) == 0 {
+				e.state.Compilers = compilers
+			}
+			continue
+		}
+
+		s.compilers[id] = compilers
+	}
 }
 
-// findWorker finds a free worker which can connect to any of the given
-// addresses and return the corresponding address and port
-func findFreeWorker(workers *map[MachineID]WorkerState, addrs []net.IPNet) (WorkerResponse, error) {
+/// TODO: remove me just an internal test function
+func (s *PolicyScheduler) findWorker(addrs []net.IPNet) (WorkerResponse, error) {
+	s.smutex.Lock()
+	defer s.smutex.Unlock()
+
 	// Error out if we aren't given any addresses to match against
 	empty := WorkerResponse{
 		Type: NoWorkers,
-		ID:   MachineID(""),
-		Host: "",
-		Port: 0,
 	}
 
 	if len(addrs) == 0 {
 		return empty, errors.New("No source addresses given")
 	}
 
+	e, addr, ok := s.findFree(addrs)
+
+	if !ok {
+		return empty, errors.New("No available & reachable host")
+	}
+
+	return workerResponse(e, addr), nil
+}
+
+// Adds or updates a worker, keeping the speed we have worked out for it if
+// asked, then hands out any requests it can now take.  Assumes things are
+// locked.
+func (s *PolicyScheduler) setWorker(state WorkerState, keepSpeed bool) {
+	e, ok := s.workers[state.ID]
+
+	if ok {
+		if keepSpeed {
+			state.Speed = e.state.Speed
+		}
+
+		// Workers which don't report compilers keep what we knew
+		if len(state.Compilers) == 0 {
+			state.Compilers = e.state.Compilers
+		}
+
+		// Take out the old capacity before the state is replaced
+		s.capacity -= e.state.Capacity
+
+		// Move the worker if it's networks have changed
+		if !sameAddrs(e.state.Addrs, state.Addrs) {
+			s.detach(e)
+			e.state = state
+			s.attach(e)
+		}
+
+		e.state = state
+	} else {
+		// Pick up the speed we learned last time we saw the worker, or
+		// make a guess from its benchmark
+		if speed, ok := s.speeds[state.ID]; ok && state.Speed == 0 {
+			state.Speed = speed
+		} else if state.Speed == 0 {
+			state.Speed = s.initialSpeed(state.Benchmark)
+		}
+
+		delete(s.speeds, state.ID)
+
+		if len(state.Compilers) == 0 {
+			state.Compilers = s.compilers[state.ID]
+		}
+
+		delete(s.compilers, state.ID)
+
+		e = newWorkerEntry(state)
+		s.workers[state.ID] = e
+		s.attach(e)
+	}
+
+	s.capacity += state.Capacity
+
+	s.refresh(e)
+	s.scheduleFor(e)
+}
+
+// Takes the worker out of the scheduler, assumes things are locked
+func (s *PolicyScheduler) dropWorker(e *workerEntry) {
+	// Remember the speed for when it comes back
+	if e.state.Speed != 0 {
+		s.speeds[e.state.ID] = e.state.Speed
+	}
+
+	if len(e.state.Compilers) > 0 {
+		s.compilers[e.state.ID] = e.state.Compilers
+	}
+
+	s.detach(e)
+	s.capacity -= e.state.Capacity
+	delete(s.workers, e.state.ID)
+
+	// Jobs on a worker which is gone won't complete
+	for id, a := range s.assigned {
+		if a.worker == e.state.ID {
+			s.unassign(id)
+		}
+	}
+}
+
+// Puts the worker into the subnet index for each of it's addresses, creating
+// the subnets as needed.  Assumes things are locked.
+func (s *PolicyScheduler) attach(e *workerEntry) {
+	for _, addr := range e.state.Addrs {
+		network := networkOf(addr)
+		key := network.String()
+
+		sub, ok := s.subnets[key]
+
+		if !ok {
+			sub = newSubnet(network, s.policy)
+			s.subnets[key] = sub
+
+			// Let the requests already waiting know about the new network
+			for _, req := range s.queue {
+				if reachesSubnet(req.addrs, sub) {
+					sub.push(req)
+				}
+			}
+		}
+
+		// Only count each network once per worker
+		if _, ok := e.addrs[sub]; ok {
+			continue
+		}
+
+		e.addrs[sub] = addr
+		sub.workers++
+	}
+}
+
+// Pulls the worker out of the subnet index, dropping subnets that no longer
+// have any workers.  Assumes things are locked.
+func (s *PolicyScheduler) detach(e *workerEntry) {
+	for sub := range e.addrs {
+		if idx, ok := e.pos[sub]; ok {
+			heap.Remove(sub.free, idx)
+		}
+
+		sub.workers--
+
+		if sub.workers == 0 {
+			delete(s.subnets, sub.network.String())
+		}
+	}
+
+	e.addrs = make(map[*subnet]net.IPNet)
+}
+
+// Puts the worker in, out, or in the right place of, the free worker heaps
+// after it's state has changed.  Assumes things are locked.
+func (s *PolicyScheduler) refresh(e *workerEntry) {
+	free := e.hasSpace()
+
+	for sub := range e.addrs {
+		idx, in := e.pos[sub]
+
+		switch {
+		case free && in:
+			heap.Fix(sub.free, idx)
+		case free && !in:
+			heap.Push(sub.free, e)
+		case !free && in:
+			heap.Remove(sub.free, idx)
+		}
+	}
+}
+
+// Finds the best free worker which can connect to any of the given
+// addresses, returning the worker's address the client should use.
+// Assumes things are locked.
+func (s *PolicyScheduler) findFree(addrs []net.IPNet) (*workerEntry, net.IPNet, bool) {
+	var best *workerEntry
+	var bestAddr net.IPNet
+
 	// Sort the worker IPs so will match local networks before global
 	sort.Sort(ByPrivateIPAddr(addrs))
 
-	// Found workers
-	var worker WorkerState
-	var addr net.IPNet
+	for _, addr := range addrs {
+		for _, sub := range s.subnets {
+			if !sub.reachable(addr) {
+				continue
+			}
+
+			e := sub.free.top()
+
+			if e != nil && (best == nil || s.policy.better(&e.state, &best.state)) {
+				best = e
+				bestAddr = e.addrs[sub]
+			}
+		}
+
+		// Policies which stick to the nearest network stop at the first one
+		// of our networks with a free worker
+		if best != nil && s.policy.nearestFirst() {
+			break
+		}
+	}
+
+	return best, bestAddr, best != nil
+}
+
+// Hands out queued requests to the worker, or whatever worker the request
+// prefers, until it's out of space or there is nothing left it can take.
+// Assumes things are locked.
+func (s *PolicyScheduler) scheduleFor(e *workerEntry) {
+	for e.hasSpace() {
+		req := s.nextRequest(e)
+
+		if req == nil {
+			break
+		}
+
+		w, addr, ok := s.findFree(req.addrs)
+
+		if !ok {
+			break
+		}
+
+		s.dequeue(req)
+		s.dispatch(req, w, addr)
+	}
+}
 
-	worker.Speed = -1
-	found := false
+// Hands out queued requests to every worker with space, used when a class
+// which was at it's cap drops below it.  Assumes things are locked.
+func (s *PolicyScheduler) scheduleAll() {
+	for _, e := range s.workers {
+		s.scheduleFor(e)
+	}
+}
 
-	// For now just a simple linear search returning the first free
-	for _, wstate := range *workers {
-		space := wstate.Capacity - wstate.Load
+// Returns the next request the worker could take, skipping classes that are
+// at their cap.  Assumes things are locked.
+func (s *PolicyScheduler) nextRequest(e *workerEntry) *SchedulerRequest {
+	var next *SchedulerRequest
 
-		if space > 0 {
-			// Get a worker IP address that can connect to the client
-			maddr, err := getMatchingIP(addrs, wstate.Addrs)
+	for sub := range e.addrs {
+		for class, h := range sub.requests {
+			if s.classFull(class) {
+				continue
+			}
 
-			// Use this worker if it's faster than the last
-			if err == nil && worker.Speed < wstate.Speed {
-				worker = wstate
-				addr = maddr
-				found = true
+			req := h.top()
+
+			if req != nil && (next == nil || requestBefore(req, next)) {
+				next = req
 			}
 		}
 	}
 
-	// Return the fastest found worker
-	if found {
-		res := WorkerResponse{
-			Type:    Valid,
-			ID:      worker.ID,
-			Host:    worker.Host,
-			Address: addr,
-			Port:    worker.Port,
+	return next
+}
+
+// Puts the request into the queue keeping it sorted by policy order, and
+// into the request heaps of every subnet it can reach.  Assumes things are
+// locked.
+func (s *PolicyScheduler) enqueue(req *SchedulerRequest) {
+	idx := sort.Search(len(s.queue), func(i int) bool {
+		return requestBefore(req, s.queue[i])
+	})
+
+	s.queue = append(s.queue, nil)
+	copy(s.queue[idx+1:], s.queue[idx:])
+	s.queue[idx] = req
+
+	s.requests[req.guid] = req
+	req.queued = true
+
+	for _, sub := range s.subnets {
+		if reachesSubnet(req.addrs, sub) {
+			sub.push(req)
+		}
+	}
+}
+
+// Takes the request out of the queue, the subnet heaps drop it lazily.
+// Assumes things are locked.
+func (s *PolicyScheduler) dequeue(req *SchedulerRequest) {
+	idx := s.queueIndex(req)
+
+	s.queue = append(s.queue[:idx], s.queue[idx+1:]...)
+	delete(s.requests, req.guid)
+	req.queued = false
+
+	for _, h := range req.heaps {
+		h.removed()
+	}
+
+	req.heaps = nil
+}
+
+// Finds where in the queue the request is, assumes things are locked
+func (s *PolicyScheduler) queueIndex(req *SchedulerRequest) int {
+	return sort.Search(len(s.queue), func(i int) bool {
+		return !requestBefore(s.queue[i], req)
+	})
+}
+
+// Sends the worker to the request, and counts the job against the worker
+// until it's next update, assumes things are locked
+func (s *PolicyScheduler) dispatch(req *SchedulerRequest, e *workerEntry, addr net.IPNet) {
+	e.state.Load++
+	s.refresh(e)
+
+	s.policy.dispatched(req)
+
+	// Track the job until it's completed
+	s.assigned[req.guid] = assignment{
+		owner:  req.owner,
+		class:  req.class,
+		at:     time.Now(),
+		seq:    req.seq,
+		worker: e.state.ID,
+	}
+	s.running[req.class]++
+
+	// Write it to channel
+	wr := workerResponse(e, addr)
+	wr.JobID = req.guid
+
+	req.r <- wr
+}
+
+// Drops any assignments we have given up hearing back about, assumes things
+// are locked
+func (s *PolicyScheduler) pruneAssigned(now time.Time) {
+	for id, a := range s.assigned {
+		if now.Sub(a.at) > assignmentTimeout {
+			s.unassign(id)
+		}
+	}
+}
+
+// Stops tracking an assigned job, handing out workers if that brings it's
+// class back under it's cap.  Assumes things are locked.
+func (s *PolicyScheduler) unassign(id GUID) {
+	a, ok := s.assigned[id]
+
+	if !ok {
+		return
+	}
+
+	wasFull := s.classFull(a.class)
+
+	s.running[a.class]--
+	delete(s.assigned, id)
+
+	if wasFull && !s.classFull(a.class) {
+		s.scheduleAll()
+	}
+}
+
+// Returns true if the class is already using all of its share of the
+// cluster, assumes things are locked
+func (s *PolicyScheduler) classFull(class JobClass) bool {
+	c, ok := s.classCaps[class]
+
+	if !ok {
+		return false
+	}
+
+	// Always let at least one job through
+	limit := int(c * float64(s.capacity))
+
+	if limit < 1 {
+		limit = 1
+	}
+
+	return s.running[class] >= limit
+}
+
+// Sorts client queues by name
+type byClient []ClientQueue
+
+func (a byClient) Len() int           { return len(a) }
+func (a byClient) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byClient) Less(i, j int) bool { return a[i].Client < a[j].Client }
+
+// Returns true if request a should be served before request b
+func requestBefore(a, b *SchedulerRequest) bool {
+	if a.prio != b.prio {
+		return a.prio > b.prio
+	}
+
+	if a.key != b.key {
+		return a.key < b.key
+	}
+
+	return a.seq < b.seq
+}
+
+// Returns true if any of the addresses can reach the subnet
+func reachesSubnet(addrs []net.IPNet, sub *subnet) bool {
+	for _, addr := range addrs {
+		if sub.reachable(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if both lists hold the same addresses in the same order
+func sameAddrs(a, b []net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Builds the response sending a client to the given worker address
+func workerResponse(e *workerEntry, addr net.IPNet) WorkerResponse {
+	return WorkerResponse{
+		Type:    Valid,
+		ID:      e.state.ID,
+		Host:    e.state.Host,
+		Address: addr,
+		Port:    e.state.Port,
+	}
+}
+
+// Guesses the relative speed of a new worker from its benchmark, using how
+// the benchmarks of the other workers compare to the speeds we've measured
+// for them.  Without anything to go on it is treated as average.  Assumes
+// things are locked.
+func (s *PolicyScheduler) initialSpeed(benchmark float64) float64 {
+	if benchmark <= 0 {
+		return 1
+	}
+
+	scale := 0.0
+	n := 0
+
+	for _, e := range s.workers {
+		if e.state.Benchmark > 0 && e.state.Speed > 0 {
+			scale += e.state.Benchmark / e.state.Speed
+			n++
 		}
+	}
 
-		return res, nil
+	if n == 0 {
+		return 1
 	}
 
-	return empty, errors.New("No available & reachable host")
+	return benchmark / (scale / float64(n))
+}
+
+// Updates the workers current speed estimate based on the job results.  The
+// job's compile speed is compared to the average for its compiler, so a
+// worker isn't judged by which compiler or files it happened to get.  This
+// uses New = Old * 0.9 + Update * 0.1 to try and smooth out spikes caused by
+// variability.  Assumes things are locked.
+func (s *PolicyScheduler) updateWorkerSpeed(e *workerEntry, cj CompletedJob) {
+	if cj.CompileSpeed <= 0 || math.IsInf(cj.CompileSpeed, 0) {
+		return
+	}
+
+	// Track the average speed of the compiler across the cluster
+	rate, ok := s.rates[cj.Compiler]
+
+	if ok {
+		rate = rate*0.9 + cj.CompileSpeed*0.1
+	} else {
+		rate = cj.CompileSpeed
+	}
+
+	s.rates[cj.Compiler] = rate
+
+	e.state.Speed = e.state.Speed*0.9 + cj.CompileSpeed/rate*0.1
 }
@@ -5,8 +5,12 @@
 package cbd
 
 import (
+	"fmt"
+	"math"
 	"net"
+	"reflect"
 	"testing"
+	"time"
 )
 
 type SchedulerTestCase struct {
@@ -24,14 +28,40 @@ type SchedulerTestCase struct {
 	addrs []net.IPNet // Client IPs
 }
 
+// Runs the given test against a fresh scheduler of every policy
+func forEachScheduler(t *testing.T, test func(t *testing.T, name string, sch Scheduler)) {
+	for _, name := range SchedulerNames {
+		sch, err := NewScheduler(name, SchedulerOptions{})
+
+		if err != nil {
+			t.Error("Creating scheduler: ", err)
+			continue
+		}
+
+		t.Run(name, func(t *testing.T) {
+			test(t, name, sch)
+		})
+	}
+}
+
+func TestNewScheduler(t *testing.T) {
+	_, err := NewScheduler("bogus", SchedulerOptions{})
+
+	if err == nil {
+		t.Error("Expected an error for an unknown scheduler")
+	}
+}
+
 func TestScheduler(t *testing.T) {
-	// Create our scheduler
-	var sch Scheduler
-	sch = newFifoScheduler()
+	forEachScheduler(t, testSchedulerQueue)
+}
 
+// Makes sure requests queue up when workers are busy and get sent out as
+// soon as a worker frees up, which every policy must do the same way
+func testSchedulerQueue(t *testing.T, name string, sch Scheduler) {
 	// Start by schedule something when we have no workers
 	addrs := []net.IPNet{{net.IPv4(192, 1, 1, 3), net.IPv4Mask(255, 255, 255, 0)}}
-	sreq := NewSchedulerRequest(addrs)
+	sreq := NewSchedulerRequest(WorkerRequest{Addrs: addrs})
 
 	err := sch.schedule(sreq)
 
@@ -72,7 +102,7 @@ func TestScheduler(t *testing.T) {
 	sch.addWorker(foo)
 
 	// Schedule a new request asking for a worker
-	sreq = NewSchedulerRequest(addrs)
+	sreq = NewSchedulerRequest(WorkerRequest{Addrs: addrs})
 
 	err = sch.schedule(sreq)
 
@@ -108,7 +138,7 @@ func TestScheduler(t *testing.T) {
 
 	sch.updateWorker(foo)
 
-	sreq = NewSchedulerRequest(addrs)
+	sreq = NewSchedulerRequest(WorkerRequest{Addrs: addrs})
 
 	err = sch.schedule(sreq)
 
@@ -145,3 +175,756 @@ func TestScheduler(t *testing.T) {
 		// Valid things are ok
 	}
 }
+
+// A set of workers which each policy has a different favorite from
+func choiceWorkers() []WorkerState {
+	mask := net.IPv4Mask(255, 255, 255, 0)
+
+	return []WorkerState{
+		{ID: "fast", Host: "fast", Capacity: 4, Load: 3, Speed: 10,
+			Addrs: []net.IPNet{{net.IPv4(10, 0, 0, 2), mask}}},
+		{ID: "mid", Host: "mid", Capacity: 4, Load: 1, Speed: 6,
+			Addrs: []net.IPNet{{net.IPv4(10, 0, 0, 3), mask}}},
+		{ID: "idle", Host: "idle", Capacity: 4, Load: 0, Speed: 1,
+			Addrs: []net.IPNet{{net.IPv4(10, 0, 0, 4), mask}}},
+		{ID: "near", Host: "near", Capacity: 8, Load: 6, Speed: 1,
+			Addrs: []net.IPNet{{net.IPv4(192, 168, 1, 2), mask}}},
+	}
+}
+
+func TestSchedulerWorkerChoice(t *testing.T) {
+	expected := map[string]string{
+		"fifo":         "fast",
+		"least-loaded": "idle",
+		"speed":        "mid",
+		"locality":     "near",
+		"fair-share":   "fast",
+	}
+
+	forEachScheduler(t, func(t *testing.T, name string, sch Scheduler) {
+		for _, ws := range choiceWorkers() {
+			sch.addWorker(ws)
+		}
+
+		// Our client is on both networks
+		mask := net.IPv4Mask(255, 255, 255, 0)
+		addrs := []net.IPNet{
+			{net.IPv4(10, 0, 0, 5), mask},
+			{net.IPv4(192, 168, 1, 5), mask},
+		}
+
+		sreq := NewSchedulerRequest(WorkerRequest{Client: "a", Addrs: addrs})
+		sch.schedule(sreq)
+
+		res := <-sreq.r
+
+		if Valid != res.Type {
+			t.Error("Response should of been valid, but got:", res.Type)
+		}
+
+		if expected[name] != res.Host {
+			t.Errorf("Got worker %s wanted %s", res.Host, expected[name])
+		}
+	})
+}
+
+// Makes sure a worker handed out is counted as busy until it tells us
+// otherwise
+func TestSchedulerDispatchLoad(t *testing.T) {
+	forEachScheduler(t, func(t *testing.T, name string, sch Scheduler) {
+		addrs := []net.IPNet{{net.IPv4(192, 1, 1, 3), net.IPv4Mask(255, 255, 255, 0)}}
+
+		sch.addWorker(WorkerState{
+			ID:       "solo",
+			Host:     "solo",
+			Addrs:    []net.IPNet{{net.IPv4(192, 1, 1, 2), net.IPv4Mask(255, 255, 255, 0)}},
+			Capacity: 1,
+		})
+
+		first := NewSchedulerRequest(WorkerRequest{Addrs: addrs})
+		sch.schedule(first)
+
+		second := NewSchedulerRequest(WorkerRequest{Addrs: addrs})
+		sch.schedule(second)
+
+		if res := <-first.r; Valid != res.Type {
+			t.Error("First response should of been valid, but got:", res.Type)
+		}
+
+		if res := <-second.r; Queued != res.Type {
+			t.Error("Second response should of been queued, but got:", res.Type)
+		}
+
+		// A job waiting on the worker still fills its slot
+		worker := WorkerState{
+			ID:       "solo",
+			Host:     "solo",
+			Addrs:    []net.IPNet{{net.IPv4(192, 1, 1, 2), net.IPv4Mask(255, 255, 255, 0)}},
+			Capacity: 1,
+			Queued:   1,
+		}
+		sch.updateWorker(worker)
+
+		select {
+		case res := <-second.r:
+			t.Error("Worker with a queued job was handed another: ", res.Type)
+		default:
+		}
+
+		worker.Queued = 0
+		sch.updateWorker(worker)
+
+		if res := <-second.r; Valid != res.Type {
+			t.Error("Second response should of been valid, but got:", res.Type)
+		}
+	})
+}
+
+// Queues up requests from a greedy client and a polite one, then frees up
+// one worker slot at a time, returning the client order they are served in
+func serveOrder(t *testing.T, sch Scheduler, clients []string) []string {
+	mask := net.IPv4Mask(255, 255, 255, 0)
+	addrs := []net.IPNet{{net.IPv4(192, 1, 1, 3), mask}}
+
+	worker := WorkerState{
+		ID:       "solo",
+		Host:     "solo",
+		Addrs:    []net.IPNet{{net.IPv4(192, 1, 1, 2), mask}},
+		Capacity: 1,
+		Load:     1,
+	}
+
+	sch.addWorker(worker)
+
+	reqs := make([]*SchedulerRequest, len(clients))
+
+	for i, client := range clients {
+		reqs[i] = NewSchedulerRequest(WorkerRequest{Client: client, Addrs: addrs})
+		sch.schedule(reqs[i])
+
+		if res := <-reqs[i].r; Queued != res.Type {
+			t.Error("Response should of been queued, but got:", res.Type)
+		}
+	}
+
+	// Free the worker once for each request and see who gets it
+	var order []string
+
+	for range clients {
+		worker.Load = 0
+		sch.updateWorker(worker)
+
+		for i, req := range reqs {
+			select {
+			case res := <-req.r:
+				if Valid != res.Type {
+					t.Error("Response should of been valid, but got:", res.Type)
+				}
+				order = append(order, clients[i])
+			default:
+			}
+		}
+	}
+
+	return order
+}
+
+func TestSchedulerClientOrder(t *testing.T) {
+	clients := []string{"greedy", "greedy", "greedy", "polite"}
+
+	forEachScheduler(t, func(t *testing.T, name string, sch Scheduler) {
+		expected := clients
+
+		if name == "fair-share" {
+			expected = []string{"greedy", "polite", "greedy", "greedy"}
+		}
+
+		order := serveOrder(t, sch, clients)
+
+		if !StrsEquals(expected, order) {
+			t.Errorf("Got order %v wanted %v", order, expected)
+		}
+	})
+}
+
+func TestFairShareWeights(t *testing.T) {
+	weights, err := ParseShareWeights("greedy=3")
+
+	if err != nil {
+		t.Error("Parsing weights: ", err)
+		return
+	}
+
+	sch, _ := NewScheduler("fair-share", SchedulerOptions{Weights: weights})
+
+	// With three times the share greedy gets served first
+	clients := []string{"greedy", "greedy", "greedy", "polite"}
+	order := serveOrder(t, sch, clients)
+
+	if !StrsEquals(clients, order) {
+		t.Errorf("Got order %v wanted %v", order, clients)
+	}
+}
+
+func TestParseShareWeights(t *testing.T) {
+	weights, err := ParseShareWeights("alice=2,ci=0.5")
+
+	if err != nil {
+		t.Error("Parsing weights: ", err)
+	}
+
+	if weights["alice"] != 2 || weights["ci"] != 0.5 {
+		t.Error("Bad weights: ", weights)
+	}
+
+	for _, bad := range []string{"alice", "alice=x", "alice=0", "=2"} {
+		if _, err := ParseShareWeights(bad); err == nil {
+			t.Errorf("Expected error parsing: %s", bad)
+		}
+	}
+}
+
+func TestSchedulerQueueState(t *testing.T) {
+	mask := net.IPv4Mask(255, 255, 255, 0)
+	addrs := []net.IPNet{{net.IPv4(192, 1, 1, 3), mask}}
+
+	sch, _ := NewScheduler("fair-share", SchedulerOptions{ShareByUser: true})
+
+	sch.addWorker(WorkerState{
+		ID:       "solo",
+		Host:     "solo",
+		Addrs:    []net.IPNet{{net.IPv4(192, 1, 1, 2), mask}},
+		Capacity: 1,
+	})
+
+	// Alice gets the worker and has another job waiting, bob just waits
+	reqs := []*SchedulerRequest{
+		NewSchedulerRequest(WorkerRequest{Client: "a", User: "alice", Addrs: addrs}),
+		NewSchedulerRequest(WorkerRequest{Client: "a", User: "alice", Addrs: addrs}),
+		NewSchedulerRequest(WorkerRequest{Client: "b", User: "bob", Addrs: addrs}),
+	}
+
+	for _, req := range reqs {
+		sch.schedule(req)
+	}
+
+	res := <-reqs[0].r
+
+	expected := []ClientQueue{
+		{Client: "alice", Queued: 1, Running: 1},
+		{Client: "bob", Queued: 1, Running: 0},
+	}
+
+	q := sch.getQueueState()
+
+	if !reflect.DeepEqual(expected, q.Clients) {
+		t.Errorf("Got queue %v wanted %v", q.Clients, expected)
+	}
+
+	// Completing the job means alice has nothing running
+	sch.completed(CompletedJob{
+		ID:     res.JobID,
+		Worker: MachineName{ID: "solo", Host: "solo"},
+	})
+
+	q = sch.getQueueState()
+
+	if q.Clients[0].Running != 0 {
+		t.Errorf("Alice should have no running jobs: %v", q.Clients)
+	}
+
+	// Once the worker is free a waiting job gets it, then the worker goes
+	// away
+	<-reqs[1].r
+	<-reqs[2].r
+
+	sch.updateWorker(WorkerState{
+		ID:       "solo",
+		Host:     "solo",
+		Addrs:    []net.IPNet{{net.IPv4(192, 1, 1, 2), mask}},
+		Capacity: 1,
+	})
+
+	running := func() int {
+		n := 0
+
+		for _, c := range sch.getQueueState().Clients {
+			n += c.Running
+		}
+
+		return n
+	}
+
+	if n := running(); n != 1 {
+		t.Errorf("Expected 1 running job got %d", n)
+	}
+
+	sch.removeWorker("solo")
+
+	if n := running(); n != 0 {
+		t.Errorf("Jobs on a removed worker still running: %d", n)
+	}
+}
+
+func TestSchedulerCapacity(t *testing.T) {
+	sch := newFifoScheduler()
+	mask := net.IPv4Mask(255, 255, 255, 0)
+
+	state := WorkerState{
+		ID:       "w",
+		Host:     "w",
+		Addrs:    []net.IPNet{{net.IPv4(192, 1, 1, 2), mask}},
+		Capacity: 2,
+	}
+
+	sch.addWorker(state)
+
+	// Capacity follows the worker as it changes, with or without moving
+	// networks
+	updates := []struct {
+		addr     net.IP
+		capacity int
+	}{
+		{net.IPv4(192, 1, 1, 2), 3},
+		{net.IPv4(10, 0, 0, 2), 4},
+		{net.IPv4(10, 0, 0, 2), 1},
+		{net.IPv4(192, 1, 1, 2), 2},
+	}
+
+	for _, u := range updates {
+		state.Addrs = []net.IPNet{{u.addr, mask}}
+		state.Capacity = u.capacity
+		sch.updateWorker(state)
+
+		if sch.capacity != u.capacity {
+			t.Errorf("Capacity %d after update to %d", sch.capacity,
+				u.capacity)
+		}
+	}
+
+	sch.removeWorker("w")
+
+	if sch.capacity != 0 {
+		t.Errorf("Capacity %d with no workers", sch.capacity)
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	forEachScheduler(t, func(t *testing.T, name string, sch Scheduler) {
+		mask := net.IPv4Mask(255, 255, 255, 0)
+		addrs := []net.IPNet{{net.IPv4(192, 1, 1, 3), mask}}
+
+		worker := WorkerState{
+			ID:       "solo",
+			Host:     "solo",
+			Addrs:    []net.IPNet{{net.IPv4(192, 1, 1, 2), mask}},
+			Capacity: 1,
+			Load:     1,
+		}
+
+		sch.addWorker(worker)
+
+		// A CI job is queued before an interactive one
+		low := NewSchedulerRequest(WorkerRequest{Client: "ci", Addrs: addrs,
+			Class: CIClass, Priority: -1})
+		high := NewSchedulerRequest(WorkerRequest{Client: "dev", Addrs: addrs})
+
+		sch.schedule(low)
+		sch.schedule(high)
+
+		<-low.r
+		<-high.r
+
+		// The interactive job gets the free worker
+		worker.Load = 0
+		sch.updateWorker(worker)
+
+		select {
+		case res := <-high.r:
+			if Valid != res.Type {
+				t.Error("Response should of been valid, but got:", res.Type)
+			}
+		default:
+			t.Error("High priority request was not served first")
+		}
+	})
+}
+
+func TestSchedulerClassCaps(t *testing.T) {
+	caps, err := ParseClassCaps("ci=0.5")
+
+	if err != nil {
+		t.Error("Parsing caps: ", err)
+		return
+	}
+
+	sch, _ := NewScheduler("fifo", SchedulerOptions{ClassCaps: caps})
+
+	mask := net.IPv4Mask(255, 255, 255, 0)
+	addrs := []net.IPNet{{net.IPv4(192, 1, 1, 3), mask}}
+
+	for _, id := range []MachineID{"a", "b"} {
+		sch.addWorker(WorkerState{
+			ID:       id,
+			Host:     string(id),
+			Addrs:    []net.IPNet{{net.IPv4(192, 1, 1, 2), mask}},
+			Capacity: 1,
+		})
+	}
+
+	// CI can only have half the cluster
+	ci1 := NewSchedulerRequest(WorkerRequest{Addrs: addrs, Class: CIClass})
+	ci2 := NewSchedulerRequest(WorkerRequest{Addrs: addrs, Class: CIClass})
+
+	sch.schedule(ci1)
+	sch.schedule(ci2)
+
+	if res := <-ci1.r; Valid != res.Type {
+		t.Error("First CI response should of been valid, but got:", res.Type)
+	}
+
+	if res := <-ci2.r; Queued != res.Type {
+		t.Error("Second CI response should of been queued, but got:", res.Type)
+	}
+
+	// Leaving the other worker for interactive jobs
+	dev := NewSchedulerRequest(WorkerRequest{Addrs: addrs})
+	sch.schedule(dev)
+
+	if res := <-dev.r; Valid != res.Type {
+		t.Error("Interactive response should of been valid, but got:", res.Type)
+	}
+
+	for _, bad := range []string{"ci", "nightly=0.5", "ci=2", "ci=x"} {
+		if _, err := ParseClassCaps(bad); err == nil {
+			t.Errorf("Expected error parsing: %s", bad)
+		}
+	}
+}
+
+func TestSchedulerRelease(t *testing.T) {
+	caps, _ := ParseClassCaps("ci=0.5")
+	sch, _ := NewScheduler("fifo", SchedulerOptions{ClassCaps: caps})
+
+	mask := net.IPv4Mask(255, 255, 255, 0)
+	addrs := []net.IPNet{{net.IPv4(192, 1, 1, 3), mask}}
+
+	for _, id := range []MachineID{"a", "b"} {
+		sch.addWorker(WorkerState{
+			ID:       id,
+			Host:     string(id),
+			Addrs:    []net.IPNet{{net.IPv4(192, 1, 1, 2), mask}},
+			Capacity: 4,
+		})
+	}
+
+	// CI gets four of the eight slots
+	var ci []*SchedulerRequest
+
+	for i := 0; i < 4; i++ {
+		req := NewSchedulerRequest(WorkerRequest{Addrs: addrs, Class: CIClass})
+		sch.schedule(req)
+		<-req.r
+		ci = append(ci, req)
+	}
+
+	// A job which bounced off a busy worker asks again under the same ID,
+	// which frees up its first assignment instead of counting twice
+	retry := NewSchedulerRequest(WorkerRequest{Addrs: addrs, Class: CIClass,
+		JobID: ci[0].guid})
+
+	if retry.guid != ci[0].guid {
+		t.Fatal("Retry didn't keep the job ID")
+	}
+
+	sch.schedule(retry)
+
+	if res := <-retry.r; Valid != res.Type || res.JobID != ci[0].guid {
+		t.Fatalf("Retry should of been valid, but got: %v", res)
+	}
+
+	// Hearing late that the first attempt failed leaves the retry alone
+	sch.release(ci[0])
+
+	if q := sch.getQueueState(); q.Clients[0].Running != 4 {
+		t.Errorf("Expected 4 running got: %v", q.Clients)
+	}
+
+	extra := NewSchedulerRequest(WorkerRequest{Addrs: addrs, Class: CIClass})
+	sch.schedule(extra)
+
+	if res := <-extra.r; Queued != res.Type {
+		t.Fatal("CI should be at its cap, but got:", res.Type)
+	}
+
+	// A failed job or a client which hangs up frees the slot
+	sch.release(ci[1])
+
+	if res := <-extra.r; Valid != res.Type {
+		t.Error("Queued CI job should of got the released slot:", res.Type)
+	}
+
+	// Releasing twice changes nothing
+	sch.release(ci[1])
+
+	if q := sch.getQueueState(); q.Clients[0].Running != 4 {
+		t.Errorf("Expected 4 running got: %v", q.Clients)
+	}
+}
+
+func TestSchedulerQueuePosition(t *testing.T) {
+	forEachScheduler(t, func(t *testing.T, name string, sch Scheduler) {
+		mask := net.IPv4Mask(255, 255, 255, 0)
+		addrs := []net.IPNet{{net.IPv4(192, 1, 1, 3), mask}}
+
+		sch.addWorker(WorkerState{
+			ID:       "pair",
+			Host:     "pair",
+			Addrs:    []net.IPNet{{net.IPv4(192, 1, 1, 2), mask}},
+			Capacity: 2,
+			Load:     2,
+		})
+
+		// Teach the scheduler jobs take 4 seconds on the worker, the time
+		// spent waiting and on the network doesn't count
+		sch.completed(CompletedJob{
+			Worker:      MachineName{ID: "pair", Host: "pair"},
+			CompileTime: 10 * time.Second,
+			Timing:      JobTiming{Queue: 6 * time.Second, Compile: 4 * time.Second},
+		})
+
+		first := NewSchedulerRequest(WorkerRequest{Client: "a", Addrs: addrs})
+		second := NewSchedulerRequest(WorkerRequest{Client: "a", Addrs: addrs})
+
+		sch.schedule(first)
+		sch.schedule(second)
+
+		// Second in line on a two slot cluster is about one job away
+		pos, wait, err := sch.queuePosition(second.guid)
+
+		if err != nil {
+			t.Error("Queue position error: ", err)
+		}
+
+		if pos != 2 {
+			t.Errorf("Got position %d wanted 2", pos)
+		}
+
+		if wait != 4*time.Second {
+			t.Errorf("Got wait %s wanted 4s", wait)
+		}
+
+		// Canceled requests are no longer in line
+		sch.cancel(first.guid)
+
+		pos, _, _ = sch.queuePosition(second.guid)
+
+		if pos != 1 {
+			t.Errorf("Got position %d wanted 1", pos)
+		}
+
+		sch.cancel(second.guid)
+
+		if _, _, err = sch.queuePosition(second.guid); err == nil {
+			t.Error("Expected error for a request not in the queue")
+		}
+	})
+}
+
+// Requests should only ever be handed workers on networks they can reach,
+// including networks that show up while they are waiting
+func TestSchedulerSubnets(t *testing.T) {
+	forEachScheduler(t, func(t *testing.T, name string, sch Scheduler) {
+		mask := net.IPv4Mask(255, 255, 255, 0)
+		addrs := []net.IPNet{{net.IPv4(10, 0, 0, 9), mask}}
+
+		sch.addWorker(WorkerState{
+			ID:       "far",
+			Host:     "far",
+			Addrs:    []net.IPNet{{net.IPv4(192, 168, 1, 2), mask}},
+			Capacity: 4,
+		})
+		sch.addWorker(WorkerState{
+			ID:       "near",
+			Host:     "near",
+			Addrs:    []net.IPNet{{net.IPv4(10, 0, 0, 2), mask}},
+			Capacity: 1,
+			Load:     1,
+		})
+
+		// The only reachable worker is full, so we wait
+		sreq := NewSchedulerRequest(WorkerRequest{Client: "a", Addrs: addrs})
+		sch.schedule(sreq)
+
+		if res := <-sreq.r; res.Type != Queued {
+			t.Fatalf("Expected to be queued, got: %d", res.Type)
+		}
+
+		// A worker on a brand new, reachable, network takes it
+		sch.addWorker(WorkerState{
+			ID:       "new",
+			Host:     "new",
+			Addrs:    []net.IPNet{{net.IPv4(10, 0, 0, 3), mask}},
+			Capacity: 1,
+		})
+
+		if res := <-sreq.r; res.Type != Valid || res.Host != "new" {
+			t.Errorf("Expected new worker, got: %d %s", res.Type, res.Host)
+		}
+
+		// Once the worker is gone the network is too
+		sch.removeWorker("new")
+		sch.removeWorker("near")
+
+		sreq = NewSchedulerRequest(WorkerRequest{Client: "a", Addrs: addrs})
+		sch.schedule(sreq)
+
+		if res := <-sreq.r; res.Type != Queued {
+			t.Errorf("Expected to be queued, got: %d", res.Type)
+		}
+
+		sch.cancel(sreq.guid)
+	})
+}
+
+func TestWorkerSpeedModel(t *testing.T) {
+	sch := newFifoScheduler()
+	mask := net.IPv4Mask(255, 255, 255, 0)
+
+	worker := func(id string, benchmark float64) WorkerState {
+		return WorkerState{
+			ID:        MachineID(id),
+			Host:      id,
+			Addrs:     []net.IPNet{{net.IPv4(192, 1, 1, id[0]), mask}},
+			Capacity:  2,
+			Benchmark: benchmark,
+		}
+	}
+
+	speed := func(id string) float64 {
+		return sch.workers[MachineID(id)].state.Speed
+	}
+
+	// With nothing to compare against a new worker is average
+	sch.addWorker(worker("a", 100))
+
+	if s := speed("a"); s != 1 {
+		t.Errorf("Got speed %f wanted 1", s)
+	}
+
+	// Twice the benchmark means twice as fast
+	sch.addWorker(worker("b", 200))
+
+	if s := speed("b"); s != 2 {
+		t.Errorf("Got speed %f wanted 2", s)
+	}
+
+	// No benchmark means average
+	sch.addWorker(worker("c", 0))
+
+	if s := speed("c"); s != 1 {
+		t.Errorf("Got speed %f wanted 1", s)
+	}
+
+	// Jobs are judged against others from the same compiler, so a slow
+	// compiler doesn't make a worker look slow
+	for i := 0; i < 20; i++ {
+		sch.completed(CompletedJob{
+			Worker:       MachineName{ID: "a", Host: "a"},
+			Compiler:     "gcc",
+			CompileSpeed: 100,
+		})
+		sch.completed(CompletedJob{
+			Worker:       MachineName{ID: "c", Host: "c"},
+			Compiler:     "clang",
+			CompileSpeed: 10,
+		})
+	}
+
+	if a, c := speed("a"), speed("c"); math.Abs(a-c) > 0.001 {
+		t.Errorf("Speeds should match got %f and %f", a, c)
+	}
+
+	if r := sch.rates["clang"]; r != 10 {
+		t.Errorf("Got clang rate %f wanted 10", r)
+	}
+
+	// Jobs without a speed don't count
+	before := speed("a")
+	sch.completed(CompletedJob{Worker: MachineName{ID: "a", Host: "a"}})
+
+	if s := speed("a"); s != before {
+		t.Errorf("Speed changed to %f from %f", s, before)
+	}
+}
+
+// Sets up a scheduler with the given number of full workers spread over 10
+// subnets, and the given number of requests waiting on them
+func fullScheduler(b *testing.B, workers int, queued int) (*PolicyScheduler, []WorkerState) {
+	sch := newFifoScheduler()
+	mask := net.IPv4Mask(255, 255, 255, 0)
+
+	states := make([]WorkerState, workers)
+
+	for i := range states {
+		states[i] = WorkerState{
+			ID:       MachineID(fmt.Sprintf("w%d", i)),
+			Host:     fmt.Sprintf("w%d", i),
+			Addrs:    []net.IPNet{{net.IPv4(10, 0, byte(i%10), byte(i/10+1)), mask}},
+			Capacity: 8,
+			Load:     8,
+			Speed:    float64(i),
+		}
+
+		sch.addWorker(states[i])
+	}
+
+	for i := 0; i < queued; i++ {
+		addrs := []net.IPNet{{net.IPv4(10, 0, byte(i%10), 250), mask}}
+		sreq := NewSchedulerRequest(WorkerRequest{
+			Client: fmt.Sprintf("c%d", i%20),
+			Addrs:  addrs,
+		})
+
+		sch.schedule(sreq)
+
+		if res := <-sreq.r; res.Type != Queued {
+			b.Fatalf("Expected to be queued, got: %d", res.Type)
+		}
+	}
+
+	return sch, states
+}
+
+// Heartbeats from busy workers with a deep queue, the common case on a
+// loaded cluster
+func BenchmarkSchedulerHeartbeat(b *testing.B) {
+	sch, states := fullScheduler(b, 500, 5000)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		sch.updateWorker(states[i%len(states)])
+	}
+}
+
+// A request is queued then handed the next worker slot to free up
+func BenchmarkSchedulerDispatch(b *testing.B) {
+	sch, states := fullScheduler(b, 500, 5000)
+	mask := net.IPv4Mask(255, 255, 255, 0)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		addrs := []net.IPNet{{net.IPv4(10, 0, byte(i%10), 250), mask}}
+		sreq := NewSchedulerRequest(WorkerRequest{Client: "bench", Addrs: addrs})
+
+		sch.schedule(sreq)
+		<-sreq.r
+
+		// Free up a slot, which goes to the front of the queue
+		ws := states[i%len(states)]
+		ws.Load = 7
+		sch.updateWorker(ws)
+	}
+}
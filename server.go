@@ -5,24 +5,67 @@
 package cbd
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net"
 	"reflect"
 	"sort"
+	"sync"
 	"time"
 )
 
 // MonitorRequest is sent from a client that wishes to be sent information
 // about the current jobs running on the build cluster.
 type MonitorRequest struct {
-	Host string
+	Host   string
+	Filter MonitorFilter // Which updates the monitor wants
+}
+
+// JobClass separates the jobs of people waiting on their build from the
+// ones nobody is watching
+type JobClass int
+
+const (
+	InteractiveClass JobClass = iota // A developer's build (the default)
+	CIClass                          // Continuous integration and batch builds
+)
+
+var jobClassNames = [...]string{
+	"interactive",
+	"ci",
+}
+
+func (c JobClass) String() string {
+	if c < 0 || int(c) >= len(jobClassNames) {
+		return "ERROR class out of range"
+	}
+
+	return jobClassNames[c]
+}
+
+// ParseJobClass turns a class name back into a JobClass
+func ParseJobClass(name string) (JobClass, error) {
+	for i, n := range jobClassNames {
+		if n == name {
+			return JobClass(i), nil
+		}
+	}
+
+	return InteractiveClass, fmt.Errorf("Unknown job class: %s", name)
 }
 
 // WorkerRequest is sent from the client to the server in order to find
 // a worker to process a job
 type WorkerRequest struct {
-	Client string      // Host request a worker
-	Addrs  []net.IPNet // IP addresses of the client
+	Client   string        // Host request a worker
+	User     string        // User running the build on the client
+	Addrs    []net.IPNet   // IP addresses of the client
+	Class    JobClass      // Kind of build the job is part of
+	Priority int           // Higher priority requests are served first
+	Wait     time.Duration // Give up waiting for a worker after this long
+	File     string        // Source file to be compiled, for monitors
+	JobID    GUID          // ID of the job from an earlier attempt, if any
 }
 
 // Determine what kind of response the server sent
@@ -32,6 +75,7 @@ const (
 	Queued    ResponseType = iota // No data, we are queued
 	NoWorkers                     // No workers at all available
 	Valid                         // Valid response
+	Expired                       // Waited past the deadline for a worker
 )
 
 type WorkerResponse struct {
@@ -40,18 +84,134 @@ type WorkerResponse struct {
 	Host    string       // Host of the worker (for debugging purposes)
 	Address net.IPNet    // IP address of the worker
 	Port    int          // Port the workers accepts connections on
+	JobID   GUID         // Identifies the job in the CompletedJob report
+
+	// Set on Queued responses
+	Position      int           // Place in line, 1 is next
+	EstimatedWait time.Duration // Rough time until we get a worker
 }
 
 // WorkState represents the load and capacity of a worker
 type WorkerState struct {
-	ID       MachineID   // Uniquely id for the worker machine
-	Host     string      // Host the worker resides one
-	Addrs    []net.IPNet // IP addresses of the worker
-	Port     int         // Port the worker accepts jobs on
-	Capacity int         // Number of available cores for building
-	Load     int         // How many cores are current in use
-	Updated  time.Time   // When the state was last updated
-	Speed    float64     // The speed of the worker, computed on the server
+	ID         MachineID      // Uniquely id for the worker machine
+	Host       string         // Host the worker resides one
+	Addrs      []net.IPNet    // IP addresses of the worker
+	Port       int            // Port the worker accepts jobs on
+	Capacity   int            // Number of available cores for building
+	Load       int            // How many compile jobs are currently running
+	Queued     int            // Jobs received but waiting to be compiled
+	FreeMemory uint64         // Bytes of memory available on the worker
+	Updated    time.Time      // When the state was last updated
+	Speed      float64        // Speed relative to other workers, 1 is average
+	Benchmark  float64        // KB per CPU second of the startup benchmark
+	Files      []string       // Source files being compiled
+	Suspect    bool           // Missed updates, gets no jobs until heard from
+	Draining   bool           // Worker is finishing its jobs before leaving
+	Compilers  []CompilerInfo // Compilers the worker can run
+}
+
+// DrainRequest asks the server to drain a worker, which the server passes
+// along to the worker itself
+type DrainRequest struct {
+	Worker string // Host name or machine ID of the worker
+}
+
+// DrainResponse lists the workers told to drain
+type DrainResponse struct {
+	Workers []MachineName
+}
+
+// What happened to a worker in a WorkerEvent
+type WorkerEventType int
+
+const (
+	WorkerAdded     WorkerEventType = iota // Worker connected to the server
+	WorkerSuspect                          // Worker has missed its updates
+	WorkerRecovered                        // Suspect worker was heard from
+	WorkerRemoved                          // Worker was dropped
+	WorkerDraining                         // Worker is taking no new jobs
+)
+
+var workerEventNames = [...]string{
+	"added",
+	"suspect",
+	"recovered",
+	"removed",
+	"draining",
+}
+
+func (t WorkerEventType) String() string {
+	if t < 0 || int(t) >= len(workerEventNames) {
+		return "ERROR event out of range"
+	}
+
+	return workerEventNames[t]
+}
+
+// WorkerEvent is sent to monitors when workers come and go
+type WorkerEvent struct {
+	Type   WorkerEventType // What happened
+	Worker MachineName     // Worker it happened to
+	Reason string          // Why it happened, if known
+	Time   time.Time       // When it happened
+}
+
+// What happened to a job in a JobEvent
+type JobEventType int
+
+const (
+	JobRequested    JobEventType = iota // Client asked for a worker
+	JobQueued                           // No worker free, the request waits
+	JobAssigned                         // Server handed the job a worker
+	JobUploadStart                      // Client started sending the job
+	JobUploadEnd                        // Client finished sending the job
+	JobCompileStart                     // Worker started the compiler
+	JobCompileEnd                       // Compiler finished on the worker
+	JobDownload                         // Client got the results back
+	JobDone                             // Job completed and was reported
+	JobFailed                           // Job failed, or gave up on the cluster
+)
+
+var jobEventNames = [...]string{
+	"requested",
+	"queued",
+	"assigned",
+	"upload-start",
+	"upload-end",
+	"compile-start",
+	"compile-end",
+	"download",
+	"done",
+	"failed",
+}
+
+func (t JobEventType) String() string {
+	if t < 0 || int(t) >= len(jobEventNames) {
+		return "ERROR event out of range"
+	}
+
+	return jobEventNames[t]
+}
+
+// JobEvent is sent to monitors at each step of a job's life.  The server
+// sends the scheduling steps, the client the transfers and the worker the
+// compile, all tied together by the ID the server gave the job.
+type JobEvent struct {
+	ID     GUID         // ID the server gave the job
+	Type   JobEventType // What happened
+	Client MachineName  // Machine that requested the job
+	Worker MachineName  // Worker building the job, once assigned
+	File   string       // Source file being compiled
+	Reason string       // Why the job failed, if it did
+	Time   time.Time    // When the server heard of it
+}
+
+// step returns a copy of the event for another step of the same job
+func (e JobEvent) step(t JobEventType, reason string) JobEvent {
+	e.Type = t
+	e.Reason = reason
+
+	return e
 }
 
 // List of all currently active works
@@ -59,28 +219,122 @@ type WorkerStateList struct {
 	Workers []WorkerState
 }
 
+// ClientQueue is the outstanding work of one client (or user when the
+// scheduler shares by user)
+type ClientQueue struct {
+	Client  string // Host or user name
+	Queued  int    // Requests waiting for a worker
+	Running int    // Jobs given a worker which are still being built
+}
+
+// QueueState lists the work outstanding for every client
+type QueueState struct {
+	Clients []ClientQueue
+}
+
+// ServerStats totals up every job reported to the server
+type ServerStats struct {
+	Jobs        int64         // Number of jobs completed
+	InputBytes  int64         // Bytes of source code compiled
+	OutputBytes int64         // Bytes of object code produced
+	CompileTime time.Duration // Time spent on all the jobs
+}
+
 // ServerState is all the state of our server
 // TODO: consider some kind of channel system instead of a mutex to get
 // sync access to these data structures.
 type ServerState struct {
-	sch Scheduler // Schedules jobs
+	sch           Scheduler     // Schedules jobs
+	queueTimeout  time.Duration // Longest a request may wait for a worker
+	workerTimeout time.Duration // Longest a worker may go without an update
+
+	wmutex      *sync.Mutex                // Protects the worker connections
+	workerConns map[MachineID]*MessageConn // Connection of each worker
+	suspects    map[MachineID]bool         // Workers marked suspect
+	draining    map[MachineID]bool         // Workers finishing up
 
 	monitorUpdates *updatePublisher // Sends to multiple channels completion information
+
+	quit chan struct{}  // Closed when the server shuts down
+	wg   sync.WaitGroup // Connection handlers and background work
+
+	history    *jobHistory    // Log of completed jobs, if kept
+	stateFile  string         // Where we save what we learn, if anywhere
+	statsMutex *sync.Mutex    // Protects the stats
+	stats      ServerStats    // Totals of all completed jobs
+	recent     []JobRecord    // Latest completed jobs, oldest first
+	builds     *buildSessions // Totals of the latest builds
+
+	metrics *serverMetrics // Counts for /metrics
 }
 
-func NewServerState() *ServerState {
+// Longest a request waits for a worker if the server isn't told otherwise
+const DefaultQueueTimeout = time.Duration(60) * time.Second
+
+// Longest a worker goes without an update before it's dropped, if the server
+// isn't told otherwise.  This is four worker heartbeats.
+const DefaultWorkerTimeout = time.Duration(20) * time.Second
+
+// ServerConfig holds the optional settings of a server
+type ServerConfig struct {
+	Scheduler     Scheduler     // How jobs are assigned, FIFO when nil
+	QueueTimeout  time.Duration // Max time a request is queued, 0 for default
+	WorkerTimeout time.Duration // Max time between worker updates, 0 for default
+	StateFile     string        // Saves learned state across restarts if set
+	HistoryFile   string        // Log of completed jobs, none if not set
+}
+
+func NewServerState(c ServerConfig) *ServerState {
 	s := new(ServerState)
-	s.sch = newFifoScheduler()
+	s.sch = c.Scheduler
+	s.queueTimeout = c.QueueTimeout
+	s.workerTimeout = c.WorkerTimeout
+	s.wmutex = new(sync.Mutex)
+	s.workerConns = make(map[MachineID]*MessageConn)
+	s.suspects = make(map[MachineID]bool)
+	s.draining = make(map[MachineID]bool)
 	s.monitorUpdates = newUpdatePublisher()
+	s.quit = make(chan struct{})
+	s.stateFile = c.StateFile
+	s.statsMutex = new(sync.Mutex)
+	s.builds = newBuildSessions(maxBuilds)
+	s.metrics = newServerMetrics()
+
+	if s.queueTimeout <= 0 {
+		s.queueTimeout = DefaultQueueTimeout
+	}
+
+	if s.workerTimeout <= 0 {
+		s.workerTimeout = DefaultWorkerTimeout
+	}
+
+	if s.sch == nil {
+		s.sch = newFifoScheduler()
+	}
+
+	// Pick up where we left off
+	if len(s.stateFile) > 0 {
+		s.loadState()
+	}
+
+	if len(c.HistoryFile) > 0 {
+		var err error
+		s.history, err = newJobHistory(c.HistoryFile, historyMaxSize,
+			historyKeep)
+
+		if err != nil {
+			log.Print("Error opening job history: ", err)
+			s.history = nil
+		}
+	}
 
 	return s
 }
 
-// server accepts incoming connections
-func (s *ServerState) Serve(ln net.Listener) {
-	// Start sending worker updates at 1Hz
-	go s.sendWorkState(1)
-
+// Serve accepts incoming connections until the context is canceled, then
+// closes the listener, drops workers and monitors, and waits for requests
+// in flight to finish before returning.
+func (s *ServerState) Serve(ctx context.Context, ln net.Listener) error {
 	// Start up our auto discover server
 	var a *discoveryServer
 	addr := ln.Addr()
@@ -91,16 +345,43 @@ func (s *ServerState) Serve(ln net.Listener) {
 
 		if err != nil {
 			log.Print("Error starting auto-discovery", err)
-			return
+			return err
 		}
 		defer a.stop()
 	}
 
+	// Start sending worker updates at 1Hz
+	s.goTracked(func() { s.sendWorkState(1) })
+
+	// Drop workers we stop hearing from
+	s.goTracked(s.pruneStaleWorkers)
+
+	// Save what we learn as we go
+	if len(s.stateFile) > 0 {
+		s.goTracked(s.saveStateLoop)
+	}
+
+	// Stop accepting once we are canceled
+	stopped := make(chan bool)
+	defer close(stopped)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.Close()
+		case <-stopped:
+		}
+	}()
+
 	// Incoming connections
 	for {
 		DebugPrint("Server accepting...")
 		conn, err := ln.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+
 			log.Print(err)
 			continue
 		}
@@ -109,8 +390,49 @@ func (s *ServerState) Serve(ln net.Listener) {
 		mc := NewMessageConn(conn, time.Duration(10)*time.Second)
 
 		// Spin off thread to handle the new connection
-		go s.handleConnection(mc)
+		s.goTracked(func() {
+			s.handleConnection(mc)
+			mc.Close()
+		})
+	}
+
+	s.shutdown()
+
+	return nil
+}
+
+// goTracked runs the function in a goroutine shutdown waits for
+func (s *ServerState) goTracked(f func()) {
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
+// shutdown stops all background work, closes connections to workers so
+// their handlers exit, then waits for every handler to finish
+func (s *ServerState) shutdown() {
+	log.Print("Server shutting down...")
+
+	close(s.quit)
+
+	s.wmutex.Lock()
+	for _, conn := range s.workerConns {
+		conn.Close()
 	}
+	s.wmutex.Unlock()
+
+	s.wg.Wait()
+
+	s.monitorUpdates.stop()
+
+	if s.history != nil {
+		s.history.close()
+	}
+
+	log.Print("Server stopped")
 }
 
 // updateWorker updates the worker with the currene state
@@ -119,21 +441,119 @@ func (s *ServerState) updateWorker(u WorkerState) {
 	// in sync with our local clock
 	u.Updated = time.Now()
 
+	// Hearing from the worker means it's no longer suspect
+	u.Suspect = false
+
 	// Sort the IP addresses, so the most local ones are first, and we can
 	// more easily find matching ones in the future
 	sort.Sort(ByPrivateIPAddr(u.Addrs))
 
 	// Tell the scheduler about the worker
 	s.sch.updateWorker(u)
+
+	// Let monitors know a suspect worker is back, or is on the way out
+	s.wmutex.Lock()
+	recovered := s.suspects[u.ID]
+	delete(s.suspects, u.ID)
+
+	draining := u.Draining && !s.draining[u.ID]
+
+	if draining {
+		s.draining[u.ID] = true
+	}
+	s.wmutex.Unlock()
+
+	if recovered {
+		s.publishWorkerEvent(WorkerRecovered, u, "")
+	}
+
+	if draining {
+		s.publishWorkerEvent(WorkerDraining, u, "")
+	}
 }
 
 // Remove the worker from the current set of workers
-func (s *ServerState) removeWorker(id MachineID) {
-	// Have the scheduler remove the worker
-	s.sch.removeWorker(id)
+func (s *ServerState) removeWorker(ws WorkerState, reason string) {
+	s.wmutex.Lock()
+	delete(s.suspects, ws.ID)
+	delete(s.draining, ws.ID)
+	s.wmutex.Unlock()
+
+	// Have the scheduler remove the worker, if it hasn't already
+	if err := s.sch.removeWorker(ws.ID); err != nil {
+		return
+	}
+
+	log.Printf("Removed worker %s: %s", ws.Host, reason)
+
+	s.publishWorkerEvent(WorkerRemoved, ws, reason)
 }
 
-// func (s*ServerState) pruneStaleWorkers(h string)
+// pruneStaleWorkers marks workers we haven't heard from in half the worker
+// timeout as suspect, and drops them once the full timeout has passed.
+// Dropped workers have their connection closed so they reconnect fresh.
+func (s *ServerState) pruneStaleWorkers() {
+	interval := s.workerTimeout / 4
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-time.After(interval):
+		}
+
+		s.pruneWorkers(time.Now())
+	}
+}
+
+// pruneWorkers does one pass of stale worker pruning
+func (s *ServerState) pruneWorkers(now time.Time) {
+	suspect, removed := s.sch.pruneWorkers(now, s.workerTimeout/2,
+		s.workerTimeout)
+
+	for _, ws := range suspect {
+		s.wmutex.Lock()
+		s.suspects[ws.ID] = true
+		s.wmutex.Unlock()
+
+		log.Printf("Worker %s is suspect, last update: %s", ws.Host, ws.Updated)
+
+		s.publishWorkerEvent(WorkerSuspect, ws, "missed updates")
+	}
+
+	for _, ws := range removed {
+		s.wmutex.Lock()
+		delete(s.suspects, ws.ID)
+		delete(s.draining, ws.ID)
+		conn := s.workerConns[ws.ID]
+		s.wmutex.Unlock()
+
+		log.Printf("Removed worker %s: timed out", ws.Host)
+
+		s.publishWorkerEvent(WorkerRemoved, ws, "timed out")
+
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// publishWorkerEvent tells monitors what happened to a worker
+func (s *ServerState) publishWorkerEvent(t WorkerEventType, ws WorkerState, reason string) {
+	s.monitorUpdates.publish(WorkerEvent{
+		Type:   t,
+		Worker: MachineName{ID: ws.ID, Host: ws.Host},
+		Reason: reason,
+		Time:   time.Now(),
+	})
+}
+
+// publishJobEvent tells monitors about a step in the life of a job, as of
+// when we heard about it
+func (s *ServerState) publishJobEvent(e JobEvent) {
+	e.Time = time.Now()
+	s.monitorUpdates.publish(e)
+}
 
 // handleMessage decodes incoming messages
 func (s *ServerState) handleConnection(conn *MessageConn) {
@@ -149,22 +569,35 @@ func (s *ServerState) handleConnection(conn *MessageConn) {
 	// Hand the message off to the proper function
 	switch m := msg.(type) {
 	case WorkerRequest:
-		err = s.processWorkerRequest(conn, m)
+		var job *assignedJob
+		job, err = s.processWorkerRequest(conn, m)
+
+		// Once it has a worker the client tells us how the job goes
+		if job != nil {
+			s.readJobEvents(conn, job)
+		}
 	case WorkerState:
+		// Wait as long as we would before pruning the worker.  This is set
+		// before the conn is shared through workerConns.
+		conn.timeout = s.workerTimeout
+
 		// Push update and then start continously handling the worker connection
-		s.updateWorker(m)
+		s.addWorker(conn, m)
 
 		s.handleWorkerConnection(conn, m)
 	case MonitorRequest:
-		// Create and register channel which receives information
-		u := make(chan interface{})
-
-		s.monitorUpdates.addObs(m.Host, u)
+		// Subscribe to updates, buffering them for when the monitor is slow
+		sub := s.monitorUpdates.subscribe(m.Host, subscriberBuffer)
 
-		// Step into our routine which shuffles messages from that channel into
-		// the provided connection
-		// TODO: a better identifier for this
-		s.handleMonitorConnection(conn, m.Host, u)
+		// Step into our routine which shuffles messages from the subscription
+		// into the provided connection
+		s.handleMonitorConnection(conn, sub, newMonitorFilter(m.Filter))
+	case DrainRequest:
+		err = s.processDrainRequest(conn, m)
+	case HistoryQuery:
+		err = s.processHistoryQuery(conn, m)
+	case BuildQuery:
+		err = s.processBuildQuery(conn, m)
 	case CompletedJob:
 		err = s.updateStats(m)
 
@@ -172,7 +605,25 @@ func (s *ServerState) handleConnection(conn *MessageConn) {
 			log.Print("Error updating stats: ", err)
 		}
 
-		s.monitorUpdates.updates <- m
+		s.monitorUpdates.publish(m)
+
+		// Close out the life of jobs we scheduled
+		if m.ID != (GUID{}) {
+			e := JobEvent{
+				ID:     m.ID,
+				Type:   JobDone,
+				Client: m.Client,
+				Worker: m.Worker,
+				File:   m.File,
+			}
+
+			if m.Return != 0 {
+				e.Type = JobFailed
+				e.Reason = fmt.Sprintf("compiler returned %d", m.Return)
+			}
+
+			s.publishJobEvent(e)
+		}
 	default:
 		log.Print("Un-handled message type: ", reflect.TypeOf(msg).Name())
 	}
@@ -183,89 +634,274 @@ func (s *ServerState) handleConnection(conn *MessageConn) {
 	}
 }
 
+// addWorker registers a newly connected worker
+func (s *ServerState) addWorker(conn *MessageConn, ws WorkerState) {
+	s.wmutex.Lock()
+	s.workerConns[ws.ID] = conn
+	s.wmutex.Unlock()
+
+	s.updateWorker(ws)
+
+	log.Printf("Added worker %s", ws.Host)
+
+	s.publishWorkerEvent(WorkerAdded, ws, "")
+}
+
 // handleWorkerConnection continously grabs updates from one worker
 // and sends updates the server state
 func (s *ServerState) handleWorkerConnection(conn *MessageConn, is WorkerState) {
+	// The last state tells us if the worker meant to leave
+	last := is
+
 	for {
-		ws, err := conn.ReadWorkerState()
+		_, msg, err := conn.Read()
 
 		if err != nil {
-			// Drop missing worker
-			s.removeWorker(is.ID)
-
-			log.Print("Error reading worker state: ", err)
+			if !last.Draining {
+				log.Print("Error reading worker state: ", err)
+			}
 			break
 		}
 
-		s.updateWorker(ws)
+		// Along with its state the worker tells us as its jobs compile
+		switch m := msg.(type) {
+		case WorkerState:
+			s.updateWorker(m)
+			last = m
+		case JobEvent:
+			s.publishJobEvent(m)
+		default:
+			log.Print("Un-handled worker message: ", reflect.TypeOf(msg).Name())
+		}
+	}
+
+	// Drop missing worker, unless it has already reconnected
+	s.wmutex.Lock()
+	current := s.workerConns[is.ID] == conn
+
+	if current {
+		delete(s.workerConns, is.ID)
+	}
+	s.wmutex.Unlock()
+
+	if !current {
+		return
+	}
+
+	if last.Draining {
+		s.removeWorker(last, "drained")
+	} else {
+		s.removeWorker(last, "connection lost")
+	}
+}
+
+// processDrainRequest tells every worker matching the request to drain,
+// and responds with the workers it found
+func (s *ServerState) processDrainRequest(conn *MessageConn, req DrainRequest) error {
+	var r DrainResponse
+
+	for _, ws := range s.sch.getWorkerState().Workers {
+		if string(ws.ID) != req.Worker && ws.Host != req.Worker {
+			continue
+		}
+
+		// Pass the request along on the worker's own connection
+		s.wmutex.Lock()
+		wc := s.workerConns[ws.ID]
+
+		var err error
+
+		if wc != nil {
+			err = wc.Send(DrainRequest{Worker: string(ws.ID)})
+		}
+		s.wmutex.Unlock()
+
+		if wc == nil || err != nil {
+			log.Printf("Could not send drain request to %s: %v", ws.Host, err)
+			continue
+		}
+
+		log.Printf("Draining worker %s", ws.Host)
+
+		r.Workers = append(r.Workers, MachineName{ID: ws.ID, Host: ws.Host})
 	}
+
+	return conn.Send(r)
 }
 
-// handleMonitorConnection sends completed job information to any requested
-func (s *ServerState) handleMonitorConnection(conn *MessageConn, h string, cin chan interface{}) {
-	for j := range cin {
+// handleMonitorConnection sends the subscription's updates to the monitor
+// until it goes away or the server shuts down
+func (s *ServerState) handleMonitorConnection(conn *MessageConn, sub *subscriber, f *monitorFilter) {
+	defer s.monitorUpdates.unsubscribe(sub)
+
+	for {
+		var j interface{}
+		var ok bool
+
+		select {
+		case j, ok = <-sub.updates:
+			if !ok {
+				return
+			}
+		case <-s.quit:
+			return
+		}
+
+		// Only send what the monitor asked for
+		j, ok = f.apply(j, time.Now())
+
+		if !ok {
+			continue
+		}
+
 		err := conn.Send(j)
 
 		// On an error we de-register and bail out
 		if err != nil {
-			log.Printf("Dropping monitor: %s Error: %s", h, err.Error())
-			s.monitorUpdates.removeObs(h)
-			break
+			log.Printf("Dropping monitor: %s Error: %s", sub.name, err.Error())
+			return
 		}
 	}
 }
 
 // processWorkerRequest searches for an available worker and sends the
-// result back on the given connection.
-func (s *ServerState) processWorkerRequest(conn *MessageConn, req WorkerRequest) error {
+// result back on the given connection.  While the request is queued the
+// client is told its place in line every second, and if no worker comes
+// along by the deadline the request is expired.  Once the client has been
+// handed a worker the job's events are returned, to fill in the ones the
+// client sends.
+func (s *ServerState) processWorkerRequest(conn *MessageConn, req WorkerRequest) (*assignedJob, error) {
 
 	// Create a go routine waiting for our scheduling result
-	sreq := NewSchedulerRequest(req.Addrs)
+	sreq := NewSchedulerRequest(req)
+
+	// The client's wait can only shorten our own, it's from when the
+	// request arrived so we don't depend on the client's clock
+	wait := s.queueTimeout
+
+	if req.Wait > 0 && req.Wait < wait {
+		wait = req.Wait
+	}
+
+	deadline := time.Now().Add(wait)
 
 	errOut := make(chan error)
+	start := time.Now()
+
+	// Every event of the job shares these
+	job := JobEvent{
+		ID:     sreq.guid,
+		Client: MachineName{Host: req.Client},
+		File:   req.File,
+	}
+
+	s.publishJobEvent(job.step(JobRequested, ""))
+
+	// Set once the client has been handed a worker
+	assigned := false
+
+	// Drops the request when we lose the client, so no worker is handed
+	// to it later
+	cancel := func() {
+		if cerr := s.sch.cancel(sreq.guid); cerr != nil {
+			DebugPrintf("Error canceling request %s: %s",
+				sreq.guid.String(), cerr)
+		}
+	}
 
 	go func() {
 		var err error
 
+		// Monitors only need to hear the first time we queue the job
+		queued := false
+		noteQueued := func() {
+			if !queued {
+				queued = true
+				s.publishJobEvent(job.step(JobQueued, ""))
+			}
+		}
+
+		// Tell the waiting client where it is at 1 Hz
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+
+		expire := time.After(deadline.Sub(time.Now()))
+
+		// When the server shuts down we expire right away
+		quit := s.quit
+
 		// Keep telling the waiting client we are queued
 	Loop:
 		for {
-			// 1 second timeout
-			timeout := make(chan bool, 1)
-			go func() {
-				time.Sleep(1 * time.Second)
-				timeout <- true
-			}()
-
 			// Wait for timeouts, or requests
 			select {
 			case result := <-sreq.r:
+				switch result.Type {
+				case Queued:
+					result = s.queuedResponse(sreq.guid)
+					noteQueued()
+				case Valid:
+					s.metrics.scheduled.add(1)
+					s.metrics.queueWait.observe(time.Since(start).Seconds())
+
+					job.Worker = MachineName{ID: result.ID, Host: result.Host}
+					s.publishJobEvent(job.step(JobAssigned, ""))
+				case NoWorkers:
+					s.publishJobEvent(job.step(JobFailed, "no workers in cluster"))
+				}
+
 				// We got a result!, send it to the user
 				err = conn.Send(result)
 
-				// If it's valid break out of our loop
-				if result.Type == Valid {
+				// The client never heard it was queued, so it's gone
+				if result.Type == Queued && err != nil {
+					cancel()
+				}
+
+				// If it's final break out of our loop
+				if result.Type != Queued || err != nil {
+					assigned = result.Type == Valid && err == nil
 					break Loop
 				}
 
-			case <-timeout:
+			case <-ticker.C:
 				// the read from ch has timed, tell the user we have a queue
 				// result
-				err = conn.Send(WorkerResponse{Type: Queued})
+				noteQueued()
+				err = conn.Send(s.queuedResponse(sreq.guid))
 
 				// Cancel the request and leave the loop
 				if err != nil {
-					cerr := s.sch.cancel(sreq.guid)
+					cancel()
+					break Loop
+				}
 
-					if cerr != nil {
-						DebugPrintf("Error canceling request %s: %s", sreq, cerr)
-					}
+			case <-quit:
+				quit = nil
+				expire = time.After(0)
 
-					break Loop
+			case <-expire:
+				// If we can't cancel it the request is either being handed a
+				// worker right now, or is yet to be queued, so check back soon
+				if cerr := s.sch.cancel(sreq.guid); cerr != nil {
+					expire = time.After(100 * time.Millisecond)
+					continue
 				}
+
+				s.metrics.expired.add(1)
+				s.publishJobEvent(job.step(JobFailed,
+					"timed out waiting for a worker"))
+				err = conn.Send(WorkerResponse{Type: Expired})
+
+				break Loop
 			}
 		}
 
+		if err != nil {
+			s.publishJobEvent(job.step(JobFailed, "lost the client: "+
+				err.Error()))
+		}
+
 		errOut <- err
 	}()
 
@@ -273,7 +909,81 @@ func (s *ServerState) processWorkerRequest(conn *MessageConn, req WorkerRequest)
 	s.sch.schedule(sreq)
 
 	// Wait for the scheduler to respond, and the message to send
-	return <-errOut
+	err := <-errOut
+
+	// A worker the client never heard about won't be used
+	if !assigned {
+		s.sch.release(sreq)
+		return nil, err
+	}
+
+	return &assignedJob{event: job, req: sreq}, err
+}
+
+// assignedJob is a job the server handed a worker, the client tells us how it
+// goes until it hangs up
+type assignedJob struct {
+	event JobEvent          // Every event of the job shares this
+	req   *SchedulerRequest // Request the scheduler assigned the worker to
+}
+
+// readJobEvents passes along the events the client sends while it builds a
+// job, until the client hangs up or the server shuts down.  A job which failed
+// on its worker, or whose client went away, stops counting as running.
+func (s *ServerState) readJobEvents(conn *MessageConn, a *assignedJob) {
+	defer s.sch.release(a.req)
+
+	job := a.event
+
+	// Builds can take a while, so wait as long as the connection lasts
+	conn.timeout = 0
+
+	done := make(chan bool)
+	defer close(done)
+
+	go func() {
+		select {
+		case <-s.quit:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		_, msg, err := conn.Read()
+
+		if err != nil {
+			return
+		}
+
+		e, ok := msg.(JobEvent)
+
+		if !ok {
+			log.Print("Un-handled job message: ", reflect.TypeOf(msg).Name())
+			continue
+		}
+
+		// We know better than the client which job this is
+		s.publishJobEvent(job.step(e.Type, e.Reason))
+
+		if e.Type == JobFailed {
+			s.sch.release(a.req)
+		}
+	}
+}
+
+// queuedResponse builds a Queued response with the request's place in line
+func (s *ServerState) queuedResponse(g GUID) WorkerResponse {
+	r := WorkerResponse{Type: Queued}
+
+	pos, wait, err := s.sch.queuePosition(g)
+
+	if err == nil {
+		r.Position = pos
+		r.EstimatedWait = wait
+	}
+
+	return r
 }
 
 // Sends worker state to all monitoring programs
@@ -283,19 +993,94 @@ func (s *ServerState) sendWorkState(rate float64) error {
 	d := time.Duration(int64(msSleep)) * time.Millisecond
 
 	for {
-		time.Sleep(d)
+		select {
+		case <-s.quit:
+			return nil
+		case <-time.After(d):
+		}
 
 		// Copy list into message
 		// TODO: maybe reduce copying here?
 		l := s.sch.getWorkerState()
 
 		// Send out update
-		s.monitorUpdates.updates <- l
+		s.monitorUpdates.publish(l)
 
+		// Along with how much each client has waiting
+		s.monitorUpdates.publish(s.sch.getQueueState())
 	}
 }
 
 // Updates scheduler state based on completed job information
 func (s *ServerState) updateStats(cj CompletedJob) error {
+	r := JobRecord{Time: time.Now(), CompletedJob: cj}
+
+	s.metrics.jobCompleted(cj)
+
+	if s.history != nil {
+		err := s.history.add(r)
+
+		if err != nil {
+			log.Print("Error recording job history: ", err)
+		}
+	}
+
+	s.statsMutex.Lock()
+	s.stats.Jobs++
+	s.stats.InputBytes += int64(cj.InputSize)
+	s.stats.OutputBytes += int64(cj.OutputSize)
+	s.stats.CompileTime += cj.CompileTime
+
+	s.recent = append(s.recent, r)
+
+	if len(s.recent) > maxRecentJobs {
+		s.recent = append(s.recent[:0], s.recent[1:]...)
+	}
+	s.statsMutex.Unlock()
+
+	if len(cj.BuildID) > 0 {
+		s.builds.add(r)
+	}
+
 	return s.sch.completed(cj)
 }
+
+// processHistoryQuery sends back the jobs in our history matching the query
+func (s *ServerState) processHistoryQuery(conn *MessageConn, q HistoryQuery) error {
+	if s.history == nil {
+		return conn.Send(HistoryResponse{
+			Error: "Server is not keeping a job history",
+		})
+	}
+
+	jobs, err := s.history.query(q)
+
+	if err != nil {
+		return conn.Send(HistoryResponse{Error: err.Error()})
+	}
+
+	// Send the jobs a page at a time so no one message gets too large
+	for {
+		n := len(jobs)
+
+		if n > historyPageSize {
+			n = historyPageSize
+		}
+
+		r := HistoryResponse{Jobs: jobs[:n], More: n < len(jobs)}
+
+		if err = conn.Send(r); err != nil || !r.More {
+			return err
+		}
+
+		jobs = jobs[n:]
+	}
+}
+
+// getStats returns the totals of all completed jobs
+func (s *ServerState) getStats() ServerStats {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+
+	return s.stats
+}
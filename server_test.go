@@ -6,9 +6,12 @@ package cbd
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"runtime"
+	"sync"
 	"testing"
 	"time"
 )
@@ -31,12 +34,13 @@ type WorkerTestCase struct {
 
 // A channel based deadline reader writer
 type ChannelReadWriter struct {
-	bytesIn  chan byte // Write writes to this channel
-	bytesOut chan byte // Read read from this channel
-	rCl      chan bool // Used to stop the Read function
-	wCl      chan bool // Used to stop the Write function
-	shCl     chan bool // Used to stop the shuffle goroutine
-	open     bool      // Channel is open
+	bytesIn  chan byte  // Write writes to this channel
+	bytesOut chan byte  // Read read from this channel
+	rCl      chan bool  // Used to stop the Read function
+	wCl      chan bool  // Used to stop the Write function
+	shCl     chan bool  // Used to stop the shuffle goroutine
+	mutex    sync.Mutex // Protects open
+	open     bool       // Channel is open
 }
 
 func newChannelReadWriter() *ChannelReadWriter {
@@ -109,12 +113,20 @@ func (s *ChannelReadWriter) shuffle() {
 	}
 }
 
+// isOpen returns true until the channel is closed
+func (s *ChannelReadWriter) isOpen() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.open
+}
+
 // Read data until there is nothing in the channel
 func (s *ChannelReadWriter) Read(p []byte) (n int, err error) {
 	n = 0
 	err = nil
 
-	if s.open {
+	if s.isOpen() {
 		// Timeout if we don't get any data, this is ugly but the higher level
 		// API's don't like this return to spin returning n == 0, err == nil,
 		// while we wait for data to come in
@@ -138,6 +150,9 @@ func (s *ChannelReadWriter) Read(p []byte) (n int, err error) {
 				break Loop
 			}
 		}
+	} else {
+		// Reads after a close must fail, otherwise readers spin forever
+		err = fmt.Errorf("Channel closed")
 	}
 
 	return n, err
@@ -148,7 +163,7 @@ func (s *ChannelReadWriter) Write(p []byte) (n int, err error) {
 	n = 0
 	err = nil
 
-	if s.open {
+	if s.isOpen() {
 	Loop:
 		for _, b := range p {
 			select {
@@ -165,7 +180,10 @@ func (s *ChannelReadWriter) Write(p []byte) (n int, err error) {
 }
 
 func (s *ChannelReadWriter) Close() {
+	s.mutex.Lock()
 	s.open = false
+	s.mutex.Unlock()
+
 	s.rCl <- true
 	s.wCl <- true
 	s.shCl <- true
@@ -183,7 +201,7 @@ func (s *ChannelReadWriter) SetWriteDeadline(t time.Time) error {
 
 // Our tests
 func TestServerWorkerTracking(t *testing.T) {
-	s := NewServerState()
+	s := NewServerState(ServerConfig{})
 
 	smith_id := MachineID("11:23:45:67:89:ab")
 	speedy_id := MachineID("01:23:45:67:89:ab")
@@ -295,7 +313,7 @@ func TestServerWorkerTracking(t *testing.T) {
 		// TODO: have to set this IP address carefully
 		var req WorkerRequest
 		req.Addrs = u.addrs
-		err = s.processWorkerRequest(mc, req)
+		_, err = s.processWorkerRequest(mc, req)
 
 		if err != nil {
 			t.Error("Process Error: ", err)
@@ -327,7 +345,7 @@ func TestServerWorkerTracking(t *testing.T) {
 // Make sure we drop a worker after a connection is severed
 func TestWorkerDrop(t *testing.T) {
 	// Start up server listening on our channel based connection
-	s := NewServerState()
+	s := NewServerState(ServerConfig{})
 
 	conn := newChannelReadWriter()
 	mc := NewMessageConn(conn, time.Duration(10)*time.Second)
@@ -389,16 +407,471 @@ func TestWorkerDrop(t *testing.T) {
 
 // TODO: we should figure out how to test monitoring here
 
-// TODO: need a test for queue worker behavior somehow
-
 func TestWorkerQueue(t *testing.T) {
+	s := NewServerState(ServerConfig{})
+
 	// Setup some busy workers
+	s.updateWorker(WorkerState{
+		ID:   "busy",
+		Host: "busy",
+		Addrs: []net.IPNet{
+			{net.IPv4(192, 1, 1, 1), net.IPv4Mask(255, 255, 255, 0)},
+		},
+		Port:     56,
+		Capacity: 1,
+		Load:     1,
+	})
+
+	// Ask for a worker, giving up shortly
+	var network MockConn
+	mc := NewMessageConn(&network, time.Duration(10)*time.Second)
+
+	req := WorkerRequest{
+		Addrs: []net.IPNet{
+			{net.IPv4(192, 1, 1, 2), net.IPv4Mask(255, 255, 255, 0)},
+		},
+		Wait: 1500 * time.Millisecond,
+	}
+
+	_, err := s.processWorkerRequest(mc, req)
+
+	if err != nil {
+		t.Error("Process Error: ", err)
+		return
+	}
+
+	// Make sure we get queued responses back, with our place in line
+	var r WorkerResponse
+
+	for i := 0; i < 2; i++ {
+		r, err = mc.ReadWorkerResponse()
+
+		if err != nil {
+			t.Error("Read Error: ", err)
+			return
+		}
+
+		if r.Type != Queued {
+			t.Error("Response should of been queued, but got:", r.Type)
+		}
+
+		if r.Position != 1 {
+			t.Error("Should be first in line, but got:", r.Position)
+		}
+	}
+
+	// Then the server gives up for us
+	r, err = mc.ReadWorkerResponse()
+
+	if err != nil {
+		t.Error("Read Error: ", err)
+		return
+	}
+
+	if r.Type != Expired {
+		t.Error("Response should of been expired, but got:", r.Type)
+	}
+
+	// And the request is no longer queued
+	if q := s.sch.getQueueState(); len(q.Clients) != 0 {
+		t.Error("Request still queued: ", q.Clients)
+	}
+}
+
+// brokenConn fails every write, like a client which has hung up
+type brokenConn struct {
+	MockConn
+}
+
+func (b *brokenConn) Write(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestWorkerQueueLostClient(t *testing.T) {
+	s := NewServerState(ServerConfig{})
+
+	s.updateWorker(WorkerState{
+		ID:   "busy",
+		Host: "busy",
+		Addrs: []net.IPNet{
+			{net.IPv4(192, 1, 1, 1), net.IPv4Mask(255, 255, 255, 0)},
+		},
+		Port:     56,
+		Capacity: 1,
+		Load:     1,
+	})
+
+	// The client is gone before it hears it's queued
+	var network brokenConn
+	mc := NewMessageConn(&network, time.Duration(10)*time.Second)
+
+	req := WorkerRequest{
+		Addrs: []net.IPNet{
+			{net.IPv4(192, 1, 1, 2), net.IPv4Mask(255, 255, 255, 0)},
+		},
+	}
+
+	if _, err := s.processWorkerRequest(mc, req); err == nil {
+		t.Error("Expected an error sending to the client")
+	}
+
+	// So the request must not be left for a worker to be handed to
+	if q := s.sch.getQueueState(); len(q.Clients) != 0 {
+		t.Error("Request still queued: ", q.Clients)
+	}
+}
+
+// Waits for the next worker event sent to monitors, and makes sure it's the
+// one we expected
+func waitWorkerEvent(t *testing.T, events chan interface{}, id MachineID, expected WorkerEventType) {
+	for {
+		select {
+		case i := <-events:
+			e, ok := i.(WorkerEvent)
+
+			if !ok {
+				continue
+			}
+
+			if e.Type != expected || e.Worker.ID != id {
+				t.Errorf("Expected %s event got: %s for %s", expected,
+					e.Type, e.Worker.ToString())
+			}
+			return
+		case <-time.After(time.Second):
+			t.Errorf("Timed out waiting for %s event", expected)
+			return
+		}
+	}
+}
+
+func TestPruneStaleWorkers(t *testing.T) {
+	s := NewServerState(ServerConfig{WorkerTimeout: 10 * time.Second})
+
+	events := s.monitorUpdates.subscribe("test", 10).updates
+
+	mask := net.IPv4Mask(255, 255, 255, 0)
+	clientAddrs := []net.IPNet{{net.IPv4(192, 1, 1, 2), mask}}
+
+	var network MockConn
+	s.addWorker(NewMessageConn(&network, time.Second), WorkerState{
+		ID:       "quiet",
+		Host:     "quiet",
+		Addrs:    []net.IPNet{{net.IPv4(192, 1, 1, 1), mask}},
+		Capacity: 1,
+	})
+
+	nextEvent := func(expected WorkerEventType) {
+		waitWorkerEvent(t, events, "quiet", expected)
+	}
+
+	nextEvent(WorkerAdded)
+
+	// Fresh workers are left alone
+	now := time.Now()
+	s.pruneWorkers(now.Add(4 * time.Second))
+
+	if _, err := s.sch.findWorker(clientAddrs); err != nil {
+		t.Error("Worker should still be usable: ", err)
+	}
+
+	// Half way to the timeout the worker is suspect, and gets no jobs
+	s.pruneWorkers(now.Add(6 * time.Second))
+	nextEvent(WorkerSuspect)
+
+	if _, err := s.sch.findWorker(clientAddrs); err == nil {
+		t.Error("Suspect worker should not be handed out")
+	}
+
+	l := s.sch.getWorkerState()
+
+	if len(l.Workers) != 1 || !l.Workers[0].Suspect {
+		t.Error("Worker should be listed as suspect: ", l.Workers)
+	}
+
+	// Hearing from it again brings it back
+	s.updateWorker(l.Workers[0])
+	nextEvent(WorkerRecovered)
+
+	if _, err := s.sch.findWorker(clientAddrs); err != nil {
+		t.Error("Recovered worker should be usable: ", err)
+	}
+
+	// Then once it's been quiet past the timeout it's gone
+	s.pruneWorkers(time.Now().Add(11 * time.Second))
+	nextEvent(WorkerRemoved)
+
+	if l := s.sch.getWorkerState(); len(l.Workers) != 0 {
+		t.Error("Worker should of been removed: ", l.Workers)
+	}
+}
+
+func TestDrainRequest(t *testing.T) {
+	s := NewServerState(ServerConfig{})
+
+	events := s.monitorUpdates.subscribe("test", 10).updates
+
+	mask := net.IPv4Mask(255, 255, 255, 0)
+	clientAddrs := []net.IPNet{{net.IPv4(192, 1, 1, 2), mask}}
+
+	ws := WorkerState{
+		ID:       "id-tired",
+		Host:     "tired",
+		Addrs:    []net.IPNet{{net.IPv4(192, 1, 1, 1), mask}},
+		Capacity: 1,
+	}
+
+	var workerNet MockConn
+	workerConn := NewMessageConn(&workerNet, time.Second)
+	s.addWorker(workerConn, ws)
+	waitWorkerEvent(t, events, ws.ID, WorkerAdded)
 
-	// Ask for a worker
+	// Ask by host name and make sure it's found
+	var adminNet MockConn
+	adminConn := NewMessageConn(&adminNet, time.Second)
 
-	// Make sure we get queued response back
+	err := s.processDrainRequest(adminConn, DrainRequest{Worker: "tired"})
 
-	// Free up a worker by finishing a job
+	if err != nil {
+		t.Error("Drain error: ", err)
+	}
+
+	_, msg, err := adminConn.Read()
+
+	r, ok := msg.(DrainResponse)
+
+	if err != nil || !ok || len(r.Workers) != 1 || r.Workers[0].ID != ws.ID {
+		t.Error("Bad drain response: ", msg, err)
+	}
+
+	// The worker gets the request by ID
+	_, msg, err = workerConn.Read()
+
+	if dr, ok := msg.(DrainRequest); err != nil || !ok || dr.Worker != "id-tired" {
+		t.Error("Worker did not get drain request: ", msg, err)
+	}
+
+	// Once the worker says it's draining it gets no more jobs
+	ws.Draining = true
+	s.updateWorker(ws)
+
+	if _, err := s.sch.findWorker(clientAddrs); err == nil {
+		t.Error("Draining worker should not be handed out")
+	}
+
+	waitWorkerEvent(t, events, ws.ID, WorkerDraining)
+
+	// Unknown workers are reported as such
+	s.processDrainRequest(adminConn, DrainRequest{Worker: "nobody"})
+	_, msg, _ = adminConn.Read()
+
+	if r, ok := msg.(DrainResponse); !ok || len(r.Workers) != 0 {
+		t.Error("Should not have found a worker: ", msg)
+	}
+}
+
+// Waits for the next job event sent to monitors, and makes sure it's the
+// type we expected
+func waitJobEvent(t *testing.T, events chan interface{}, expected JobEventType) JobEvent {
+	for {
+		select {
+		case i := <-events:
+			e, ok := i.(JobEvent)
+
+			if !ok {
+				continue
+			}
+
+			if e.Type != expected {
+				t.Errorf("Expected %s event got: %s", expected, e.Type)
+			}
+			return e
+		case <-time.After(time.Second):
+			t.Errorf("Timed out waiting for %s event", expected)
+			return JobEvent{}
+		}
+	}
+}
+
+func TestJobEvents(t *testing.T) {
+	s := NewServerState(ServerConfig{})
+
+	events := s.monitorUpdates.subscribe("test", 20).updates
+
+	mask := net.IPv4Mask(255, 255, 255, 0)
+
+	s.updateWorker(WorkerState{
+		ID:       "id-w1",
+		Host:     "w1",
+		Addrs:    []net.IPNet{{net.IPv4(192, 1, 1, 1), mask}},
+		Capacity: 1,
+	})
+
+	// The server reports the request and where it went
+	var clientNet MockConn
+	clientConn := NewMessageConn(&clientNet, time.Second)
+
+	job, err := s.processWorkerRequest(clientConn, WorkerRequest{
+		Client: "laptop",
+		Addrs:  []net.IPNet{{net.IPv4(192, 1, 1, 2), mask}},
+		File:   "main.c",
+	})
+
+	if err != nil || job == nil {
+		t.Fatal("Request not assigned: ", err)
+	}
+
+	e := waitJobEvent(t, events, JobRequested)
+
+	if e.ID != job.event.ID || e.File != "main.c" || e.Client.Host != "laptop" {
+		t.Errorf("Bad requested event: %+v", e)
+	}
+
+	if e = waitJobEvent(t, events, JobAssigned); e.Worker.Host != "w1" {
+		t.Errorf("Bad assigned event: %+v", e)
+	}
+
+	// The client's events are filled in with what the server knows
+	var eventNet MockConn
+	eventConn := NewMessageConn(&eventNet, time.Second)
+	eventConn.Send(JobEvent{Type: JobUploadStart})
+
+	s.readJobEvents(eventConn, job)
+
+	e = waitJobEvent(t, events, JobUploadStart)
+
+	if e.ID != job.event.ID || e.File != "main.c" || e.Worker.Host != "w1" {
+		t.Errorf("Bad upload event: %+v", e)
+	}
+
+	// The client hung up, so the job no longer counts as running
+	if q := s.sch.getQueueState(); len(q.Clients) != 0 {
+		t.Errorf("Job still running after the client left: %v", q.Clients)
+	}
+
+	// The worker's events come along with its state
+	var workerNet MockConn
+	workerConn := NewMessageConn(&workerNet, time.Second)
+	workerConn.Send(JobEvent{ID: job.event.ID, Type: JobCompileStart})
+
+	s.handleWorkerConnection(workerConn, WorkerState{ID: "id-w1", Host: "w1"})
+
+	if e = waitJobEvent(t, events, JobCompileStart); e.ID != job.event.ID {
+		t.Errorf("Bad compile event: %+v", e)
+	}
 
-	// Make sure we now get back the worker we expect
+	// Then completing the job closes it out
+	var doneNet MockConn
+	doneConn := NewMessageConn(&doneNet, time.Second)
+	doneConn.Send(CompletedJob{ID: job.event.ID, File: "main.c", Return: 1})
+
+	s.handleConnection(doneConn)
+
+	e = waitJobEvent(t, events, JobFailed)
+
+	if e.ID != job.event.ID || e.Reason != "compiler returned 1" {
+		t.Errorf("Bad failed event: %+v", e)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	s := NewServerState(ServerConfig{})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("Listen error: ", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+
+	go func() {
+		served <- s.Serve(ctx, ln)
+	}()
+
+	// Connect up a busy worker, and a monitor
+	worker, err := NewTCPMessageConn(ln.Addr().String(), time.Second)
+
+	if err != nil {
+		t.Fatal("Worker connect error: ", err)
+	}
+
+	defer worker.Close()
+
+	worker.Send(WorkerState{
+		ID:       "busy",
+		Host:     "busy",
+		Addrs:    []net.IPNet{{net.IPv4(127, 0, 0, 1), net.IPv4Mask(255, 0, 0, 0)}},
+		Capacity: 1,
+		Load:     1,
+	})
+
+	// Wait for the server to take in the worker
+	for i := 0; len(s.sch.getWorkerState().Workers) == 0 && i < 50; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	monitor, err := NewTCPMessageConn(ln.Addr().String(), time.Second)
+
+	if err != nil {
+		t.Fatal("Monitor connect error: ", err)
+	}
+
+	defer monitor.Close()
+
+	monitor.Send(MonitorRequest{Host: "watcher"})
+
+	// Queue up a request behind the busy worker
+	client, err := NewTCPMessageConn(ln.Addr().String(), 5*time.Second)
+
+	if err != nil {
+		t.Fatal("Client connect error: ", err)
+	}
+
+	defer client.Close()
+
+	client.Send(WorkerRequest{
+		Client: "client",
+		Addrs:  []net.IPNet{{net.IPv4(127, 0, 0, 2), net.IPv4Mask(255, 0, 0, 0)}},
+	})
+
+	if r, err := client.ReadWorkerResponse(); err != nil || r.Type != Queued {
+		t.Fatal("Expected to be queued: ", r.Type, err)
+	}
+
+	// Shutting down expires the request and returns from Serve
+	cancel()
+
+	for {
+		r, err := client.ReadWorkerResponse()
+
+		if err != nil {
+			t.Fatal("Read error: ", err)
+		}
+
+		if r.Type == Expired {
+			break
+		}
+	}
+
+	select {
+	case err = <-served:
+		if err != nil {
+			t.Error("Serve error: ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+
+	// Everything the server started should be gone
+	for i := 0; runtime.NumGoroutine() > before && i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("Leaked goroutines, had %d now %d", before, n)
+	}
 }
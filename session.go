@@ -0,0 +1,259 @@
+// Build sessions: every job run with the same CBD_BUILD_ID is part of one
+// build, which the server totals up so "cbd build" can summarize it at the
+// end.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Builds tracked at once, the one we heard from longest ago is dropped first
+var maxBuilds = 100
+
+// Slowest files kept for each build
+const slowestFiles = 10
+
+// BuildQuery asks the server for the summary of one build
+type BuildQuery struct {
+	ID string // CBD_BUILD_ID of the build
+}
+
+// BuildSummary totals up the jobs of one build
+type BuildSummary struct {
+	ID      string         // CBD_BUILD_ID of the build
+	Jobs    int            // Jobs reported
+	Local   int            // Jobs the client built itself
+	Failed  int            // Jobs the compiler failed
+	JobTime time.Duration  // Time of every job added up
+	Busy    time.Duration  // Time at least one job was running
+	Longest time.Duration  // Longest single job
+	Start   time.Time      // When the first job started
+	End     time.Time      // When the last job finished
+	Slowest []FileSummary  // Slowest files, slowest first
+	Workers map[string]int // Jobs built on each worker host
+	Error   string         // Why the query failed, if it did
+}
+
+// jobInterval is when one job was running
+type jobInterval struct {
+	start time.Time
+	end   time.Time
+}
+
+// buildSession is what we know about one build so far
+type buildSession struct {
+	summary   BuildSummary  // Totals, Busy is filled in when asked for
+	intervals []jobInterval // When each job ran
+	updated   time.Time     // When we last heard about the build
+}
+
+// buildSessions tracks the latest builds
+type buildSessions struct {
+	mutex  *sync.Mutex              // Protects the builds
+	builds map[string]*buildSession // Each build by ID
+	max    int                      // Most builds kept
+}
+
+func newBuildSessions(max int) *buildSessions {
+	b := new(buildSessions)
+	b.mutex = new(sync.Mutex)
+	b.builds = make(map[string]*buildSession)
+	b.max = max
+
+	return b
+}
+
+// add counts the job towards its build, the job must have a build ID
+func (b *buildSessions) add(r JobRecord) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s, ok := b.builds[r.BuildID]
+
+	if !ok {
+		b.evict()
+
+		s = &buildSession{
+			summary: BuildSummary{
+				ID:      r.BuildID,
+				Workers: make(map[string]int),
+			},
+		}
+		b.builds[r.BuildID] = s
+	}
+
+	s.updated = r.Time
+
+	// The job started its compile time before it was reported
+	in := jobInterval{start: r.Time.Add(-r.CompileTime), end: r.Time}
+	s.intervals = append(s.intervals, in)
+
+	sum := &s.summary
+	sum.Jobs++
+	sum.JobTime += r.CompileTime
+
+	if r.local() {
+		sum.Local++
+	} else {
+		sum.Workers[r.Worker.Host]++
+	}
+
+	if r.Return != 0 {
+		sum.Failed++
+	}
+
+	if r.CompileTime > sum.Longest {
+		sum.Longest = r.CompileTime
+	}
+
+	if sum.Start.IsZero() || in.start.Before(sum.Start) {
+		sum.Start = in.start
+	}
+
+	if in.end.After(sum.End) {
+		sum.End = in.end
+	}
+
+	// Keep the slowest files in order
+	sum.Slowest = append(sum.Slowest, FileSummary{
+		File:        r.File,
+		Jobs:        1,
+		CompileTime: r.CompileTime,
+	})
+
+	sort.Stable(byCompileTime(sum.Slowest))
+
+	if len(sum.Slowest) > slowestFiles {
+		sum.Slowest = sum.Slowest[:slowestFiles]
+	}
+}
+
+// evict drops the build we heard from longest ago if we are full.  Assumes
+// things are locked.
+func (b *buildSessions) evict() {
+	if len(b.builds) < b.max {
+		return
+	}
+
+	var oldest string
+
+	for id, s := range b.builds {
+		if len(oldest) == 0 || s.updated.Before(b.builds[oldest].updated) {
+			oldest = id
+		}
+	}
+
+	delete(b.builds, oldest)
+}
+
+// summary returns the totals of the build, false if we know nothing of it
+func (b *buildSessions) summary(id string) (BuildSummary, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s, ok := b.builds[id]
+
+	if !ok {
+		return BuildSummary{}, false
+	}
+
+	sum := s.summary
+	sum.Busy = busyTime(s.intervals)
+
+	// Copy what we keep updating
+	sum.Slowest = append([]FileSummary{}, sum.Slowest...)
+	sum.Workers = make(map[string]int)
+
+	for w, n := range s.summary.Workers {
+		sum.Workers[w] = n
+	}
+
+	return sum, true
+}
+
+// byStart sorts intervals by when they start
+type byStart []jobInterval
+
+func (a byStart) Len() int           { return len(a) }
+func (a byStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byStart) Less(i, j int) bool { return a[i].start.Before(a[j].start) }
+
+// busyTime returns how long at least one of the intervals was running
+func busyTime(intervals []jobInterval) time.Duration {
+	sorted := append([]jobInterval{}, intervals...)
+	sort.Sort(byStart(sorted))
+
+	var busy time.Duration
+	var cur jobInterval
+
+	for i, in := range sorted {
+		if i > 0 && !in.start.After(cur.end) {
+			// Overlaps the current stretch, so extend it
+			if in.end.After(cur.end) {
+				cur.end = in.end
+			}
+			continue
+		}
+
+		busy += cur.end.Sub(cur.start)
+		cur = in
+	}
+
+	return busy + cur.end.Sub(cur.start)
+}
+
+// processBuildQuery sends back the summary of the build
+func (s *ServerState) processBuildQuery(conn *MessageConn, q BuildQuery) error {
+	r, ok := s.builds.summary(q.ID)
+
+	if !ok {
+		r.ID = q.ID
+		r.Error = "No jobs reported for build " + q.ID
+	}
+
+	return conn.Send(r)
+}
+
+// QueryBuild asks the server for the summary of the build with the given
+// ID.  If no server is given auto-discovery is used to find one.
+func QueryBuild(saddr string, id string) (BuildSummary, error) {
+	mc, err := connectServer(saddr, time.Duration(10)*time.Second)
+
+	if err != nil {
+		return BuildSummary{}, err
+	}
+
+	defer mc.Close()
+
+	err = mc.Send(BuildQuery{ID: id})
+
+	if err != nil {
+		return BuildSummary{}, err
+	}
+
+	_, msg, err := mc.Read()
+
+	if err != nil {
+		return BuildSummary{}, err
+	}
+
+	r, ok := msg.(BuildSummary)
+
+	if !ok {
+		return r, fmt.Errorf("Unexpected build response: %s",
+			reflect.TypeOf(msg).Name())
+	}
+
+	if len(r.Error) > 0 {
+		return r, fmt.Errorf("Build query failed: %s", r.Error)
+	}
+
+	return r, nil
+}
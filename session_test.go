@@ -0,0 +1,184 @@
+// Tests for build session tracking.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"testing"
+	"time"
+)
+
+// Makes a history record for the given file in the given build
+func buildRecord(build string, t time.Time, client string, worker string,
+	file string, d time.Duration) JobRecord {
+	r := historyRecord(t, client, worker, file, d)
+	r.BuildID = build
+
+	return r
+}
+
+func TestBuildSessionSummary(t *testing.T) {
+	b := newBuildSessions(10)
+
+	start := time.Now()
+	second := time.Duration(1) * time.Second
+
+	// Two overlapping jobs, a gap, then a local one
+	failed := buildRecord("b1", start.Add(4*second), "alice", "w2",
+		"src/b.c", 3*second)
+	failed.Return = 1
+
+	records := []JobRecord{
+		buildRecord("b1", start.Add(2*second), "alice", "w1", "src/a.c",
+			2*second),
+		failed,
+		buildRecord("b1", start.Add(10*second), "alice", "alice", "src/c.c",
+			second),
+		buildRecord("other", start, "bob", "w1", "src/d.c", 5*second),
+	}
+
+	// A worker on the client's host is still remote
+	same := buildRecord("b2", start, "alice", "alice", "src/e.c", second)
+	same.Timing = JobTiming{Upload: second}
+	records = append(records, same)
+
+	for _, r := range records {
+		b.add(r)
+	}
+
+	if sum, _ := b.summary("b2"); sum.Local != 0 || sum.Workers["alice"] != 1 {
+		t.Errorf("Job on the client's worker counted as local: %+v", sum)
+	}
+
+	sum, ok := b.summary("b1")
+
+	if !ok {
+		t.Fatal("No summary of the build")
+	}
+
+	if sum.Jobs != 3 || sum.Local != 1 || sum.Failed != 1 {
+		t.Errorf("Wrong counts: %d jobs %d local %d failed", sum.Jobs,
+			sum.Local, sum.Failed)
+	}
+
+	if sum.JobTime != 6*second || sum.Longest != 3*second {
+		t.Errorf("Wrong times: %s total %s longest", sum.JobTime, sum.Longest)
+	}
+
+	// Running from 0s-4s then 9s-10s
+	if sum.Busy != 5*second {
+		t.Errorf("Busy for %s, wanted 5s", sum.Busy)
+	}
+
+	if !sum.Start.Equal(start) || !sum.End.Equal(start.Add(10*second)) {
+		t.Errorf("Wrong span: %s to %s", sum.Start, sum.End)
+	}
+
+	if len(sum.Workers) != 2 || sum.Workers["w1"] != 1 || sum.Workers["w2"] != 1 {
+		t.Errorf("Wrong workers: %v", sum.Workers)
+	}
+
+	files := []string{"src/b.c", "src/a.c", "src/c.c"}
+
+	if len(sum.Slowest) != len(files) {
+		t.Fatalf("Got %d slowest files wanted %d", len(sum.Slowest),
+			len(files))
+	}
+
+	for i, f := range files {
+		if sum.Slowest[i].File != f {
+			t.Errorf("Slowest file %d is %s wanted %s", i,
+				sum.Slowest[i].File, f)
+		}
+	}
+
+	if _, ok := b.summary("missing"); ok {
+		t.Error("Got a summary of an unknown build")
+	}
+}
+
+func TestBuildSessionLimits(t *testing.T) {
+	b := newBuildSessions(2)
+
+	start := time.Now()
+	second := time.Duration(1) * time.Second
+
+	b.add(buildRecord("old", start, "a", "w", "a.c", second))
+	b.add(buildRecord("new", start.Add(second), "a", "w", "a.c", second))
+
+	// The old build is the one dropped to make room
+	b.add(buildRecord("newest", start.Add(2*second), "a", "w", "a.c", second))
+
+	if _, ok := b.summary("old"); ok {
+		t.Error("Oldest build was kept")
+	}
+
+	for _, id := range []string{"new", "newest"} {
+		if _, ok := b.summary(id); !ok {
+			t.Errorf("Build %s was dropped", id)
+		}
+	}
+
+	// Only the slowest files are kept
+	for i := 0; i < slowestFiles+5; i++ {
+		b.add(buildRecord("new", start, "a", "w", "a.c",
+			time.Duration(i)*second))
+	}
+
+	sum, _ := b.summary("new")
+
+	if len(sum.Slowest) != slowestFiles {
+		t.Errorf("Kept %d slowest files", len(sum.Slowest))
+	}
+
+	if sum.Slowest[0].CompileTime != time.Duration(slowestFiles+4)*second {
+		t.Errorf("Slowest file took %s", sum.Slowest[0].CompileTime)
+	}
+}
+
+func TestProcessBuildQuery(t *testing.T) {
+	s := NewServerState(ServerConfig{})
+
+	j := CompletedJob{
+		Client:      MachineName{ID: "c", Host: "client"},
+		Worker:      MachineName{ID: "w", Host: "worker"},
+		File:        "src/a.c",
+		CompileTime: time.Duration(2) * time.Second,
+		BuildID:     "b1",
+	}
+
+	// The scheduler doesn't know the worker, but the job is still counted
+	s.updateStats(j)
+
+	// Jobs outside a build aren't tracked
+	j.BuildID = ""
+	s.updateStats(j)
+
+	var network MockConn
+	mc := NewMessageConn(&network, time.Duration(10)*time.Second)
+
+	if err := s.processBuildQuery(mc, BuildQuery{ID: "b1"}); err != nil {
+		t.Fatal("Query error: ", err)
+	}
+
+	_, msg, err := mc.Read()
+
+	if err != nil {
+		t.Fatal("Read error: ", err)
+	}
+
+	sum, ok := msg.(BuildSummary)
+
+	if !ok || sum.ID != "b1" || sum.Jobs != 1 || sum.Workers["worker"] != 1 {
+		t.Errorf("Wrong summary: %+v", msg)
+	}
+
+	// Unknown builds give back an error
+	s.processBuildQuery(mc, BuildQuery{ID: "nope"})
+	_, msg, _ = mc.Read()
+
+	if sum, ok := msg.(BuildSummary); !ok || len(sum.Error) == 0 {
+		t.Errorf("Expected an error got: %+v", msg)
+	}
+}
@@ -0,0 +1,174 @@
+// The server's HTTP status API, which serves the state of the cluster as JSON
+// so dashboards and scripts don't need to speak our message protocol.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Number of completed jobs the server keeps around for /jobs/recent
+const maxRecentJobs = 100
+
+// WorkerStatus is a worker as served by /workers, with plain address strings
+type WorkerStatus struct {
+	WorkerState
+	Addrs []string // Networks of the worker, ex: "192.168.1.2/24"
+}
+
+// StatusStats is what /stats serves, the job totals along with the size of
+// the cluster
+type StatusStats struct {
+	ServerStats
+	Workers  int // Workers connected
+	Capacity int // Jobs the workers can run at once
+	Load     int // Jobs running
+	Queued   int // Requests waiting for a worker
+}
+
+// ServeStatus serves the status API over HTTP until the context is canceled
+func (s *ServerState) ServeStatus(ctx context.Context, ln net.Listener) error {
+	return serveHTTP(ctx, ln, s.statusHandler())
+}
+
+// serveHTTP serves HTTP requests with the handler until the context is
+// canceled, giving requests in flight a few seconds to finish
+func serveHTTP(ctx context.Context, ln net.Listener, h http.Handler) error {
+	srv := &http.Server{Handler: h}
+
+	stopped := make(chan bool)
+	defer close(stopped)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			sctx, cancel := context.WithTimeout(context.Background(),
+				time.Duration(5)*time.Second)
+			srv.Shutdown(sctx)
+			cancel()
+		case <-stopped:
+		}
+	}()
+
+	err := srv.Serve(ln)
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+// statusHandler routes each status API path to its handler
+func (s *ServerState) statusHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/workers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, toWorkerStatus(s.sch.getWorkerState().Workers))
+	})
+
+	mux.HandleFunc("/queue", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, s.sch.getQueueState())
+	})
+
+	mux.HandleFunc("/jobs/recent", func(w http.ResponseWriter, r *http.Request) {
+		limit := maxRecentJobs
+
+		if str := r.FormValue("limit"); len(str) > 0 {
+			var err error
+			limit, err = strconv.Atoi(str)
+
+			if err != nil || limit < 0 {
+				http.Error(w, "Bad limit: "+str, http.StatusBadRequest)
+				return
+			}
+		}
+
+		writeJSON(w, r, s.recentJobs(limit))
+	})
+
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, s.statusStats())
+	})
+
+	mux.Handle("/metrics", metricsHandler(s.writeMetrics))
+
+	// The dashboard and its live updates
+	mux.HandleFunc("/", serveDashboard)
+	mux.HandleFunc("/events", s.serveEvents)
+
+	return mux
+}
+
+// writeJSON sends back the value as JSON, only GET requests are allowed
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(v)
+
+	if err != nil {
+		log.Print("Error writing status: ", err)
+	}
+}
+
+// toWorkerStatus returns the workers with their addresses as strings
+func toWorkerStatus(workers []WorkerState) []WorkerStatus {
+	status := make([]WorkerStatus, 0, len(workers))
+
+	for _, ws := range workers {
+		ns := WorkerStatus{WorkerState: ws}
+
+		for _, addr := range ws.Addrs {
+			ns.Addrs = append(ns.Addrs, addr.String())
+		}
+
+		status = append(status, ns)
+	}
+
+	return status
+}
+
+// statusStats totals up the job stats and the state of the cluster
+func (s *ServerState) statusStats() StatusStats {
+	st := StatusStats{ServerStats: s.getStats()}
+
+	for _, ws := range s.sch.getWorkerState().Workers {
+		st.Workers++
+		st.Capacity += ws.Capacity
+		st.Load += ws.Load
+	}
+
+	for _, c := range s.sch.getQueueState().Clients {
+		st.Queued += c.Queued
+	}
+
+	return st
+}
+
+// recentJobs returns up to limit of the latest completed jobs, oldest first
+func (s *ServerState) recentJobs(limit int) []JobRecord {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+
+	jobs := s.recent
+
+	if limit < len(jobs) {
+		jobs = jobs[len(jobs)-limit:]
+	}
+
+	return append([]JobRecord{}, jobs...)
+}
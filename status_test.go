@@ -0,0 +1,114 @@
+// Tests for the HTTP status API.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Fetches the path from the status API, decoding the JSON into v
+func getStatus(t *testing.T, h http.Handler, path string, v interface{}) int {
+	req := httptest.NewRequest("GET", path, nil)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code == http.StatusOK {
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: got content type %s", path, ct)
+		}
+
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Errorf("%s: decode error: %s", path, err)
+		}
+	}
+
+	return rec.Code
+}
+
+func TestStatusAPI(t *testing.T) {
+	s := NewServerState(ServerConfig{})
+	h := s.statusHandler()
+
+	s.updateWorker(WorkerState{
+		ID:       "w1",
+		Host:     "w1",
+		Addrs:    []net.IPNet{{net.IPv4(192, 1, 1, 1), net.IPv4Mask(255, 255, 255, 0)}},
+		Port:     57,
+		Capacity: 4,
+		Load:     1,
+	})
+
+	for i := 0; i < maxRecentJobs+5; i++ {
+		s.updateStats(CompletedJob{
+			Worker:      MachineName{ID: "w1", Host: "w1"},
+			File:        "a.c",
+			InputSize:   i,
+			CompileTime: time.Second,
+		})
+	}
+
+	var workers []WorkerStatus
+
+	if code := getStatus(t, h, "/workers", &workers); code != http.StatusOK {
+		t.Fatal("/workers got status: ", code)
+	}
+
+	if len(workers) != 1 || workers[0].Host != "w1" || workers[0].Capacity != 4 {
+		t.Errorf("Bad workers: %+v", workers)
+	} else if len(workers[0].Addrs) != 1 || workers[0].Addrs[0] != "192.1.1.1/24" {
+		t.Errorf("Bad worker addresses: %v", workers[0].Addrs)
+	}
+
+	var queue QueueState
+
+	if code := getStatus(t, h, "/queue", &queue); code != http.StatusOK {
+		t.Error("/queue got status: ", code)
+	}
+
+	var stats StatusStats
+
+	if code := getStatus(t, h, "/stats", &stats); code != http.StatusOK {
+		t.Error("/stats got status: ", code)
+	}
+
+	if stats.Jobs != maxRecentJobs+5 || stats.Workers != 1 ||
+		stats.Capacity != 4 || stats.Load != 1 {
+		t.Errorf("Bad stats: %+v", stats)
+	}
+
+	// Only the latest jobs are kept, newest last
+	var jobs []JobRecord
+
+	getStatus(t, h, "/jobs/recent", &jobs)
+
+	if len(jobs) != maxRecentJobs || jobs[len(jobs)-1].InputSize != maxRecentJobs+4 {
+		t.Errorf("Got %d recent jobs", len(jobs))
+	}
+
+	getStatus(t, h, "/jobs/recent?limit=2", &jobs)
+
+	if len(jobs) != 2 || jobs[0].InputSize != maxRecentJobs+3 {
+		t.Errorf("Bad limited jobs: %+v", jobs)
+	}
+
+	if code := getStatus(t, h, "/jobs/recent?limit=x", &jobs); code != http.StatusBadRequest {
+		t.Error("Bad limit got status: ", code)
+	}
+
+	// Read only
+	req := httptest.NewRequest("POST", "/stats", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Error("POST got status: ", rec.Code)
+	}
+}
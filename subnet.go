@@ -0,0 +1,204 @@
+// The indexes the PolicyScheduler uses to avoid scanning every worker and
+// request on each update.  Workers are grouped by the subnets they are on,
+// and each subnet keeps a heap of its free workers along with heaps of the
+// queued requests that can reach it.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"container/heap"
+	"net"
+)
+
+// workerEntry is the scheduler's record of a single worker
+type workerEntry struct {
+	state WorkerState           // Latest state of the worker
+	addrs map[*subnet]net.IPNet // Address of the worker on each subnet
+	pos   map[*subnet]int       // Index in each subnet's free heap
+}
+
+func newWorkerEntry(state WorkerState) *workerEntry {
+	e := new(workerEntry)
+	e.state = state
+	e.addrs = make(map[*subnet]net.IPNet)
+	e.pos = make(map[*subnet]int)
+
+	return e
+}
+
+// hasSpace returns true if the worker can take another job, suspect and
+// draining workers never can
+func (e *workerEntry) hasSpace() bool {
+	if e.state.Suspect || e.state.Draining {
+		return false
+	}
+
+	return freeSlots(&e.state) > 0
+}
+
+// subnet is one network that workers are on
+type subnet struct {
+	network  net.IPNet                 // Masked network address
+	workers  int                       // Number of workers on the network
+	free     *workerHeap               // Workers with space, best on top
+	requests map[JobClass]*requestHeap // Requests that can reach us
+}
+
+func newSubnet(network net.IPNet, p schedPolicy) *subnet {
+	sub := new(subnet)
+	sub.network = network
+	sub.free = &workerHeap{sub: sub, policy: p}
+	sub.requests = make(map[JobClass]*requestHeap)
+
+	return sub
+}
+
+// Adds a queued request to the heap for its class
+func (sub *subnet) push(req *SchedulerRequest) {
+	h, ok := sub.requests[req.class]
+
+	if !ok {
+		h = new(requestHeap)
+		sub.requests[req.class] = h
+	}
+
+	heap.Push(h, req)
+	req.heaps = append(req.heaps, h)
+}
+
+// Returns the network the address is on, used to index subnets
+func networkOf(addr net.IPNet) net.IPNet {
+	return net.IPNet{
+		IP:   addr.IP.Mask(addr.Mask),
+		Mask: addr.Mask,
+	}
+}
+
+// Returns true if a client with the given address can reach the subnet.  We
+// treat overlapping networks as reachable either way around, so a client on
+// a smaller network than the workers' can be sent any worker on it, not just
+// the ones inside the client's own network.
+func (sub *subnet) reachable(addr net.IPNet) bool {
+	return addr.Contains(sub.network.IP) || sub.network.Contains(addr.IP)
+}
+
+// workerHeap orders the free workers of a subnet with the best on top
+type workerHeap struct {
+	sub    *subnet        // Subnet the heap belongs to
+	policy schedPolicy    // Decides which worker is best
+	items  []*workerEntry // The heap itself
+}
+
+func (h *workerHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *workerHeap) Less(i, j int) bool {
+	return h.policy.better(&h.items[i].state, &h.items[j].state)
+}
+
+func (h *workerHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].pos[h.sub] = i
+	h.items[j].pos[h.sub] = j
+}
+
+func (h *workerHeap) Push(x interface{}) {
+	e := x.(*workerEntry)
+	e.pos[h.sub] = len(h.items)
+	h.items = append(h.items, e)
+}
+
+func (h *workerHeap) Pop() interface{} {
+	n := len(h.items)
+	e := h.items[n-1]
+	h.items[n-1] = nil
+	h.items = h.items[:n-1]
+	delete(e.pos, h.sub)
+
+	return e
+}
+
+// Returns the best free worker, or nil if there are none
+func (h *workerHeap) top() *workerEntry {
+	if len(h.items) == 0 {
+		return nil
+	}
+
+	return h.items[0]
+}
+
+// requestHeap orders queued requests with the next to be served on top.
+// Requests are left in the heap when they leave the queue and skipped over
+// once they reach the top.
+type requestHeap struct {
+	items []*SchedulerRequest // The heap itself
+	dead  int                 // Requests in the heap no longer queued
+}
+
+func (h *requestHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *requestHeap) Less(i, j int) bool {
+	return requestBefore(h.items[i], h.items[j])
+}
+
+func (h *requestHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *requestHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(*SchedulerRequest))
+}
+
+func (h *requestHeap) Pop() interface{} {
+	n := len(h.items)
+	req := h.items[n-1]
+	h.items[n-1] = nil
+	h.items = h.items[:n-1]
+
+	return req
+}
+
+// Returns the next queued request, or nil if there are none
+func (h *requestHeap) top() *SchedulerRequest {
+	for len(h.items) > 0 && !h.items[0].queued {
+		heap.Pop(h)
+		h.dead--
+	}
+
+	if len(h.items) == 0 {
+		return nil
+	}
+
+	return h.items[0]
+}
+
+// Notes that one of the requests has left the queue, once most of the heap
+// is made of those we clear them all out
+func (h *requestHeap) removed() {
+	h.dead++
+
+	if h.dead < 64 || h.dead < len(h.items)/2 {
+		return
+	}
+
+	live := h.items[:0]
+
+	for _, req := range h.items {
+		if req.queued {
+			live = append(live, req)
+		}
+	}
+
+	for i := len(live); i < len(h.items); i++ {
+		h.items[i] = nil
+	}
+
+	h.items = live
+	h.dead = 0
+	heap.Init(h)
+}
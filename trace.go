@@ -0,0 +1,286 @@
+// Exports completed jobs as a Chrome trace, which chrome://tracing and
+// Perfetto show as a timeline of the build: a track for each client and
+// worker host, with a row for each job running at once on it.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Worker slot rows come after the client rows of a host which is both
+const traceSlotTid = 1000
+
+// traceEvent is one entry in the Chrome trace event format, times are in
+// microseconds
+type traceEvent struct {
+	Name string                 `json:"name"`
+	Cat  string                 `json:"cat,omitempty"`
+	Ph   string                 `json:"ph"` // X for a slice, M for metadata
+	Ts   float64                `json:"ts"`
+	Dur  float64                `json:"dur"`
+	Pid  int                    `json:"pid"`
+	Tid  int                    `json:"tid"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+// traceFile is the whole trace as written out
+type traceFile struct {
+	TraceEvents     []traceEvent      `json:"traceEvents"`
+	DisplayTimeUnit string            `json:"displayTimeUnit"`
+	OtherData       map[string]string `json:"otherData"`
+}
+
+// tracePhase is one step of a job laid out on the timeline
+type tracePhase struct {
+	name  string
+	start time.Time
+	dur   time.Duration
+}
+
+// traceJob is a job laid out on the timeline
+type traceJob struct {
+	r      JobRecord
+	start  time.Time
+	phases []tracePhase
+}
+
+// layoutJob works out when each step of the job ran.  Records only have when
+// the server heard of the job and how long each step took, so the steps are
+// laid out back to back ending then.  Jobs without a breakdown get a single
+// compile step.
+func layoutJob(r JobRecord) traceJob {
+	t := r.Timing
+	steps := []tracePhase{
+		{name: "preprocess", dur: t.Preprocess},
+		{name: "queue", dur: t.Queue},
+		{name: "upload", dur: t.Upload},
+		{name: "compile", dur: t.Compile},
+		{name: "download", dur: t.Download},
+		{name: "write", dur: t.Write},
+	}
+
+	if t == (JobTiming{}) {
+		steps = []tracePhase{{name: "compile", dur: r.CompileTime}}
+	}
+
+	end := r.Time
+
+	for i := len(steps) - 1; i >= 0; i-- {
+		steps[i].start = end.Add(-steps[i].dur)
+		end = steps[i].start
+	}
+
+	j := traceJob{r: r, start: end}
+
+	for _, s := range steps {
+		if s.dur > 0 {
+			j.phases = append(j.phases, s)
+		}
+	}
+
+	return j
+}
+
+// traceCompile is a remote compile waiting for a worker slot
+type traceCompile struct {
+	r JobRecord
+	p tracePhase
+}
+
+// jobArgs are the details shown when a job is picked in the viewer
+func jobArgs(r JobRecord) map[string]interface{} {
+	args := map[string]interface{}{
+		"file":   r.File,
+		"client": r.Client.Host,
+		"worker": r.Worker.Host,
+		"return": r.Return,
+	}
+
+	if len(r.BuildID) > 0 {
+		args["build"] = r.BuildID
+	}
+
+	return args
+}
+
+// traceLanes packs overlapping intervals into rows, reusing the first row
+// which is free
+type traceLanes struct {
+	ends []time.Time // When the last interval in each row ends
+}
+
+// add returns the row for an interval, they must be added by start time
+func (l *traceLanes) add(start time.Time, end time.Time) int {
+	for i, e := range l.ends {
+		if !e.After(start) {
+			l.ends[i] = end
+			return i
+		}
+	}
+
+	l.ends = append(l.ends, end)
+
+	return len(l.ends) - 1
+}
+
+// WriteTrace writes the jobs as a Chrome trace.  Each host gets a process
+// with a row for each job it requested at once, and if it's a worker a row
+// for each job it compiled at once.  Rows are packed from the job times, so
+// they are the fewest slots which could have built the jobs, not the slots
+// the worker actually used.
+func WriteTrace(w io.Writer, jobs []JobRecord) error {
+	laid := make([]traceJob, len(jobs))
+
+	for i, r := range jobs {
+		laid[i] = layoutJob(r)
+	}
+
+	sort.SliceStable(laid, func(i, j int) bool {
+		return laid[i].start.Before(laid[j].start)
+	})
+
+	// Give each host a process, in name order
+	hosts := make(map[string]int)
+	var names []string
+
+	for _, j := range laid {
+		for _, h := range []string{j.r.Client.Host, j.r.Worker.Host} {
+			if _, ok := hosts[h]; !ok {
+				hosts[h] = 0
+				names = append(names, h)
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	trace := traceFile{
+		TraceEvents:     []traceEvent{},
+		DisplayTimeUnit: "ms",
+		OtherData:       make(map[string]string),
+	}
+
+	for i, h := range names {
+		hosts[h] = i + 1
+
+		trace.TraceEvents = append(trace.TraceEvents, traceEvent{
+			Name: "process_name",
+			Ph:   "M",
+			Pid:  i + 1,
+			Args: map[string]interface{}{"name": h},
+		})
+	}
+
+	if len(laid) == 0 {
+		return json.NewEncoder(w).Encode(trace)
+	}
+
+	// Times are from the start of the first job
+	origin := laid[0].start
+	trace.OtherData["start"] = origin.Format(time.RFC3339Nano)
+
+	micros := func(t time.Time) float64 {
+		return float64(t.Sub(origin).Nanoseconds()) / 1000
+	}
+
+	clients := make(map[string]*traceLanes)
+	slots := make(map[string]*traceLanes)
+	var compiles []traceCompile
+	named := make(map[[2]int]bool)
+
+	// Names a row the first time it's used
+	row := func(pid int, tid int, name string) {
+		if !named[[2]int{pid, tid}] {
+			named[[2]int{pid, tid}] = true
+
+			trace.TraceEvents = append(trace.TraceEvents, traceEvent{
+				Name: "thread_name",
+				Ph:   "M",
+				Pid:  pid,
+				Tid:  tid,
+				Args: map[string]interface{}{"name": name},
+			})
+		}
+	}
+
+	for _, j := range laid {
+		r := j.r
+		local := r.local()
+
+		// The whole job on the client, with each step inside it
+		if clients[r.Client.Host] == nil {
+			clients[r.Client.Host] = new(traceLanes)
+		}
+
+		pid := hosts[r.Client.Host]
+		lane := clients[r.Client.Host].add(j.start, r.Time)
+		row(pid, lane+1, "client "+strconv.Itoa(lane+1))
+
+		trace.TraceEvents = append(trace.TraceEvents, traceEvent{
+			Name: filepath.Base(r.File),
+			Cat:  "job",
+			Ph:   "X",
+			Ts:   micros(j.start),
+			Dur:  micros(r.Time) - micros(j.start),
+			Pid:  pid,
+			Tid:  lane + 1,
+			Args: jobArgs(r),
+		})
+
+		for _, p := range j.phases {
+			trace.TraceEvents = append(trace.TraceEvents, traceEvent{
+				Name: p.name,
+				Cat:  "step",
+				Ph:   "X",
+				Ts:   micros(p.start),
+				Dur:  micros(p.start.Add(p.dur)) - micros(p.start),
+				Pid:  pid,
+				Tid:  lane + 1,
+			})
+
+			// Remote compiles also fill a slot on the worker
+			if p.name == "compile" && !local {
+				compiles = append(compiles, traceCompile{r, p})
+			}
+		}
+	}
+
+	// Compiles don't start in the same order as their jobs, so they are
+	// packed into slots once they are all known
+	sort.SliceStable(compiles, func(i, j int) bool {
+		return compiles[i].p.start.Before(compiles[j].p.start)
+	})
+
+	for _, c := range compiles {
+		host := c.r.Worker.Host
+
+		if slots[host] == nil {
+			slots[host] = new(traceLanes)
+		}
+
+		pid := hosts[host]
+		slot := slots[host].add(c.p.start, c.p.start.Add(c.p.dur))
+		row(pid, traceSlotTid+slot, "slot "+strconv.Itoa(slot+1))
+
+		trace.TraceEvents = append(trace.TraceEvents, traceEvent{
+			Name: filepath.Base(c.r.File),
+			Cat:  "compile",
+			Ph:   "X",
+			Ts:   micros(c.p.start),
+			Dur:  micros(c.p.start.Add(c.p.dur)) - micros(c.p.start),
+			Pid:  pid,
+			Tid:  traceSlotTid + slot,
+			Args: jobArgs(c.r),
+		})
+	}
+
+	return json.NewEncoder(w).Encode(trace)
+}
@@ -0,0 +1,172 @@
+// Tests for the Chrome trace export.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestLayoutJob(t *testing.T) {
+	end := time.Now()
+	second := time.Duration(1) * time.Second
+
+	r := historyRecord(end, "alice", "w1", "src/a.c", 4*second)
+	r.Timing = JobTiming{
+		Preprocess: second,
+		Queue:      second,
+		Compile:    2 * second,
+		CPU:        second,
+		Write:      second,
+	}
+
+	// Steps run back to back up to when the job was reported, skipping
+	// the ones which took no time
+	j := layoutJob(r)
+
+	expected := []tracePhase{
+		{"preprocess", end.Add(-5 * second), second},
+		{"queue", end.Add(-4 * second), second},
+		{"compile", end.Add(-3 * second), 2 * second},
+		{"write", end.Add(-1 * second), second},
+	}
+
+	if len(j.phases) != len(expected) {
+		t.Fatalf("Got %d steps wanted %d", len(j.phases), len(expected))
+	}
+
+	for i, e := range expected {
+		p := j.phases[i]
+
+		if p.name != e.name || !p.start.Equal(e.start) || p.dur != e.dur {
+			t.Errorf("Step %d is %v wanted %v", i, p, e)
+		}
+	}
+
+	if !j.start.Equal(end.Add(-5 * second)) {
+		t.Errorf("Job starts %s before the end", end.Sub(j.start))
+	}
+
+	// Without a breakdown it's all compiling
+	r.Timing = JobTiming{}
+	j = layoutJob(r)
+
+	if len(j.phases) != 1 || j.phases[0].name != "compile" ||
+		!j.start.Equal(end.Add(-4*second)) {
+		t.Errorf("Wrong layout without timing: %v", j.phases)
+	}
+}
+
+func TestTraceLanes(t *testing.T) {
+	start := time.Now()
+	at := func(s int) time.Time {
+		return start.Add(time.Duration(s) * time.Second)
+	}
+
+	var l traceLanes
+
+	// Overlapping intervals get their own row, later ones reuse free rows
+	rows := []int{
+		l.add(at(0), at(2)),
+		l.add(at(1), at(3)),
+		l.add(at(2), at(4)),
+		l.add(at(2), at(5)),
+		l.add(at(4), at(5)),
+	}
+
+	expected := []int{0, 1, 0, 2, 0}
+
+	for i, e := range expected {
+		if rows[i] != e {
+			t.Errorf("Interval %d in row %d wanted %d", i, rows[i], e)
+		}
+	}
+}
+
+func TestWriteTrace(t *testing.T) {
+	end := time.Now()
+	second := time.Duration(1) * time.Second
+
+	// Two remote jobs at once on the same worker and one built locally
+	jobs := []JobRecord{
+		historyRecord(end, "alice", "w1", "src/a.c", 2*second),
+		historyRecord(end, "alice", "w1", "src/b.c", 2*second),
+		historyRecord(end.Add(second), "alice", "alice", "src/c.c", second),
+	}
+
+	jobs[0].BuildID = "b1"
+
+	var buf bytes.Buffer
+
+	if err := WriteTrace(&buf, jobs); err != nil {
+		t.Fatal("Write error: ", err)
+	}
+
+	var trace traceFile
+
+	if err := json.Unmarshal(buf.Bytes(), &trace); err != nil {
+		t.Fatal("Trace isn't valid JSON: ", err)
+	}
+
+	processes := make(map[int]string)
+	threads := make(map[[2]int]string)
+	slices := make(map[string][]traceEvent)
+
+	for _, e := range trace.TraceEvents {
+		switch {
+		case e.Name == "process_name":
+			processes[e.Pid] = e.Args["name"].(string)
+		case e.Name == "thread_name":
+			threads[[2]int{e.Pid, e.Tid}] = e.Args["name"].(string)
+		default:
+			slices[e.Cat] = append(slices[e.Cat], e)
+		}
+	}
+
+	// alice sorts before w1
+	if len(processes) != 2 || processes[1] != "alice" || processes[2] != "w1" {
+		t.Errorf("Wrong processes: %v", processes)
+	}
+
+	// Both remote jobs overlap, so alice needs two client rows and w1 two
+	// slots, the local job reuses the first client row
+	want := map[[2]int]string{
+		{1, 1}:                "client 1",
+		{1, 2}:                "client 2",
+		{2, traceSlotTid}:     "slot 1",
+		{2, traceSlotTid + 1}: "slot 2",
+	}
+
+	if len(threads) != len(want) {
+		t.Errorf("Got threads %v wanted %v", threads, want)
+	}
+
+	for k, v := range want {
+		if threads[k] != v {
+			t.Errorf("Thread %v is %q wanted %q", k, threads[k], v)
+		}
+	}
+
+	if len(slices["job"]) != 3 || len(slices["step"]) != 3 ||
+		len(slices["compile"]) != 2 {
+		t.Fatalf("Wrong slices: %d jobs %d steps %d compiles",
+			len(slices["job"]), len(slices["step"]), len(slices["compile"]))
+	}
+
+	// Times are in microseconds from the first job
+	first := slices["job"][0]
+
+	if first.Ts != 0 || first.Dur != 2e6 || first.Args["build"] != "b1" {
+		t.Errorf("Wrong first job: %+v", first)
+	}
+
+	last := slices["job"][2]
+
+	if last.Name != "c.c" || last.Ts != 2e6 || last.Tid != 1 {
+		t.Errorf("Wrong local job: %+v", last)
+	}
+}
@@ -0,0 +1,426 @@
+// The full screen view of "cbd monitor", redrawn in place with plain ANSI
+// escape codes: workers with their slots and running files, the queue, a
+// chart of recent throughput, and the latest jobs.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// How often the full screen view is redrawn
+var screenRefresh = time.Duration(500) * time.Millisecond
+
+// Seconds of throughput kept for the chart
+const throughputSeconds = 60
+
+// Lines of recent jobs and events kept for the bottom of the screen
+const recentLines = 50
+
+// Jobs we hear nothing about for this long are assumed lost
+var staleJob = time.Duration(10) * time.Minute
+
+// Characters used to draw the throughput chart, from empty to full
+var sparkLevels = []rune(" ▁▂▃▄▅▆▇█")
+
+// Terminal escape codes
+const (
+	escAltScreen  = "\x1b[?1049h" // Switch to the alternate screen
+	escMainScreen = "\x1b[?1049l" // Back to the main screen
+	escHideCursor = "\x1b[?25l"
+	escShowCursor = "\x1b[?25h"
+	escHome       = "\x1b[H"  // Move the cursor to the top left
+	escClearLine  = "\x1b[K"  // Clear to the end of the line
+	escClearDown  = "\x1b[J"  // Clear to the end of the screen
+	escBold       = "\x1b[1m" // Start bold text
+	escReset      = "\x1b[0m" // Back to normal text
+)
+
+// winsize is the terminal size returned by the TIOCGWINSZ ioctl
+type winsize struct {
+	rows, cols, xpixel, ypixel uint16
+}
+
+// terminalSize returns the size of the terminal, ok is false if the file
+// isn't one
+func terminalSize(f *os.File) (width int, height int, ok bool) {
+	var ws winsize
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(),
+		uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+
+	if errno != 0 || ws.cols == 0 || ws.rows == 0 {
+		return 0, 0, false
+	}
+
+	return int(ws.cols), int(ws.rows), true
+}
+
+// IsTerminal returns true if the file is a terminal we can draw on
+func IsTerminal(f *os.File) bool {
+	_, _, ok := terminalSize(f)
+	return ok
+}
+
+// monitorView is everything the full screen view shows, built up from the
+// updates the server sends monitors
+type monitorView struct {
+	workers   []WorkerState // Latest state of every worker
+	queue     QueueState    // Latest queue of every client
+	completed []time.Time   // When recent jobs completed, for the chart
+	recent    []string      // Latest jobs and events, oldest first
+
+	// Latest step of each job in progress, timed by when we saw it
+	jobs map[GUID]JobEvent
+}
+
+// update takes in one message from the server
+func (v *monitorView) update(msg interface{}, now time.Time) {
+	switch m := msg.(type) {
+	case WorkerStateList:
+		v.workers = m.Workers
+
+		sort.Sort(byHost(v.workers))
+	case QueueState:
+		v.queue = m
+	case CompletedJob:
+		v.completed = append(v.completed, now)
+
+		status := ""
+
+		if m.Return != 0 {
+			status = fmt.Sprintf(" (failed: %d)", m.Return)
+		}
+
+		v.addRecent(fmt.Sprintf("%s %s -> %s %s %.3fs%s",
+			now.Format("15:04:05"), m.Client.Host, m.Worker.Host, m.File,
+			m.CompileTime.Seconds(), status))
+	case WorkerEvent:
+		line := fmt.Sprintf("%s worker %s %s", m.Time.Format("15:04:05"),
+			m.Worker.Host, m.Type)
+
+		if len(m.Reason) > 0 {
+			line += ": " + m.Reason
+		}
+
+		v.addRecent(line)
+	case MissedUpdates:
+		v.addRecent(fmt.Sprintf("%s missed %d updates", now.Format("15:04:05"),
+			m.Count))
+	case JobEvent:
+		if v.jobs == nil {
+			v.jobs = make(map[GUID]JobEvent)
+		}
+
+		switch m.Type {
+		case JobDone:
+			delete(v.jobs, m.ID)
+		case JobFailed:
+			delete(v.jobs, m.ID)
+
+			v.addRecent(fmt.Sprintf("%s %s -> %s %s failed: %s",
+				now.Format("15:04:05"), m.Client.Host, m.Worker.Host, m.File,
+				m.Reason))
+		default:
+			m.Time = now
+			v.jobs[m.ID] = m
+		}
+	}
+
+	// Forget jobs we have stopped hearing about
+	for id, e := range v.jobs {
+		if now.Sub(e.Time) > staleJob {
+			delete(v.jobs, id)
+		}
+	}
+
+	// Forget completions too old to chart
+	cutoff := now.Add(-throughputSeconds * time.Second)
+
+	for len(v.completed) > 0 && v.completed[0].Before(cutoff) {
+		v.completed = v.completed[1:]
+	}
+}
+
+// addRecent adds a line to the bottom of the recent list
+func (v *monitorView) addRecent(line string) {
+	v.recent = append(v.recent, line)
+
+	if len(v.recent) > recentLines {
+		v.recent = v.recent[len(v.recent)-recentLines:]
+	}
+}
+
+// throughput returns the jobs completed in each of the last n seconds,
+// oldest first
+func (v *monitorView) throughput(now time.Time, n int) []int {
+	counts := make([]int, n)
+
+	for _, t := range v.completed {
+		age := int(now.Sub(t) / time.Second)
+
+		if age >= 0 && age < n {
+			counts[n-1-age]++
+		}
+	}
+
+	return counts
+}
+
+// render draws the view as lines fitting the given screen size
+func (v *monitorView) render(width int, height int, now time.Time) []string {
+	var lines []string
+
+	// Summary of the whole cluster
+	load, capacity, queued := 0, 0, 0
+
+	for _, ws := range v.workers {
+		load += ws.Load
+		capacity += ws.Capacity
+	}
+
+	for _, c := range v.queue.Clients {
+		queued += c.Queued
+	}
+
+	chartWidth := width - 12
+
+	if chartWidth > throughputSeconds {
+		chartWidth = throughputSeconds
+	}
+
+	if chartWidth < 1 {
+		chartWidth = 1
+	}
+
+	counts := v.throughput(now, chartWidth)
+	total := 0
+
+	for _, c := range counts {
+		total += c
+	}
+
+	lines = append(lines,
+		fmt.Sprintf("%scbd monitor%s  workers: %d  slots: %d/%d  queued: %d  "+
+			"jobs/s: %.1f  %s", escBold, escReset, len(v.workers), load,
+			capacity, queued, float64(total)/float64(chartWidth),
+			now.Format("15:04:05")),
+		"")
+
+	// Workers with a bar showing each of their slots
+	lines = append(lines, escBold+fmt.Sprintf("%-16s %-18s %6s %5s  %s",
+		"Worker", "Slots", "Speed", "Queue", "Compiling")+escReset)
+
+	// What each worker's jobs are up to, when we know
+	steps := make(map[string][]string)
+
+	for _, e := range v.jobs {
+		if len(e.Worker.Host) > 0 {
+			steps[e.Worker.Host] = append(steps[e.Worker.Host],
+				fmt.Sprintf("%s(%s)", e.File, e.Type))
+		}
+	}
+
+	for _, ws := range v.workers {
+		host := ws.Host
+		files := ws.Files
+
+		if s, ok := steps[ws.Host]; ok {
+			sort.Strings(s)
+			files = s
+		}
+
+		if ws.Suspect {
+			host += "?"
+		} else if ws.Draining {
+			host += "-"
+		}
+
+		lines = append(lines, fmt.Sprintf("%-16s %-18s %6.2f %5d  %s",
+			truncate(host, 16), slotBar(ws.Load, ws.Capacity, 16), ws.Speed,
+			ws.Queued, strings.Join(files, " ")))
+	}
+
+	// Clients with work outstanding
+	if len(v.queue.Clients) > 0 {
+		var clients []string
+
+		for _, c := range v.queue.Clients {
+			clients = append(clients, fmt.Sprintf("%s %d/%d", c.Client,
+				c.Queued, c.Running))
+		}
+
+		lines = append(lines, "", "Queued/running: "+strings.Join(clients, "  "))
+	}
+
+	// Throughput over the last minute
+	lines = append(lines, "", fmt.Sprintf("Jobs/s %s last %ds",
+		sparkline(counts), chartWidth))
+
+	// Fill what's left with the latest jobs
+	lines = append(lines, "")
+
+	room := height - len(lines)
+
+	if room > 0 {
+		recent := v.recent
+
+		if len(recent) > room {
+			recent = recent[len(recent)-room:]
+		}
+
+		lines = append(lines, recent...)
+	}
+
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+
+	for i, line := range lines {
+		lines[i] = truncate(line, width)
+	}
+
+	return lines
+}
+
+// slotBar draws a bar with a # for each busy slot and a . for each free one,
+// squeezed down to at most max slots
+func slotBar(load int, capacity int, max int) string {
+	if capacity > max {
+		load = (load*max + capacity - 1) / capacity
+		capacity = max
+	}
+
+	if load > capacity {
+		load = capacity
+	}
+
+	if load < 0 {
+		load = 0
+	}
+
+	return "[" + strings.Repeat("#", load) +
+		strings.Repeat(".", capacity-load) + "]"
+}
+
+// sparkline draws the counts as a row of bars scaled to the largest
+func sparkline(counts []int) string {
+	max := 0
+
+	for _, c := range counts {
+		if c > max {
+			max = c
+		}
+	}
+
+	top := len(sparkLevels) - 1
+	chart := make([]rune, len(counts))
+
+	for i, c := range counts {
+		level := 0
+
+		if max > 0 {
+			level = (c*top + max - 1) / max
+		}
+
+		chart[i] = sparkLevels[level]
+	}
+
+	return string(chart)
+}
+
+// truncate cuts the string down to n characters, escape codes aside
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	shown := 0
+
+	for i := 0; i < len(runes); i++ {
+		// Escape codes take up no room
+		if runes[i] == '\x1b' {
+			for i < len(runes) && runes[i] != 'm' {
+				i++
+			}
+			continue
+		}
+
+		shown++
+
+		if shown > n {
+			return string(runes[:i]) + escReset
+		}
+	}
+
+	return s
+}
+
+// byHost sorts workers by host name
+type byHost []WorkerState
+
+func (a byHost) Len() int           { return len(a) }
+func (a byHost) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byHost) Less(i, j int) bool { return a[i].Host < a[j].Host }
+
+// FullScreenReport shows the state of the cluster on the terminal, redrawn
+// in place, until the context is canceled or the connection drops
+func (m *Monitor) FullScreenReport(ctx context.Context) error {
+	if m.mc == nil {
+		err := m.Connect()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	out := os.Stdout
+
+	fmt.Fprint(out, escAltScreen+escHideCursor)
+	defer fmt.Fprint(out, escShowCursor+escMainScreen)
+
+	// Read from the server in the background so we can redraw as we wait
+	stop := make(chan struct{})
+	defer close(stop)
+
+	msgs, errs := m.readUpdates(stop)
+
+	ticker := time.NewTicker(screenRefresh)
+	defer ticker.Stop()
+
+	var v monitorView
+
+	for {
+		select {
+		case msg := <-msgs:
+			v.update(msg, time.Now())
+			continue
+		case err := <-errs:
+			m.mc = nil
+			return err
+		case <-ctx.Done():
+			// Closing the connection ends the reader
+			m.mc.Close()
+			m.mc = nil
+			return nil
+		case <-ticker.C:
+		}
+
+		width, height, ok := terminalSize(out)
+
+		if !ok {
+			width, height = 80, 24
+		}
+
+		lines := v.render(width, height, time.Now())
+
+		fmt.Fprint(out, escHome+strings.Join(lines, escClearLine+"\r\n")+
+			escClearLine+escClearDown)
+	}
+}
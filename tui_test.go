@@ -0,0 +1,200 @@
+// Tests for the full screen monitor view.
+//
+// Author: Joseph Lisee <jlisee@gmail.com>
+
+package cbd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlotBar(t *testing.T) {
+	tests := []struct {
+		load     int
+		capacity int
+		expected string
+	}{
+		{0, 4, "[....]"},
+		{3, 4, "[###.]"},
+		{6, 4, "[####]"},
+		{1, 16, "[#.......]"},
+		{16, 16, "[########]"},
+	}
+
+	for _, test := range tests {
+		bar := slotBar(test.load, test.capacity, 8)
+
+		if bar != test.expected {
+			t.Errorf("Load %d/%d got: %s wanted: %s", test.load, test.capacity,
+				bar, test.expected)
+		}
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	chart := sparkline([]int{0, 1, 2, 4, 8})
+
+	if chart != " ▁▂▄█" {
+		t.Errorf("Got: %q", chart)
+	}
+
+	chart = sparkline([]int{0, 0})
+
+	if chart != "  " {
+		t.Errorf("Empty chart got: %q", chart)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	if s := truncate("abcdef", 4); s != "abcd"+escReset {
+		t.Errorf("Got: %q", s)
+	}
+
+	if s := truncate("abc", 4); s != "abc" {
+		t.Errorf("Short string changed: %q", s)
+	}
+
+	// Escape codes don't count against the width
+	s := escBold + "ab" + escReset + "cd"
+
+	if truncate(s, 4) != s {
+		t.Errorf("Escaped string changed: %q", truncate(s, 4))
+	}
+}
+
+func TestMonitorViewThroughput(t *testing.T) {
+	var v monitorView
+	now := time.Now()
+
+	v.update(CompletedJob{}, now.Add(-90*time.Second))
+	v.update(CompletedJob{}, now.Add(-2500*time.Millisecond))
+	v.update(CompletedJob{}, now.Add(-100*time.Millisecond))
+	v.update(CompletedJob{}, now)
+
+	// The first job is too old to keep
+	if len(v.completed) != 3 {
+		t.Errorf("Kept %d completions, wanted 3", len(v.completed))
+	}
+
+	counts := v.throughput(now, 4)
+	expected := []int{0, 1, 0, 2}
+
+	for i := range expected {
+		if counts[i] != expected[i] {
+			t.Errorf("Got: %v wanted: %v", counts, expected)
+			break
+		}
+	}
+}
+
+func TestMonitorViewRender(t *testing.T) {
+	var v monitorView
+	now := time.Now()
+
+	v.update(WorkerStateList{Workers: []WorkerState{
+		{Host: "zeta", Capacity: 2, Load: 1, Speed: 1, Files: []string{"b.c"}},
+		{Host: "alpha", Capacity: 4, Load: 2, Speed: 1.5,
+			Files: []string{"a.c", "main.cpp"}, Suspect: true},
+	}}, now)
+
+	v.update(QueueState{Clients: []ClientQueue{
+		{Client: "laptop", Queued: 3, Running: 2},
+	}}, now)
+
+	v.update(CompletedJob{
+		Client:      MachineName{Host: "laptop"},
+		Worker:      MachineName{Host: "zeta"},
+		File:        "util.c",
+		CompileTime: 1500 * time.Millisecond,
+		Return:      1,
+	}, now)
+
+	v.update(WorkerEvent{
+		Type:   WorkerSuspect,
+		Worker: MachineName{Host: "alpha"},
+		Time:   now,
+	}, now)
+
+	lines := v.render(100, 40, now)
+	screen := strings.Join(lines, "\n")
+
+	for _, part := range []string{
+		"workers: 2  slots: 3/6  queued: 3",
+		"alpha?",
+		"[##..]",
+		"a.c main.cpp",
+		"[#.]",
+		"laptop 3/2",
+		"laptop -> zeta util.c 1.500s (failed: 1)",
+		"worker alpha suspect",
+	} {
+		if !strings.Contains(screen, part) {
+			t.Errorf("Screen missing %q:\n%s", part, screen)
+		}
+	}
+
+	// Workers are sorted by host
+	if strings.Index(screen, "alpha") > strings.Index(screen, "zeta") {
+		t.Errorf("Workers out of order:\n%s", screen)
+	}
+
+	// Everything fits on a small screen
+	lines = v.render(20, 5, now)
+
+	if len(lines) > 5 {
+		t.Errorf("Got %d lines for a 5 line screen", len(lines))
+	}
+
+	for _, line := range lines {
+		if len([]rune(line)) > 20+len(escBold)+2*len(escReset) {
+			t.Errorf("Line too long: %q", line)
+		}
+	}
+}
+
+func TestMonitorViewJobEvents(t *testing.T) {
+	var v monitorView
+	now := time.Now()
+
+	v.update(WorkerStateList{Workers: []WorkerState{
+		{Host: "w1", Capacity: 2, Load: 2, Files: []string{"a.c", "b.c"}},
+	}}, now)
+
+	a := JobEvent{ID: NewGUID(), Type: JobCompileStart, File: "a.c",
+		Worker: MachineName{Host: "w1"}}
+	b := JobEvent{ID: NewGUID(), Type: JobUploadStart, File: "b.c",
+		Worker: MachineName{Host: "w1"}}
+
+	v.update(a, now)
+	v.update(b, now)
+
+	screen := strings.Join(v.render(100, 20, now), "\n")
+
+	if !strings.Contains(screen, "a.c(compile-start) b.c(upload-start)") {
+		t.Errorf("Missing job steps:\n%s", screen)
+	}
+
+	// Finished jobs drop off, failures are listed
+	v.update(a.step(JobDone, ""), now)
+	v.update(b.step(JobFailed, "worker busy"), now)
+
+	if len(v.jobs) != 0 {
+		t.Errorf("Jobs left over: %v", v.jobs)
+	}
+
+	screen = strings.Join(v.render(100, 20, now), "\n")
+
+	if !strings.Contains(screen, "b.c failed: worker busy") {
+		t.Errorf("Missing failure:\n%s", screen)
+	}
+
+	// Jobs we stop hearing about are forgotten
+	v.update(a, now)
+	v.update(QueueState{}, now.Add(staleJob+time.Second))
+
+	if len(v.jobs) != 0 {
+		t.Errorf("Stale job kept: %v", v.jobs)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -23,6 +24,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 // String that unique identifies a machine
@@ -66,8 +68,9 @@ func GetMachineID() (m MachineID, err error) {
 
 // The result of running a command
 type ExecResult struct {
-	Output []byte // Output of the command
-	Return int    // Return code of program
+	Output  []byte        // Output of the command
+	Return  int           // Return code of program
+	CPUTime time.Duration // User and system CPU time the program used
 }
 
 // Executes, returning the stdout if the program fails (the return code is
@@ -93,6 +96,11 @@ func RunCmd(prog string, args []string) (result ExecResult, err error) {
 	// Copy over our buffer
 	result.Output = buffer.Bytes()
 
+	if cmd.ProcessState != nil {
+		result.CPUTime = cmd.ProcessState.UserTime() +
+			cmd.ProcessState.SystemTime()
+	}
+
 	// Get the return code out of the error
 	if err != nil {
 		result.Return = -1
@@ -188,6 +196,35 @@ func GetLoadAverage() (float64, error) {
 	return load, nil
 }
 
+// GetFreeMemory returns the bytes of memory available for new processes
+// TODO: linux only, support more of unix with sysctl
+func GetFreeMemory() (uint64, error) {
+	d, err := ioutil.ReadFile("/proc/meminfo")
+
+	if err != nil {
+		return 0, err
+	}
+
+	// Lines are of the form "MemAvailable:   12345 kB"
+	for _, line := range strings.Split(string(d), "\n") {
+		fields := strings.Fields(line)
+
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+
+		if err != nil {
+			return 0, err
+		}
+
+		return kb * 1024, nil
+	}
+
+	return 0, fmt.Errorf("Could not find MemAvailable in /proc/meminfo")
+}
+
 // Make this log statement only when debugging logging is on
 func DebugPrint(v ...interface{}) {
 	if DebugLogging {
@@ -227,3 +264,52 @@ func NewGUID() GUID {
 func (g *GUID) String() string {
 	return fmt.Sprintf("%x-%x-%x-%x-%x", g[0:4], g[4:6], g[6:8], g[8:10], g[10:])
 }
+
+// MarshalText writes the GUID in its string form, so it reads the same in
+// every JSON output
+func (g GUID) MarshalText() ([]byte, error) {
+	return []byte(g.String()), nil
+}
+
+// UnmarshalText parses the string form of a GUID
+func (g *GUID) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(strings.Replace(string(text), "-", "", -1))
+
+	if err != nil || len(b) != len(g) {
+		return fmt.Errorf("Invalid GUID: %q", text)
+	}
+
+	copy(g[:], b)
+
+	return nil
+}
+
+// UnmarshalJSON reads a GUID in its string form, or as the array of bytes
+// older job histories have
+func (g *GUID) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '[' {
+		return json.Unmarshal(data, (*[16]byte)(g))
+	}
+
+	var s string
+
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	return g.UnmarshalText([]byte(s))
+}
+
+// SplitList splits a comma separated list, like the servers in CBD_SERVER,
+// trimming space and dropping any empty entries
+func SplitList(str string) []string {
+	var l []string
+
+	for _, s := range strings.Split(str, ",") {
+		if s = strings.TrimSpace(s); len(s) > 0 {
+			l = append(l, s)
+		}
+	}
+
+	return l
+}
@@ -2,8 +2,10 @@ package cbd
 
 import (
 	"bytes"
+	"encoding/json"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
 	"testing"
@@ -99,6 +101,19 @@ func TestGetLoadAverage(t *testing.T) {
 	}
 }
 
+func TestGetFreeMemory(t *testing.T) {
+	mem, err := GetFreeMemory()
+
+	if err != nil {
+		t.Error("Error: ", err)
+		return
+	}
+
+	if mem == 0 {
+		t.Error("Free memory bad: ", mem)
+	}
+}
+
 func TestGUID(t *testing.T) {
 	g1 := NewGUID()
 	g2 := NewGUID()
@@ -113,4 +128,39 @@ func TestGUID(t *testing.T) {
 	if s1 == s2 {
 		t.Error("GUIDs match but should be different: ", s1, s2)
 	}
+
+	// JSON has the string form, and reads back either that or the bytes
+	data, err := json.Marshal(g1)
+
+	if err != nil || string(data) != `"`+s1+`"` {
+		t.Errorf("GUID marshalled to %s: %v", data, err)
+	}
+
+	var g GUID
+
+	if err = json.Unmarshal(data, &g); err != nil || g != g1 {
+		t.Errorf("Read back %s wanted %s: %v", g.String(), s1, err)
+	}
+
+	data, _ = json.Marshal([16]byte(g2))
+
+	if err = json.Unmarshal(data, &g); err != nil || g != g2 {
+		t.Errorf("Read back %s wanted %s: %v", g.String(), s2, err)
+	}
+
+	if err = json.Unmarshal([]byte(`"not-a-guid"`), &g); err == nil {
+		t.Error("Expected an error reading a bad GUID")
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	l := SplitList(" main:18000, ,standby ")
+
+	if !reflect.DeepEqual(l, []string{"main:18000", "standby"}) {
+		t.Error("Bad list: ", l)
+	}
+
+	if l = SplitList(""); len(l) != 0 {
+		t.Error("Expected an empty list: ", l)
+	}
 }
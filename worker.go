@@ -5,29 +5,78 @@
 package cbd
 
 import (
+	"context"
+	"fmt"
 	"log"
-	"math"
 	"net"
 	"os"
-	"runtime"
+	"reflect"
+	"sync"
 	"time"
 )
 
+// How often the worker sends its state when nothing has changed
+var workerHeartbeat = time.Duration(5) * time.Second
+
+// How often a draining worker checks if its jobs have finished
+var drainPoll = time.Duration(250) * time.Millisecond
+
+// How long a drained worker waits for jobs the server handed out just before
+// it heard we were draining
+var drainGrace = time.Duration(1) * time.Second
+
+// Job events buffered for each server before we start dropping them
+const jobEventBuffer = 64
+
 type Worker struct {
-	port  int       // Port we listen for connections on
-	saddr string    // Port of the server (if it exists)
-	run   bool      // Should the update loop keep running?
-	id    MachineID // The ID of this worker
+	port      int            // Port we listen for connections on
+	saddr     string         // Port of the server (if it exists)
+	run       bool           // Should the update loop keep running?
+	id        MachineID      // The ID of this worker
+	jobs      int            // Max number of compile jobs to run at once
+	maxQueue  int            // Max number of jobs waiting for a free slot
+	bench     float64        // KB per CPU second of the startup benchmark
+	compilers []CompilerInfo // Compilers found on our PATH
+
+	jmutex   *sync.Mutex // Protects the job counts
+	running  int         // Compile jobs currently running
+	queued   int         // Jobs accepted but not yet compiling
+	draining bool        // No new jobs wanted, stop once idle
+	slots    chan bool   // Holds one entry for each running job
+	files    []string    // Source files of the running jobs
+
+	// Each state sender gets a channel signaled when the job counts change,
+	// and one to pass the events of our jobs along on
+	watchers  map[chan bool]bool
+	listeners map[chan JobEvent]bool
+
+	ln   net.Listener // Where we accept jobs, closed once drained
+	done chan bool    // Closed once the server has our final state
+
+	metrics *workerMetrics // Counts for /metrics
 }
 
 // NewWorker initializes a Worker struct based on the given server and
 // local address.  The local address will be parsed to determine our
-// local port for receiving connections.
-func NewWorker(port int, saddr string) (w *Worker, err error) {
+// local port for receiving connections.  At most jobs compiles are run at
+// once, with an equal number allowed to wait for a free slot.
+func NewWorker(port int, saddr string, jobs int) (w *Worker, err error) {
+	if jobs < 1 {
+		return nil, fmt.Errorf("Worker needs at least one job slot, got: %d", jobs)
+	}
+
 	w = new(Worker)
 	w.saddr = saddr
 	w.run = true
 	w.port = port
+	w.jobs = jobs
+	w.maxQueue = jobs
+	w.jmutex = new(sync.Mutex)
+	w.slots = make(chan bool, jobs)
+	w.watchers = make(map[chan bool]bool)
+	w.listeners = make(map[chan JobEvent]bool)
+	w.done = make(chan bool)
+	w.metrics = newWorkerMetrics()
 	w.id, err = GetMachineID()
 
 	return w, err
@@ -35,8 +84,10 @@ func NewWorker(port int, saddr string) (w *Worker, err error) {
 
 // Serve listens for incoming build requests connections and spawns
 // goroutines to handle them as needed.  If we have a server address
-// it will send status updates there as well.
-func (w *Worker) Serve(ln net.Listener) error {
+// it will send status updates there as well.  It returns once the worker
+// has been drained or the context is canceled, after the jobs in flight
+// are finished and the server has been sent our final state.
+func (w *Worker) Serve(ctx context.Context, ln net.Listener) error {
 	// Get IP addresses on the machine
 	addrs, err := getLocalIPAddrs()
 
@@ -44,38 +95,203 @@ func (w *Worker) Serve(ln net.Listener) error {
 		return err
 	}
 
+	w.jmutex.Lock()
+	w.ln = ln
+	w.jmutex.Unlock()
+
+	// Give the server an idea how fast we are before we've done any jobs
+	w.bench = runBenchmark(benchmarkCompiler)
+	w.compilers = findCompilers(knownCompilers)
+
 	// Start update goroutine if present
 	go w.updateServer(addrs)
 
+	// Shut down when we are canceled
+	stopped := make(chan bool)
+	defer close(stopped)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Stop getting jobs while we finish the ones we have
+			w.jmutex.Lock()
+			w.draining = true
+			w.jmutex.Unlock()
+
+			w.notifyChanged()
+			ln.Close()
+		case <-stopped:
+		}
+	}()
+
+	// Tracks the jobs in flight
+	var jobs sync.WaitGroup
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if w.stopped() || ctx.Err() != nil {
+				break
+			}
+
 			log.Print(err)
 			continue
 		}
-		go w.handleRequest(conn)
+
+		jobs.Add(1)
+
+		go func() {
+			defer jobs.Done()
+			w.handleRequest(conn)
+			conn.Close()
+		}()
 	}
+
+	log.Print("Worker shutting down...")
+
+	jobs.Wait()
+
+	// Make sure the server has had our last update
+	w.stop()
+	w.notifyChanged()
+
+	select {
+	case <-w.done:
+	case <-time.After(workerHeartbeat):
+		log.Print("Timed out sending final state to server")
+	}
+
+	return nil
+}
+
+// Drain tells the server to stop sending us jobs, and once the jobs we have
+// are finished and the server has been told we are leaving, Serve returns.
+func (w *Worker) Drain() {
+	w.jmutex.Lock()
+	already := w.draining
+	w.draining = true
+	w.jmutex.Unlock()
+
+	if already {
+		return
+	}
+
+	log.Print("Draining worker...")
+
+	w.notifyChanged()
+
+	go w.finishDrain()
+}
+
+// finishDrain waits for the worker to go idle then shuts it down
+func (w *Worker) finishDrain() {
+	// Wait until we have no jobs, and haven't been handed any for a bit
+	for idle := time.Duration(0); idle < drainGrace; {
+		time.Sleep(drainPoll)
+
+		running, queued := w.jobCounts()
+
+		if running+queued > 0 {
+			idle = 0
+		} else {
+			idle += drainPoll
+		}
+	}
+
+	log.Print("Worker drained")
+
+	// Send our final state then wait for the server to have it
+	w.stop()
+	w.notifyChanged()
+
+	select {
+	case <-w.done:
+	case <-time.After(workerHeartbeat):
+		log.Print("Timed out waiting to deregister from server")
+	}
+
+	w.jmutex.Lock()
+	ln := w.ln
+	w.jmutex.Unlock()
+
+	if ln != nil {
+		ln.Close()
+	}
+}
+
+// stop ends the update loop after it sends one more update
+func (w *Worker) stop() {
+	w.jmutex.Lock()
+	w.run = false
+	w.jmutex.Unlock()
+}
+
+// stopped returns true once the worker is shutting down
+func (w *Worker) stopped() bool {
+	w.jmutex.Lock()
+	defer w.jmutex.Unlock()
+
+	return !w.run
 }
 
 func (w *Worker) handleRequest(conn DeadlineReadWriter) {
 	log.Print("Handling request...")
 
+	// Claim a spot in our queue before reading in the job
+	admitted := w.reserve()
+
 	// Decode the CompileJob
 	mc := NewMessageConn(conn, time.Duration(10)*time.Second)
 	job, err := mc.ReadCompileJob()
 
 	if err != nil {
 		log.Print("Decode error:", err)
+		w.unreserve(admitted)
+		return
+	}
+
+	// When full up let the client know so it can go elsewhere
+	if !admitted {
+		log.Print("Rejecting job, worker busy")
+		w.metrics.rejected.add(1)
+
+		err = mc.Send(CompileResult{Busy: true})
+
+		if err != nil {
+			log.Print("Encode error:", err)
+		}
 		return
 	}
 
 	// Build the code
 	if err = job.Validate(); err != nil {
 		log.Print("Invalid job: ", err)
+		w.unreserve(admitted)
 		return
 	}
 
+	// Wait for a free slot then build
+	queued := time.Now()
+	w.startJob(job.Build.Input())
+	w.publishJobEvent(job, JobCompileStart)
+	started := time.Now()
 	cresults, _ := job.Compile()
+	w.finishJob(job.Build.Input())
+	w.publishJobEvent(job, JobCompileEnd)
+
+	cresults.Timing.Queue = started.Sub(queued)
+	cresults.Timing.Compile = time.Since(started)
+	cresults.Timing.CPU = cresults.CPUTime
+
+	w.metrics.jobs.add(1)
+	w.metrics.receivedBytes.add(float64(len(job.Input)))
+	w.metrics.sentBytes.add(float64(len(cresults.ObjectCode)))
+	w.metrics.queueWait.observe(cresults.Timing.Queue.Seconds())
+	w.metrics.compileTime.observe(cresults.Timing.Compile.Seconds())
+
+	if cresults.Return != 0 {
+		w.metrics.failed.add(1)
+	}
 
 	// Send back the result
 	err = mc.Send(cresults)
@@ -88,12 +304,173 @@ func (w *Worker) handleRequest(conn DeadlineReadWriter) {
 	log.Print("Done.")
 }
 
-// updateServer will do it's best to maintain a connection to the main
-// server, and send it WorkerState updates
-func (w *Worker) updateServer(addrs []net.IPNet) {
-	// How often we try to establish a connection
-	interval := time.Duration(1) * time.Second
+// reserve claims a place in the job queue, returning false if the worker
+// already has a full queue
+func (w *Worker) reserve() bool {
+	w.jmutex.Lock()
+	ok := w.running+w.queued < w.jobs+w.maxQueue
+
+	if ok {
+		w.queued++
+	}
+	w.jmutex.Unlock()
+
+	if ok {
+		w.notifyChanged()
+	}
+
+	return ok
+}
+
+// unreserve gives back a queue place claimed by reserve, if there was one
+func (w *Worker) unreserve(reserved bool) {
+	if !reserved {
+		return
+	}
+
+	w.jmutex.Lock()
+	w.queued--
+	w.jmutex.Unlock()
+
+	w.notifyChanged()
+}
+
+// startJob blocks until a job slot is free then moves a queued job, which
+// compiles the given file, into it
+func (w *Worker) startJob(file string) {
+	w.slots <- true
+
+	w.jmutex.Lock()
+	w.queued--
+	w.running++
+	w.files = append(w.files, file)
+	w.jmutex.Unlock()
+
+	w.notifyChanged()
+}
+
+// finishJob frees up the slot taken by startJob for the file
+func (w *Worker) finishJob(file string) {
+	w.jmutex.Lock()
+	w.running--
+
+	for i, f := range w.files {
+		if f == file {
+			w.files = append(w.files[:i], w.files[i+1:]...)
+			break
+		}
+	}
+	w.jmutex.Unlock()
+
+	<-w.slots
+
+	w.notifyChanged()
+}
+
+// notifyChanged wakes up the state senders without ever blocking, a pending
+// notification already covers this change
+func (w *Worker) notifyChanged() {
+	w.jmutex.Lock()
+	defer w.jmutex.Unlock()
 
+	for ch := range w.watchers {
+		select {
+		case ch <- true:
+		default:
+		}
+	}
+}
+
+// watch returns a channel signaled whenever the job counts change
+func (w *Worker) watch() chan bool {
+	ch := make(chan bool, 1)
+
+	w.jmutex.Lock()
+	w.watchers[ch] = true
+	w.jmutex.Unlock()
+
+	return ch
+}
+
+// unwatch stops signaling a channel from watch
+func (w *Worker) unwatch(ch chan bool) {
+	w.jmutex.Lock()
+	delete(w.watchers, ch)
+	w.jmutex.Unlock()
+}
+
+// listen returns a channel which gets the events of our jobs
+func (w *Worker) listen() chan JobEvent {
+	ch := make(chan JobEvent, jobEventBuffer)
+
+	w.jmutex.Lock()
+	w.listeners[ch] = true
+	w.jmutex.Unlock()
+
+	return ch
+}
+
+// unlisten stops sending events to a channel from listen
+func (w *Worker) unlisten(ch chan JobEvent) {
+	w.jmutex.Lock()
+	delete(w.listeners, ch)
+	w.jmutex.Unlock()
+}
+
+// publishJobEvent passes a step of the job to every state sender, without
+// ever blocking.  Jobs the server didn't schedule have no ID to tie their
+// events together, so they are left out.
+func (w *Worker) publishJobEvent(job CompileJob, t JobEventType) {
+	if job.ID == (GUID{}) {
+		return
+	}
+
+	e := JobEvent{
+		ID:     job.ID,
+		Type:   t,
+		Client: MachineName{Host: job.Host},
+		File:   job.Build.Input(),
+	}
+
+	w.jmutex.Lock()
+	defer w.jmutex.Unlock()
+
+	for ch := range w.listeners {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// jobCounts returns the current running and queued job counts
+func (w *Worker) jobCounts() (running int, queued int) {
+	w.jmutex.Lock()
+	defer w.jmutex.Unlock()
+
+	return w.running, w.queued
+}
+
+// runningFiles returns the source files of the running jobs
+func (w *Worker) runningFiles() []string {
+	w.jmutex.Lock()
+	defer w.jmutex.Unlock()
+
+	return append([]string{}, w.files...)
+}
+
+// isDraining returns true once Drain has been called
+func (w *Worker) isDraining() bool {
+	w.jmutex.Lock()
+	defer w.jmutex.Unlock()
+
+	return w.draining
+}
+
+// updateServer will do it's best to maintain a connection to every server,
+// and send them WorkerState updates.  With no servers given we use
+// auto-discovery to find one.
+func (w *Worker) updateServer(addrs []net.IPNet) {
 	// Get host name
 	hostname, err := os.Hostname()
 
@@ -101,9 +478,39 @@ func (w *Worker) updateServer(addrs []net.IPNet) {
 		log.Fatal("Could not find hostname: ", err)
 	}
 
-	useAuto := len(w.saddr) == 0
+	// Let finishDrain know we have said goodbye to the servers
+	defer close(w.done)
 
-	for {
+	servers := SplitList(w.saddr)
+
+	if len(servers) == 0 {
+		w.serverLoop("", hostname, addrs)
+		return
+	}
+
+	var wg sync.WaitGroup
+
+	for _, saddr := range servers {
+		wg.Add(1)
+
+		go func(saddr string) {
+			defer wg.Done()
+			w.serverLoop(saddr, hostname, addrs)
+		}(saddr)
+	}
+
+	wg.Wait()
+}
+
+// serverLoop keeps a connection to one server until the worker stops,
+// using auto-discovery when the address is empty
+func (w *Worker) serverLoop(server string, hostname string, addrs []net.IPNet) {
+	// How often we try to establish a connection
+	interval := time.Duration(1) * time.Second
+
+	useAuto := len(server) == 0
+
+	for !w.stopped() {
 		// Use auto-discovery to find the server
 		var saddr string
 
@@ -117,7 +524,7 @@ func (w *Worker) updateServer(addrs []net.IPNet) {
 				continue
 			}
 		} else {
-			saddr = addPortIfNeeded(w.saddr, DefaultServerPort)
+			saddr = addPortIfNeeded(server, DefaultServerPort)
 		}
 
 		// Open up
@@ -132,9 +539,13 @@ func (w *Worker) updateServer(addrs []net.IPNet) {
 			continue
 		}
 
-		// Send updates
+		// Listen for commands from the server while we send updates
+		go w.readServer(mc)
+
 		err = w.sendWorkerState(mc, hostname, addrs)
 
+		mc.Close()
+
 		if err != nil {
 			log.Print("Error sending message to server: ", err)
 			time.Sleep(interval)
@@ -143,30 +554,68 @@ func (w *Worker) updateServer(addrs []net.IPNet) {
 	}
 }
 
+// readServer handles the commands the server sends us, until the
+// connection is closed
+func (w *Worker) readServer(mc *MessageConn) {
+	// The server only sends when it wants something, so never time out
+	cmds := NewMessageConn(mc.conn, 0)
+
+	for {
+		_, msg, err := cmds.Read()
+
+		if err != nil {
+			DebugPrint("Server command connection closed: ", err)
+			return
+		}
+
+		switch msg.(type) {
+		case DrainRequest:
+			w.Drain()
+		default:
+			log.Print("Un-handled server command: ", reflect.TypeOf(msg).Name())
+		}
+	}
+}
+
 // sendWorkerState sends updates to our server until the connection
-// fails
+// fails.  An update is sent as soon as a job starts or finishes, and
+// otherwise every workerHeartbeat.
 func (w *Worker) sendWorkerState(mc *MessageConn, host string, addrs []net.IPNet) error {
-	// Get capacity
-	capacity := runtime.NumCPU()
+	changed := w.watch()
+	defer w.unwatch(changed)
+
+	events := w.listen()
+	defer w.unlisten(events)
 
 	for {
-		// Get the current load
-		load, err := GetLoadAverage()
+		// Checked first so the last update we send shows we are stopping
+		last := w.stopped()
+
+		// Get the current jobs and memory
+		running, queued := w.jobCounts()
+
+		mem, err := GetFreeMemory()
 
 		if err != nil {
-			load = 0
-			log.Print("Error getting load: ", err)
+			mem = 0
+			log.Print("Error getting free memory: ", err)
 		}
 
 		// Update the state with the latest information
 		ws := WorkerState{
-			ID:       w.id,
-			Host:     host,
-			Addrs:    addrs,
-			Port:     w.port,
-			Capacity: capacity,
-			Load:     int(math.Ceil(load)),
-			Updated:  time.Now(),
+			ID:         w.id,
+			Host:       host,
+			Addrs:      addrs,
+			Port:       w.port,
+			Capacity:   w.jobs,
+			Load:       running,
+			Queued:     queued,
+			FreeMemory: mem,
+			Updated:    time.Now(),
+			Draining:   w.isDraining(),
+			Benchmark:  w.bench,
+			Files:      w.runningFiles(),
+			Compilers:  w.compilers,
 		}
 
 		err = mc.Send(ws)
@@ -176,13 +625,69 @@ func (w *Worker) sendWorkerState(mc *MessageConn, host string, addrs []net.IPNet
 		}
 
 		// Bail out if this is the end
-		if !w.run {
+		if last {
 			break
 		}
 
-		// Wait for the next send
-		time.Sleep(time.Duration(5) * time.Second)
+		// Wait for a job change or the next heartbeat, passing along the
+		// events of our jobs in the meantime
+		heartbeat := time.After(workerHeartbeat)
+
+	Wait:
+		for {
+			select {
+			case e := <-events:
+				e.Worker = MachineName{ID: w.id, Host: host}
+
+				if err = mc.Send(e); err != nil {
+					return err
+				}
+			case <-changed:
+				break Wait
+			case <-heartbeat:
+				break Wait
+			}
+		}
 	}
 
 	return nil
 }
+
+// DrainWorker asks the server to drain the worker with the given host name
+// or machine ID, returning the workers that were told to drain.  The first
+// reachable server of a comma separated list is used, and if no server is
+// given auto-discovery is used to find one.
+func DrainWorker(saddr string, worker string) ([]MachineName, error) {
+	mc, err := connectServer(saddr, time.Duration(10)*time.Second)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer mc.Close()
+
+	err = mc.Send(DrainRequest{Worker: worker})
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, msg, err := mc.Read()
+
+	if err != nil {
+		return nil, err
+	}
+
+	r, ok := msg.(DrainResponse)
+
+	if !ok {
+		return nil, fmt.Errorf("Unexpected drain response: %s",
+			reflect.TypeOf(msg).Name())
+	}
+
+	if len(r.Workers) == 0 {
+		return nil, fmt.Errorf("No worker found matching: %s", worker)
+	}
+
+	return r.Workers, nil
+}
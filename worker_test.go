@@ -1,14 +1,16 @@
 package cbd
 
 import (
+	"context"
 	"net"
+	"runtime"
 	"testing"
 	"time"
 )
 
 func TestSendWorkerState(t *testing.T) {
 	// Create and check our worker
-	w, err := NewWorker(57, "server:89")
+	w, err := NewWorker(57, "server:89", 2)
 
 	if err != nil {
 		t.Error("Making worker:", err)
@@ -43,7 +45,425 @@ func TestSendWorkerState(t *testing.T) {
 		t.Errorf("Got host \"%s\" wanted %s", s.Host, "bob")
 	}
 
-	if s.Load <= 0 {
-		t.Errorf("Bad system load")
+	if s.Load != 0 {
+		t.Errorf("Got load %d wanted 0", s.Load)
 	}
+
+	if s.FreeMemory == 0 {
+		t.Errorf("Bad free memory")
+	}
+}
+
+func TestWorkerJobEvents(t *testing.T) {
+	w, err := NewWorker(57, "", 2)
+
+	if err != nil {
+		t.Fatal("Making worker:", err)
+	}
+
+	events := w.listen()
+
+	// Jobs the server didn't schedule are left out
+	w.publishJobEvent(CompileJob{}, JobCompileStart)
+
+	job := CompileJob{
+		ID:    NewGUID(),
+		Host:  "laptop",
+		Build: Build{Args: []string{"-c", "main.c"}, Iindex: 1},
+	}
+
+	w.publishJobEvent(job, JobCompileEnd)
+
+	select {
+	case e := <-events:
+		if e.ID != job.ID || e.Type != JobCompileEnd || e.File != "main.c" ||
+			e.Client.Host != "laptop" {
+			t.Errorf("Bad event: %+v", e)
+		}
+	default:
+		t.Fatal("No event published")
+	}
+
+	if len(events) != 0 {
+		t.Error("Unexpected event: ", <-events)
+	}
+
+	// Once we stop listening nothing more comes
+	w.unlisten(events)
+	w.publishJobEvent(job, JobCompileStart)
+
+	if len(events) != 0 {
+		t.Error("Event after unlisten: ", <-events)
+	}
+}
+
+func TestWorkerJobTracking(t *testing.T) {
+	w, err := NewWorker(57, "server:89", 2)
+
+	if err != nil {
+		t.Error("Making worker:", err)
+		return
+	}
+
+	// Starting jobs should signal the state senders
+	changed := w.watch()
+	other := w.watch()
+
+	if !w.reserve() {
+		t.Error("Could not reserve a place for a job")
+	}
+
+	w.startJob("")
+
+	for _, ch := range []chan bool{changed, other} {
+		select {
+		case <-ch:
+		default:
+			t.Error("Job change did not signal an update")
+		}
+	}
+
+	w.unwatch(changed)
+	w.unwatch(other)
+
+	// The next update should report the running job
+	var network MockConn
+	mc := NewMessageConn(&network, time.Duration(10)*time.Second)
+
+	w.run = false
+	w.sendWorkerState(mc, "bob", nil)
+
+	s, err := mc.ReadWorkerState()
+
+	if err != nil {
+		t.Error("Reading worker state:", err)
+		return
+	}
+
+	if s.Load != 1 {
+		t.Errorf("Got load %d wanted 1", s.Load)
+	}
+
+	if s.Queued != 0 {
+		t.Errorf("Got queued %d wanted 0", s.Queued)
+	}
+}
+
+func TestWorkerAdmission(t *testing.T) {
+	w, err := NewWorker(57, "server:89", 1)
+
+	if err != nil {
+		t.Error("Making worker:", err)
+		return
+	}
+
+	// One job running and one waiting fills up the worker
+	if !w.reserve() {
+		t.Error("Could not reserve a place for the first job")
+	}
+
+	w.startJob("")
+
+	if !w.reserve() {
+		t.Error("Could not reserve a place for the second job")
+	}
+
+	if w.reserve() {
+		t.Error("Worker accepted a job with a full queue")
+	}
+
+	// Finishing the running job lets the queued one start
+	started := make(chan bool)
+
+	go func() {
+		w.startJob("")
+		started <- true
+	}()
+
+	select {
+	case <-started:
+		t.Error("Job started while all slots were full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	w.finishJob("")
+	<-started
+
+	running, queued := w.jobCounts()
+
+	if running != 1 || queued != 0 {
+		t.Errorf("Got running %d queued %d wanted 1 and 0", running, queued)
+	}
+
+	// Which leaves space for another job
+	if !w.reserve() {
+		t.Error("Could not reserve a place after a job finished")
+	}
+}
+
+func TestWorkerBusyResponse(t *testing.T) {
+	w, err := NewWorker(57, "server:89", 1)
+
+	if err != nil {
+		t.Error("Making worker:", err)
+		return
+	}
+
+	// Fill up the worker
+	w.reserve()
+	w.reserve()
+
+	// Send it a job and make sure it gets bounced back
+	var network MockConn
+	mc := NewMessageConn(&network, time.Duration(10)*time.Second)
+
+	mc.Send(CompileJob{})
+
+	w.handleRequest(&network)
+
+	r, err := mc.ReadCompileResult()
+
+	if err != nil {
+		t.Error("Reading compile result:", err)
+		return
+	}
+
+	if !r.Busy {
+		t.Error("Worker did not report being busy")
+	}
+}
+
+func TestWorkerDrain(t *testing.T) {
+	drainPoll = 10 * time.Millisecond
+	drainGrace = 50 * time.Millisecond
+
+	w, err := NewWorker(57, "server:89", 2)
+
+	if err != nil {
+		t.Error("Making worker:", err)
+		return
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Error("Listening:", err)
+		return
+	}
+
+	w.ln = ln
+
+	// Stand in for the server connection saying goodbye
+	go func() {
+		for !w.stopped() {
+			time.Sleep(drainPoll)
+		}
+		close(w.done)
+	}()
+
+	// Drain with a job running
+	w.reserve()
+	w.startJob("")
+	w.Drain()
+
+	// The server is told right away
+	var network MockConn
+	mc := NewMessageConn(&network, time.Duration(10)*time.Second)
+
+	w.stop()
+	w.sendWorkerState(mc, "bob", nil)
+
+	w.jmutex.Lock()
+	w.run = true
+	w.jmutex.Unlock()
+
+	if s, _ := mc.ReadWorkerState(); !s.Draining {
+		t.Error("Worker state should show draining")
+	}
+
+	// We stay up until the job is done
+	time.Sleep(5 * drainGrace)
+
+	if w.stopped() {
+		t.Error("Worker stopped with a job running")
+	}
+
+	w.finishJob("")
+
+	// Then shut down, closing our listener
+	accepted := make(chan error)
+
+	go func() {
+		_, err := ln.Accept()
+		accepted <- err
+	}()
+
+	select {
+	case err = <-accepted:
+		if err == nil {
+			t.Error("Listener should of been closed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Worker never finished draining")
+		ln.Close()
+	}
+
+	if !w.stopped() {
+		t.Error("Drained worker should be stopped")
+	}
+}
+
+// Stands in for a server, collecting the states sent by one worker.  The
+// channel is closed when the worker disconnects.
+func fakeServer(t *testing.T) (net.Listener, chan WorkerState) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("Listen error: ", err)
+	}
+
+	states := make(chan WorkerState, 10)
+
+	go func() {
+		defer close(states)
+
+		conn, err := ln.Accept()
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		mc := NewMessageConn(conn, 5*time.Second)
+
+		for {
+			ws, err := mc.ReadWorkerState()
+
+			if err != nil {
+				return
+			}
+
+			states <- ws
+		}
+	}()
+
+	return ln, states
+}
+
+func TestWorkerShutdown(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	sln, states := fakeServer(t)
+	defer sln.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("Listen error: ", err)
+	}
+
+	w, err := NewWorker(ln.Addr().(*net.TCPAddr).Port, sln.Addr().String(), 1)
+
+	if err != nil {
+		t.Fatal("Making worker:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+
+	go func() {
+		served <- w.Serve(ctx, ln)
+	}()
+
+	if ws := <-states; ws.Draining {
+		t.Error("Worker should not start out draining")
+	}
+
+	cancel()
+
+	select {
+	case err = <-served:
+		if err != nil {
+			t.Error("Serve error: ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+
+	// The server heard we were leaving, then the connection closed
+	var last WorkerState
+
+	for ws := range states {
+		last = ws
+	}
+
+	if !last.Draining {
+		t.Error("Last state should of been draining")
+	}
+
+	for i := 0; runtime.NumGoroutine() > before && i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("Leaked goroutines, had %d now %d", before, n)
+	}
+}
+
+func TestWorkerMultipleServers(t *testing.T) {
+	first, firstStates := fakeServer(t)
+	defer first.Close()
+
+	second, secondStates := fakeServer(t)
+	defer second.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("Listen error: ", err)
+	}
+
+	saddr := first.Addr().String() + ", " + second.Addr().String()
+
+	w, err := NewWorker(ln.Addr().(*net.TCPAddr).Port, saddr, 1)
+
+	if err != nil {
+		t.Fatal("Making worker:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+
+	go func() {
+		served <- w.Serve(ctx, ln)
+	}()
+
+	// Both servers hear from us, and hear about job changes
+	for _, states := range []chan WorkerState{firstStates, secondStates} {
+		select {
+		case <-states:
+		case <-time.After(5 * time.Second):
+			t.Error("Server never got a worker state")
+		}
+	}
+
+	w.reserve()
+	w.startJob("")
+
+	for _, states := range []chan WorkerState{firstStates, secondStates} {
+		select {
+		case ws := <-states:
+			if ws.Load != 1 {
+				t.Errorf("Got load %d wanted 1", ws.Load)
+			}
+		case <-time.After(time.Second):
+			t.Error("Server never got the job change")
+		}
+	}
+
+	w.finishJob("")
+
+	cancel()
+	<-served
 }